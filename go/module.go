@@ -1,7 +1,11 @@
 package main
 
 import (
+	"os"
+
 	"go.viam.com/rdk/components/generic"
+	"go.viam.com/rdk/components/sensor"
+	"go.viam.com/rdk/logging"
 	"go.viam.com/rdk/module"
 	"go.viam.com/utils"
 
@@ -12,6 +16,12 @@ import (
 )
 
 func main() {
+	// a self update starts this binary again as the watchdog that verifies the new module
+	if len(os.Args) > 1 && os.Args[1] == update_module.SelfUpdateWatchdogArg {
+		utils.ContextualMain(update_module.RunSelfUpdateWatchdog, logging.NewLogger(module_utils.LoggerName))
+		return
+	}
 	moduleutils.AddModularResource(generic.API, update_module.Model)
+	moduleutils.AddModularResource(sensor.API, update_module.StatusModel)
 	utils.ContextualMain(moduleutils.RunModule, module.NewLoggerFromArgs(module_utils.LoggerName))
 }
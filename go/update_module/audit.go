@@ -0,0 +1,306 @@
+package update_module
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.viam.com/utils/rpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	auditLogFile = "audit.jsonl"
+	// the log is rotated to audit.jsonl.1 .. audit.jsonl.<auditLogBackups> when it reaches maxAuditLogSize
+	maxAuditLogSize     = 1 << 20
+	auditLogBackups     = 3
+	defaultAuditResults = 100
+
+	auditOutcomeOk    = "ok"
+	auditOutcomeError = "error"
+)
+
+var errInvalidAuditQuery = errors.New("invalid audit_log query")
+
+type auditEntryKey struct{}
+
+// auditEntry is one line of the audit log
+type auditEntry struct {
+	Time    time.Time `json:"time"`
+	Command string    `json:"command"`
+	// Caller identifies the client that sent the command as far as the request context tells
+	Caller map[string]string `json:"caller,omitempty"`
+	// ApiKeyName and CredentialSource are the credentials the command used to reach app or the machine
+	ApiKeyName       string `json:"api_key_name,omitempty"`
+	CredentialSource string `json:"credential_source,omitempty"`
+	// Params is the command with secrets redacted
+	Params map[string]interface{} `json:"params,omitempty"`
+	// ConfigHashBefore and ConfigHashAfter are sha256 hashes of the part config a command changed
+	ConfigHashBefore string `json:"config_hash_before,omitempty"`
+	ConfigHashAfter  string `json:"config_hash_after,omitempty"`
+	Outcome          string `json:"outcome"`
+	Error            string `json:"error,omitempty"`
+	DurationMs       int64  `json:"duration_ms"`
+}
+
+// newAuditEntry starts an audit entry for a command, it is written by writeAudit once the command returns
+func newAuditEntry(ctx context.Context, command string, cmd map[string]interface{}) *auditEntry {
+	params := redactCommand(cmd)
+	delete(params, "command")
+	return &auditEntry{Time: time.Now().UTC(), Command: command, Caller: callerFromContext(ctx), Params: params}
+}
+
+// callerFromContext collects what the request context says about who sent the command
+func callerFromContext(ctx context.Context) map[string]string {
+	caller := map[string]string{}
+	if entity, ok := rpc.ContextAuthEntity(ctx); ok {
+		caller["entity"] = entity.Entity
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		caller["peer"] = p.Addr.String()
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ua := md.Get("user-agent"); len(ua) > 0 {
+			caller["user_agent"] = ua[0]
+		}
+	}
+	if len(caller) == 0 {
+		return nil
+	}
+	return caller
+}
+
+func withAuditEntry(ctx context.Context, e *auditEntry) context.Context {
+	return context.WithValue(ctx, auditEntryKey{}, e)
+}
+
+func auditEntryFromContext(ctx context.Context) *auditEntry {
+	e, _ := ctx.Value(auditEntryKey{}).(*auditEntry)
+	return e
+}
+
+// auditCredentials records the credentials a command used, if the command is being audited
+func auditCredentials(ctx context.Context, creds *credentials) {
+	if e := auditEntryFromContext(ctx); e != nil && creds != nil {
+		e.ApiKeyName = creds.entity
+		e.CredentialSource = creds.source
+	}
+}
+
+// auditConfigHashes records the part config before and after a command changed it
+func auditConfigHashes(ctx context.Context, before string, after *structpb.Struct) {
+	if e := auditEntryFromContext(ctx); e != nil {
+		e.ConfigHashBefore = before
+		e.ConfigHashAfter = configHash(after)
+	}
+}
+
+// configHash returns a sha256 of the config as JSON, or "" if there is no config
+func configHash(conf *structpb.Struct) string {
+	if conf == nil {
+		return ""
+	}
+	// encoding/json sorts map keys, so equal configs hash the same
+	data, err := json.Marshal(conf.AsMap())
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeAudit completes the entry with the command's outcome and appends it to the audit log
+func (b *RobotUpdateModule) writeAudit(e *auditEntry, err error) {
+	e.DurationMs = time.Since(e.Time).Milliseconds()
+	e.Outcome = auditOutcomeOk
+	if err != nil {
+		e.Outcome = auditOutcomeError
+		e.Error = err.Error()
+	}
+	line, jsonErr := json.Marshal(e)
+	if jsonErr != nil {
+		b.logger.Errorf("Error encoding audit entry: %v", jsonErr)
+		return
+	}
+
+	b.auditMu.Lock()
+	defer b.auditMu.Unlock()
+	if err := appendAuditLine(append(line, '\n')); err != nil {
+		b.logger.Errorf("Error writing audit log: %v", err)
+	}
+}
+
+func appendAuditLine(line []byte) error {
+	dir, err := dataDir()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, auditLogFile)
+	if fi, err := os.Stat(path); err == nil && fi.Size()+int64(len(line)) > maxAuditLogSize {
+		if err := rotateAuditLog(path); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rotateAuditLog shifts audit.jsonl.N to N+1, dropping the oldest, and moves the current log to .1
+func rotateAuditLog(path string) error {
+	if err := os.Remove(fmt.Sprintf("%s.%d", path, auditLogBackups)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for i := auditLogBackups - 1; i > 0; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(path, path+".1")
+}
+
+// readAuditLog returns the entries of the current and rotated logs, oldest first
+func readAuditLog() ([]auditEntry, error) {
+	dir, err := dataDir()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, auditLogFile)
+	var entries []auditEntry
+	for i := auditLogBackups; i >= 0; i-- {
+		p := path
+		if i > 0 {
+			p = fmt.Sprintf("%s.%d", path, i)
+		}
+		f, err := os.Open(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), maxAuditLogSize)
+		for scanner.Scan() {
+			var e auditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				// a torn write from a crash, keep reading
+				continue
+			}
+			entries = append(entries, e)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// auditLog handles the audit_log command. since and until are RFC3339 times, audit_command limits the
+// results to one command and limit (default 100) keeps the most recent matches.
+func (b *RobotUpdateModule) auditLog(cmd map[string]interface{}) (map[string]interface{}, error) {
+	since, err := timeFromRequest(cmd, "since")
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	until, err := timeFromRequest(cmd, "until")
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	command, _ := cmd["audit_command"].(string)
+	limit := defaultAuditResults
+	if _, ok := cmd["limit"]; ok {
+		l, err := intFromRequest(cmd, "limit")
+		if err != nil || l <= 0 {
+			err = fmt.Errorf("%w: limit must be a positive number", errInvalidAuditQuery)
+			return map[string]interface{}{"error": err.Error()}, err
+		}
+		limit = l
+	}
+
+	b.auditMu.Lock()
+	entries, err := readAuditLog()
+	b.auditMu.Unlock()
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+
+	matches := []interface{}{}
+	for _, e := range entries {
+		if !since.IsZero() && e.Time.Before(since) {
+			continue
+		}
+		if !until.IsZero() && e.Time.After(until) {
+			continue
+		}
+		if command != "" && e.Command != command {
+			continue
+		}
+		// round trip through JSON so the response only holds types DoCommand can encode
+		data, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal(data, &m); err != nil {
+			continue
+		}
+		matches = append(matches, m)
+	}
+	if len(matches) > limit {
+		matches = matches[len(matches)-limit:]
+	}
+	return map[string]interface{}{"ok": 1, "entries": matches}, nil
+}
+
+// timeFromRequest reads an optional RFC3339 time, returning the zero time if it is not set
+func timeFromRequest(cmd map[string]interface{}, key string) (time.Time, error) {
+	v, ok := cmd[key]
+	if !ok {
+		return time.Time{}, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("%w: %s must be an RFC3339 string", errInvalidAuditQuery, key)
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %s: %v", errInvalidAuditQuery, key, err)
+	}
+	return t, nil
+}
+
+// intFromRequest reads a whole number, DoCommand numbers arrive as float64 but in process callers may
+// pass back the integers they were given
+func intFromRequest(cmd map[string]interface{}, key string) (int, error) {
+	switch v := cmd[key].(type) {
+	case float64:
+		if v == float64(int(v)) {
+			return int(v), nil
+		}
+	case int:
+		return v, nil
+	case int64:
+		return int(v), nil
+	case uint64:
+		return int(v), nil
+	}
+	return 0, fmt.Errorf("%s must be a whole number", key)
+}
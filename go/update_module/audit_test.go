@@ -0,0 +1,119 @@
+package update_module
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.viam.com/rdk/logging"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestAuditLog(t *testing.T) {
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	ctx := context.Background()
+	manager := &fakeServiceManager{}
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: ctx, serviceManager: manager}
+
+	start := time.Now().UTC().Add(-time.Second)
+	_, err := module.DoCommand(ctx, map[string]interface{}{"command": "set_credentials", "apiKeyName": "key-id", "apiKey": "secret"})
+	require.NoError(t, err)
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "restart", "delay_seconds": 0})
+	require.NoError(t, err)
+	manager.restartErr = assert.AnError
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "restart", "delay_seconds": 0})
+	require.Error(t, err)
+	// commands that only report an error in the response are audited as failed
+	resp, err := module.DoCommand(ctx, map[string]interface{}{"command": "restart_on_rdk_update", "version": ""})
+	require.NoError(t, err)
+	require.Contains(t, resp, "error")
+	// read only commands are not audited
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "pending_restart"})
+	require.NoError(t, err)
+
+	dir, err := dataDir()
+	require.NoError(t, err)
+	data, err := os.ReadFile(filepath.Join(dir, auditLogFile))
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "secret")
+
+	resp, err = module.DoCommand(ctx, map[string]interface{}{"command": "audit_log", "since": start.Format(time.RFC3339)})
+	require.NoError(t, err)
+	entries := resp["entries"].([]interface{})
+	require.Len(t, entries, 4)
+	first := entries[0].(map[string]interface{})
+	assert.Equal(t, "set_credentials", first["command"])
+	assert.Equal(t, redacted, first["params"].(map[string]interface{})["apiKey"])
+	assert.Equal(t, auditOutcomeOk, first["outcome"])
+	failed := entries[2].(map[string]interface{})
+	assert.Equal(t, auditOutcomeError, failed["outcome"])
+	assert.Contains(t, failed["error"], assert.AnError.Error())
+	refused := entries[3].(map[string]interface{})
+	assert.Equal(t, auditOutcomeError, refused["outcome"])
+	assert.Equal(t, "no version provided", refused["error"])
+
+	resp, err = module.DoCommand(ctx, map[string]interface{}{"command": "audit_log", "audit_command": "restart", "limit": 1})
+	require.NoError(t, err)
+	entries = resp["entries"].([]interface{})
+	require.Len(t, entries, 1)
+	assert.Equal(t, auditOutcomeError, entries[0].(map[string]interface{})["outcome"])
+
+	resp, err = module.DoCommand(ctx, map[string]interface{}{"command": "audit_log", "until": start.Format(time.RFC3339)})
+	require.NoError(t, err)
+	assert.Empty(t, resp["entries"])
+
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "audit_log", "since": "yesterday"})
+	assert.ErrorIs(t, err, errInvalidAuditQuery)
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t)}
+
+	padding := strings.Repeat("x", maxAuditLogSize/3)
+	for i := 0; i < 12; i++ {
+		module.writeAudit(&auditEntry{Time: time.Now(), Command: "restart", Params: map[string]interface{}{"i": i, "padding": padding}}, nil)
+	}
+	dir, err := dataDir()
+	require.NoError(t, err)
+	for i := 1; i <= auditLogBackups; i++ {
+		assert.FileExists(t, filepath.Join(dir, fmt.Sprintf("%s.%d", auditLogFile, i)))
+	}
+	assert.NoFileExists(t, filepath.Join(dir, fmt.Sprintf("%s.%d", auditLogFile, auditLogBackups+1)))
+
+	entries, err := readAuditLog()
+	require.NoError(t, err)
+	require.NotEmpty(t, entries)
+	assert.Less(t, len(entries), 12)
+	// the oldest entries were dropped, the rest are in order
+	assert.EqualValues(t, 11, entries[len(entries)-1].Params["i"])
+	for i := 1; i < len(entries); i++ {
+		assert.Greater(t, entries[i].Params["i"], entries[i-1].Params["i"])
+	}
+}
+
+func TestAuditConfigHashes(t *testing.T) {
+	defer os.Remove("testdata/UpdateRobotPartRequest.json")
+	ctx := context.Background()
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: ctx}
+
+	a, err := structpb.NewStruct(map[string]interface{}{"fragments": []interface{}{"a"}, "components": []interface{}{}})
+	require.NoError(t, err)
+	b, err := structpb.NewStruct(map[string]interface{}{"components": []interface{}{}, "fragments": []interface{}{"a"}})
+	require.NoError(t, err)
+	assert.Equal(t, configHash(a), configHash(b))
+	assert.Empty(t, configHash(nil))
+
+	entry := &auditEntry{}
+	_, err = module.updateFragment(withAuditEntry(ctx, entry), &MockAppServiceClient{}, "3bf2974e-59af-409c-bed1-afc1c73d029b", "abf95d7c-424a-49f2-b861-9ce999eac2fa", "6abb7bab-769c-4a31-a13b-0f7efa7ab670")
+	require.NoError(t, err)
+	assert.NotEmpty(t, entry.ConfigHashBefore)
+	assert.NotEmpty(t, entry.ConfigHashAfter)
+	assert.NotEqual(t, entry.ConfigHashBefore, entry.ConfigHashAfter)
+}
@@ -0,0 +1,708 @@
+package update_module
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	rdkconfig "go.viam.com/rdk/config"
+)
+
+const (
+	// an offline update bundle is a tarball, optionally gzipped, with a signed manifest at its root
+	bundleManifestFile  = "manifest.json"
+	bundleSignatureFile = "manifest.sig"
+	// bundles are unpacked here while they are verified and staged
+	bundlesDir = "bundles"
+	// maxBundleManifestSize caps what is read of the manifest and its signature before they are verified
+	maxBundleManifestSize = 1 << 20
+)
+
+var (
+	// viamCacheDir is where viam-agent keeps the viam-server binaries viamServerBinary points at
+	viamCacheDir = "/opt/viam/cache"
+	// offlineModulesDir holds the modules staged from bundles, they run as local modules
+	offlineModulesDir = filepath.Join(rdkconfig.ViamDotDir, "offline_modules")
+	// cachedConfigPath is the config viam-server caches for the part and starts from when it can't reach
+	// app
+	cachedConfigPath = func(partId string) string {
+		return filepath.Join(rdkconfig.ViamDotDir, fmt.Sprintf("cached_cloud_config_%s.json", partId))
+	}
+	// maxBundleSize caps the unpacked size of a bundle, gzip included, and the total of the files its
+	// manifest lists
+	maxBundleSize int64 = 8 << 30
+	// agentArch is the architecture suffix viam-agent names viam-server binaries with
+	agentArch = map[string]string{"amd64": "x86_64", "arm64": "aarch64", "arm": "armv7l"}
+
+	// namedConfigLists are the lists of the cached config a config overlay merges into by name
+	namedConfigLists = []string{"components", "services", "modules", "processes", "remotes", "packages"}
+
+	errBundlePathMissing = errors.New("no bundle path provided")
+	errInvalidBundle     = errors.New("invalid update bundle")
+	errNoSigningKeys     = errors.New("no signing_keys configured to verify signatures with")
+	errBundleChecksum    = errors.New("bundle file checksum mismatch")
+	errInvalidSigningKey = errors.New("invalid signing key")
+	errNoCachedConfig    = errors.New("no cached config to apply the bundle to, viam-server has not started online yet")
+)
+
+// bundleFile is a file in the bundle, by its path relative to the bundle root. Only as many bytes as Size
+// are unpacked for it.
+type bundleFile struct {
+	File   string `json:"file"`
+	Sha256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+type bundleViamServer struct {
+	bundleFile
+	Version string `json:"version"`
+}
+
+// bundleModule is a module archive, a tarball with the module's files, or a single executable. Modules
+// are run as local modules from where they are staged.
+type bundleModule struct {
+	bundleFile
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// Entrypoint is the executable in an archive, by default the entrypoint of its meta.json
+	Entrypoint string `json:"entrypoint,omitempty"`
+}
+
+// bundleManifest lists the contents of a bundle with their checksums. Only the manifest is signed.
+type bundleManifest struct {
+	ID            string            `json:"id"`
+	CreatedAt     time.Time         `json:"created_at"`
+	ViamServer    *bundleViamServer `json:"viam_server,omitempty"`
+	Modules       []bundleModule    `json:"modules,omitempty"`
+	ConfigOverlay *bundleFile       `json:"config_overlay,omitempty"`
+}
+
+func (m *bundleManifest) files() []bundleFile {
+	var files []bundleFile
+	if m.ViamServer != nil {
+		files = append(files, m.ViamServer.bundleFile)
+	}
+	for _, mod := range m.Modules {
+		files = append(files, mod.bundleFile)
+	}
+	if m.ConfigOverlay != nil {
+		files = append(files, *m.ConfigOverlay)
+	}
+	return files
+}
+
+func (m *bundleManifest) toMap() map[string]interface{} {
+	resp := map[string]interface{}{"id": m.ID}
+	if !m.CreatedAt.IsZero() {
+		resp["created_at"] = m.CreatedAt.Format(time.RFC3339)
+	}
+	if m.ViamServer != nil {
+		resp["viam_server_version"] = m.ViamServer.Version
+	}
+	modules := make([]interface{}, 0, len(m.Modules))
+	for _, mod := range m.Modules {
+		modules = append(modules, map[string]interface{}{"name": mod.Name, "version": mod.Version})
+	}
+	resp["modules"] = modules
+	resp["config_overlay"] = m.ConfigOverlay != nil
+	return resp
+}
+
+// updateBundle is a bundle unpacked into dir, verified against its manifest
+type updateBundle struct {
+	dir      string
+	manifest bundleManifest
+}
+
+func (u *updateBundle) path(f bundleFile) string {
+	return filepath.Join(u.dir, filepath.FromSlash(f.File))
+}
+
+func (u *updateBundle) Close() error {
+	return os.RemoveAll(u.dir)
+}
+
+func fileSha256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// newTarReader reads a tarball, gzipped or not. The returned func closes the gzip reader.
+func newTarReader(r io.Reader) (*tar.Reader, func(), error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return tar.NewReader(gz), func() { gz.Close() }, nil
+	}
+	return tar.NewReader(br), func() {}, nil
+}
+
+// extractTar unpacks a tarball, gzipped or not, into dir. Only regular files and directories inside dir
+// are accepted.
+func extractTar(r io.Reader, dir string) error {
+	tr, closeTar, err := newTarReader(r)
+	if err != nil {
+		return err
+	}
+	defer closeTar()
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(h.Name)
+		if filepath.IsAbs(name) || !filepath.IsLocal(name) {
+			return fmt.Errorf("%w: %s is outside of the archive", errInvalidBundle, h.Name)
+		}
+		target := filepath.Join(dir, name)
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := writeTarFile(tr, target, h.Mode, -1); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: %s is not a regular file or directory", errInvalidBundle, h.Name)
+		}
+	}
+}
+
+// writeTarFile writes the current tar entry to target. With size at or above zero it refuses entries
+// longer than size.
+func writeTarFile(r io.Reader, target string, mode int64, size int64) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(mode)&0o755|0o600)
+	if err != nil {
+		return err
+	}
+	if size >= 0 {
+		r = io.LimitReader(r, size+1)
+	}
+	n, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && size >= 0 && n > size {
+		err = fmt.Errorf("%w: %s is larger than the %d bytes in the manifest", errInvalidBundle, filepath.Base(target), size)
+	}
+	return err
+}
+
+// bundleName is the cleaned, slash separated name of a file in a bundle
+func bundleName(name string) string {
+	return filepath.ToSlash(filepath.Clean(filepath.FromSlash(name)))
+}
+
+// walkBundle calls visit with every regular file of the bundle at path, by its cleaned name, reading no
+// more than maxBundleSize of the unpacked tarball
+func walkBundle(path string, visit func(name string, h *tar.Header, r io.Reader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr, closeTar, err := newTarReader(f)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidBundle, err)
+	}
+	defer closeTar()
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidBundle, err)
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		if h.Size > maxBundleSize {
+			return fmt.Errorf("%w: %s is larger than %d bytes", errInvalidBundle, h.Name, maxBundleSize)
+		}
+		if err := visit(bundleName(h.Name), h, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// openBundle verifies the manifest signature of the bundle at path, then unpacks only the files the
+// manifest lists and verifies their checksums. Close the bundle to remove the unpacked files.
+func openBundle(path string, keys []string) (*updateBundle, error) {
+	if len(keys) == 0 {
+		return nil, errNoSigningKeys
+	}
+	manifest, err := readBundleManifest(path, keys)
+	if err != nil {
+		return nil, err
+	}
+	data, err := dataDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(data, bundlesDir), 0o700); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(filepath.Join(data, bundlesDir), "bundle-")
+	if err != nil {
+		return nil, err
+	}
+	u := &updateBundle{dir: dir, manifest: *manifest}
+	if err := u.extract(path); err != nil {
+		u.Close()
+		return nil, err
+	}
+	return u, nil
+}
+
+// readBundleManifest reads the manifest and its signature from the bundle without unpacking anything,
+// and verifies the signature before the manifest is parsed
+func readBundleManifest(path string, keys []string) (*bundleManifest, error) {
+	var data, sig []byte
+	err := walkBundle(path, func(name string, h *tar.Header, r io.Reader) error {
+		var dst *[]byte
+		switch name {
+		case bundleManifestFile:
+			dst = &data
+		case bundleSignatureFile:
+			dst = &sig
+		default:
+			return nil
+		}
+		if h.Size > maxBundleManifestSize {
+			return fmt.Errorf("%w: %s is larger than %d bytes", errInvalidBundle, name, maxBundleManifestSize)
+		}
+		read, err := io.ReadAll(io.LimitReader(r, maxBundleManifestSize))
+		*dst = read
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, fmt.Errorf("%w: the bundle has no %s", errInvalidBundle, bundleManifestFile)
+	}
+	if sig == nil {
+		return nil, fmt.Errorf("%w: the bundle has no %s", errArtifactUnsigned, bundleSignatureFile)
+	}
+	if _, err := verifySignature(bytes.NewReader(data), sig, keys); err != nil {
+		return nil, fmt.Errorf("bundle manifest: %w", err)
+	}
+	var manifest bundleManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidBundle, err)
+	}
+	if err := manifest.validate(); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// validPathElement is true for names used as a single element of a path, like module names and versions
+func validPathElement(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, `/\`) && filepath.IsLocal(s)
+}
+
+func (m *bundleManifest) validate() error {
+	if m.ID == "" {
+		return fmt.Errorf("%w: the manifest has no id", errInvalidBundle)
+	}
+	if s := m.ViamServer; s != nil && !validPathElement(s.Version) {
+		return fmt.Errorf("%w: viam_server needs a version without path separators", errInvalidBundle)
+	}
+	for _, mod := range m.Modules {
+		if !validPathElement(mod.Name) || !validPathElement(mod.Version) {
+			return fmt.Errorf("%w: modules need a name and version without path separators", errInvalidBundle)
+		}
+	}
+	var total int64
+	for _, file := range m.files() {
+		name := bundleName(file.File)
+		if !filepath.IsLocal(filepath.FromSlash(name)) || name == bundleManifestFile || name == bundleSignatureFile {
+			return fmt.Errorf("%w: %s is outside of the bundle", errInvalidBundle, file.File)
+		}
+		if file.Size <= 0 {
+			return fmt.Errorf("%w: %s has no size", errInvalidBundle, file.File)
+		}
+		total += file.Size
+		if total > maxBundleSize {
+			return fmt.Errorf("%w: the files are larger than %d bytes", errInvalidBundle, maxBundleSize)
+		}
+	}
+	return nil
+}
+
+// extract unpacks the files the manifest lists, each up to its size, and verifies their checksums
+func (u *updateBundle) extract(path string) error {
+	listed := map[string]bundleFile{}
+	for _, file := range u.manifest.files() {
+		listed[bundleName(file.File)] = file
+	}
+	extracted := map[string]bool{}
+	err := walkBundle(path, func(name string, h *tar.Header, r io.Reader) error {
+		file, ok := listed[name]
+		if !ok || extracted[name] {
+			return nil
+		}
+		if h.Size != file.Size {
+			return fmt.Errorf("%w: %s has %d bytes, the manifest lists %d", errInvalidBundle, name, h.Size, file.Size)
+		}
+		extracted[name] = true
+		return writeTarFile(r, u.path(file), h.Mode, file.Size)
+	})
+	if err != nil {
+		return err
+	}
+	for name, file := range listed {
+		if !extracted[name] {
+			return fmt.Errorf("%w: %s is missing", errInvalidBundle, file.File)
+		}
+		sum, err := fileSha256(u.path(file))
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidBundle, err)
+		}
+		if !strings.EqualFold(sum, file.Sha256) {
+			return fmt.Errorf("%w: %s", errBundleChecksum, file.File)
+		}
+	}
+	return nil
+}
+
+// copyFile copies src to a temporary file next to dst and renames it into place
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, in)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// cachedViamServer is where viam-agent keeps the viam-server binary of a version
+func cachedViamServer(version string) string {
+	arch, ok := agentArch[runtime.GOARCH]
+	if !ok {
+		arch = runtime.GOARCH
+	}
+	return filepath.Join(viamCacheDir, fmt.Sprintf("viam-server-v%s-%s", strings.TrimPrefix(version, "v"), arch))
+}
+
+// stageViamServer copies the bundle's viam-server into viam-agent's cache and points viamServerBinary at
+// it, returning the previous target
+func (u *updateBundle) stageViamServer() (string, error) {
+	s := u.manifest.ViamServer
+	target := cachedViamServer(s.Version)
+	if err := copyFile(u.path(s.bundleFile), target, 0o755); err != nil {
+		return "", err
+	}
+	previous, err := os.Readlink(viamServerBinary)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	return previous, replaceSymlink(target, viamServerBinary)
+}
+
+// replaceSymlink points link at target in one rename, so viam-agent never sees it missing
+func replaceSymlink(target, link string) error {
+	tmp := link + ".bundle"
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, link)
+}
+
+// stageModule unpacks or copies a module into offlineModulesDir, returning its executable
+func (u *updateBundle) stageModule(m bundleModule) (string, error) {
+	dir := filepath.Join(offlineModulesDir, m.Name, m.Version)
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	src := u.path(m.bundleFile)
+	if !strings.HasSuffix(m.File, ".tar.gz") && !strings.HasSuffix(m.File, ".tgz") && !strings.HasSuffix(m.File, ".tar") {
+		exe := filepath.Join(dir, filepath.Base(src))
+		return exe, copyFile(src, exe, 0o755)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := extractTar(f, dir); err != nil {
+		return "", fmt.Errorf("unpacking module %s: %w", m.Name, err)
+	}
+	entrypoint := m.Entrypoint
+	if entrypoint == "" {
+		var meta struct {
+			Entrypoint string `json:"entrypoint"`
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "meta.json"))
+		if err != nil {
+			return "", fmt.Errorf("module %s has no entrypoint: %w", m.Name, err)
+		}
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return "", fmt.Errorf("module %s has no entrypoint: %w", m.Name, err)
+		}
+		entrypoint = meta.Entrypoint
+	}
+	if entrypoint == "" || !filepath.IsLocal(filepath.FromSlash(entrypoint)) {
+		return "", fmt.Errorf("%w: module %s has no entrypoint in the archive", errInvalidBundle, m.Name)
+	}
+	exe := filepath.Join(dir, filepath.FromSlash(entrypoint))
+	if err := checkExecutable(exe); err != nil {
+		return "", err
+	}
+	return exe, nil
+}
+
+// mergeConfigOverlay applies the overlay to a config. Entries of the named lists replace the entry with
+// the same name or are added, other fields replace the config's.
+func mergeConfigOverlay(conf, overlay map[string]interface{}) {
+	named := map[string]bool{}
+	for _, field := range namedConfigLists {
+		named[field] = true
+	}
+	for field, v := range overlay {
+		entries, isList := v.([]interface{})
+		if !named[field] || !isList {
+			conf[field] = v
+			continue
+		}
+		existing, _ := conf[field].([]interface{})
+		for _, e := range entries {
+			entry, _ := e.(map[string]interface{})
+			name, _ := entry["name"].(string)
+			replaced := false
+			for i, have := range existing {
+				if h, ok := have.(map[string]interface{}); ok && name != "" && h["name"] == name {
+					existing[i] = e
+					replaced = true
+					break
+				}
+			}
+			if !replaced {
+				existing = append(existing, e)
+			}
+		}
+		conf[field] = existing
+	}
+}
+
+// applyToCachedConfig writes the bundle's config overlay and its modules, run from where they were
+// staged, to the part's cached config. It returns the cached config as it was.
+func (u *updateBundle) applyToCachedConfig(partId string, modules map[string]string) ([]byte, error) {
+	path := cachedConfigPath(partId)
+	before, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNoCachedConfig
+	}
+	if err != nil {
+		return nil, err
+	}
+	var conf map[string]interface{}
+	if err := json.Unmarshal(before, &conf); err != nil {
+		return nil, fmt.Errorf("reading the cached config: %w", err)
+	}
+	if u.manifest.ConfigOverlay != nil {
+		data, err := os.ReadFile(u.path(*u.manifest.ConfigOverlay))
+		if err != nil {
+			return nil, err
+		}
+		var overlay map[string]interface{}
+		if err := json.Unmarshal(data, &overlay); err != nil {
+			return nil, fmt.Errorf("%w: config overlay: %v", errInvalidBundle, err)
+		}
+		mergeConfigOverlay(conf, overlay)
+	}
+	var entries []interface{}
+	for _, name := range sortedKeys(modules) {
+		entries = append(entries, map[string]interface{}{"type": "local", "name": name, "executable_path": modules[name]})
+	}
+	if len(entries) > 0 {
+		mergeConfigOverlay(conf, map[string]interface{}{"modules": entries})
+	}
+	data, err := json.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+	return before, writeFileAtomic(path, data)
+}
+
+// writeFileAtomic replaces the file keeping its mode, so readers see the old or the new contents
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0o600)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	tmp := path + ".bundle"
+	if err := os.WriteFile(tmp, data, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (b *RobotUpdateModule) signingKeys() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cfg == nil {
+		return nil
+	}
+	return b.cfg.SigningKeys
+}
+
+// verifyBundle handles the verify_bundle command, checking a bundle without applying it
+func (b *RobotUpdateModule) verifyBundle(cmd map[string]interface{}) (map[string]interface{}, error) {
+	path, _ := cmd["path"].(string)
+	if path == "" {
+		return map[string]interface{}{"error": errBundlePathMissing.Error()}, errBundlePathMissing
+	}
+	u, err := openBundle(path, b.signingKeys())
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	defer u.Close()
+	return map[string]interface{}{"ok": 1, "bundle": u.manifest.toMap()}, nil
+}
+
+// applyBundle handles the apply_bundle command for machines without cloud access. It verifies the bundle
+// at path, stages its modules and viam-server, applies its config to the part's cached config and
+// restarts viam-agent, at or after delay_seconds like restart, unless restart is false.
+func (b *RobotUpdateModule) applyBundle(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	path, _ := cmd["path"].(string)
+	if path == "" {
+		return map[string]interface{}{"error": errBundlePathMissing.Error()}, errBundlePathMissing
+	}
+	restart := true
+	if v, ok := cmd["restart"].(bool); ok {
+		restart = v
+	}
+	at, err := b.restartTimeFromRequest(cmd)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	partId, err := machinePartId()
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+
+	b.publishStep("apply_bundle", "verifying bundle")
+	u, err := openBundle(path, b.signingKeys())
+	if err != nil {
+		b.logger.Errorf("Refusing update bundle %s: %v", path, err)
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	defer u.Close()
+	params := map[string]string{"bundle_id": u.manifest.ID}
+	if u.manifest.ViamServer != nil {
+		params["viam_server_version"] = u.manifest.ViamServer.Version
+	}
+	b.notify(eventUpdateStarted, params, nil)
+	resp, err := b.stageBundle(u, partId)
+	if err := responseError(resp, err); err != nil {
+		b.notify(eventUpdateFailed, params, err)
+		return resp, err
+	}
+	b.notify(eventUpdateSucceeded, params, nil)
+
+	if !restart {
+		return resp, nil
+	}
+	op := operation{Command: "apply_bundle", Params: params}
+	if !at.After(time.Now()) {
+		if err := b.restartViamServer(ctx, op); err != nil {
+			resp["restart_error"] = err.Error()
+			return resp, err
+		}
+		return resp, nil
+	}
+	p := b.scheduleRestart(at, op, b.windowCheck(cmd))
+	resp["restart_at"] = p.at.Format(time.RFC3339)
+	return resp, nil
+}
+
+// stageBundle puts the bundle's files in place, undoing the cached config change if viam-server can't be
+// staged after it
+func (b *RobotUpdateModule) stageBundle(u *updateBundle, partId string) (map[string]interface{}, error) {
+	modules := map[string]string{}
+	for _, m := range u.manifest.Modules {
+		b.publishStep("apply_bundle", "staging module "+m.Name)
+		exe, err := u.stageModule(m)
+		if err != nil {
+			return map[string]interface{}{"error": err.Error()}, err
+		}
+		modules[m.Name] = exe
+	}
+	b.publishStep("apply_bundle", "applying config")
+	before, err := u.applyToCachedConfig(partId, modules)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	resp := map[string]interface{}{"ok": 1, "bundle": u.manifest.toMap()}
+	if s := u.manifest.ViamServer; s != nil {
+		b.publishStep("apply_bundle", "staging viam-server "+s.Version)
+		previous, err := u.stageViamServer()
+		if err != nil {
+			if restoreErr := writeFileAtomic(cachedConfigPath(partId), before); restoreErr != nil {
+				b.logger.Errorf("Error restoring the cached config: %v", restoreErr)
+			}
+			err = fmt.Errorf("staging viam-server: %w", err)
+			return map[string]interface{}{"error": err.Error()}, err
+		}
+		b.setTargetVersion(s.Version)
+		resp["previous_viam_server"] = previous
+	}
+	return resp, nil
+}
@@ -0,0 +1,240 @@
+package update_module
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.viam.com/rdk/logging"
+)
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeTar writes the files, by path, to a gzipped tarball
+func writeTar(t *testing.T, path string, files map[string][]byte) {
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for name, data := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o755, Size: int64(len(data)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+}
+
+// testBundleFile lists data in a manifest as file
+func testBundleFile(file string, data []byte) bundleFile {
+	return bundleFile{File: file, Sha256: sha256Hex(data), Size: int64(len(data))}
+}
+
+// testBundle is the contents of a bundle with viam-server, a module archive and a config overlay
+func testBundle(t *testing.T) (bundleManifest, map[string][]byte) {
+	moduleArchive := filepath.Join(t.TempDir(), "module.tar.gz")
+	writeTar(t, moduleArchive, map[string][]byte{
+		"meta.json":  []byte(`{"entrypoint": "bin/sensor"}`),
+		"bin/sensor": []byte("#!/bin/sh\n"),
+	})
+	archive, err := os.ReadFile(moduleArchive)
+	require.NoError(t, err)
+	files := map[string][]byte{
+		"viam-server":           []byte("viam-server 0.50.0"),
+		"modules/sensor.tar.gz": archive,
+		"config/overlay.json":   []byte(`{"components": [{"name": "cam", "model": "webcam"}, {"name": "arm", "model": "fake"}]}`),
+	}
+	overlay := testBundleFile("config/overlay.json", files["config/overlay.json"])
+	manifest := bundleManifest{
+		ID:            "field-1",
+		ViamServer:    &bundleViamServer{bundleFile: testBundleFile("viam-server", files["viam-server"]), Version: "0.50.0"},
+		Modules:       []bundleModule{{bundleFile: testBundleFile("modules/sensor.tar.gz", archive), Name: "sensor", Version: "1.0.0"}},
+		ConfigOverlay: &overlay,
+	}
+	return manifest, files
+}
+
+// writeBundle signs the manifest with key and writes the bundle
+func writeBundle(t *testing.T, key ed25519.PrivateKey, manifest bundleManifest, files map[string][]byte) string {
+	data, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	contents := map[string][]byte{
+		bundleManifestFile:  data,
+		bundleSignatureFile: []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))),
+	}
+	for name, f := range files {
+		contents[name] = f
+	}
+	path := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	writeTar(t, path, contents)
+	return path
+}
+
+func newSigningKey(t *testing.T) (string, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(pub), priv
+}
+
+func TestVerifyBundle(t *testing.T) {
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	pub, priv := newSigningKey(t)
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), cfg: &Config{SigningKeys: []string{pub}}}
+	manifest, files := testBundle(t)
+
+	resp, err := module.doCommand(context.Background(), map[string]interface{}{"command": "verify_bundle", "path": writeBundle(t, priv, manifest, files)})
+	require.NoError(t, err)
+	bundle := resp["bundle"].(map[string]interface{})
+	assert.Equal(t, "field-1", bundle["id"])
+	assert.Equal(t, "0.50.0", bundle["viam_server_version"])
+	dir, err := dataDir()
+	require.NoError(t, err)
+	unpacked, err := os.ReadDir(filepath.Join(dir, bundlesDir))
+	require.NoError(t, err)
+	assert.Empty(t, unpacked)
+
+	// a file that doesn't match the manifest
+	tampered := map[string][]byte{}
+	for k, v := range files {
+		tampered[k] = v
+	}
+	tampered["viam-server"] = []byte("viam-server 6.66.6")
+	_, err = module.verifyBundle(map[string]interface{}{"path": writeBundle(t, priv, manifest, tampered)})
+	assert.ErrorIs(t, err, errBundleChecksum)
+
+	// a file larger than the manifest lists
+	tampered["viam-server"] = []byte("viam-server 0.50.0 and then some")
+	_, err = module.verifyBundle(map[string]interface{}{"path": writeBundle(t, priv, manifest, tampered)})
+	assert.ErrorIs(t, err, errInvalidBundle)
+
+	// files the manifest doesn't list are not unpacked
+	extra := map[string][]byte{"unlisted": []byte("x")}
+	for k, v := range files {
+		extra[k] = v
+	}
+	u, err := openBundle(writeBundle(t, priv, manifest, extra), []string{pub})
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(u.dir, "unlisted"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	require.NoError(t, u.Close())
+
+	// a manifest signed by another key
+	_, other := newSigningKey(t)
+	_, err = module.verifyBundle(map[string]interface{}{"path": writeBundle(t, other, manifest, files)})
+	assert.ErrorIs(t, err, errArtifactSignature)
+
+	// an unsigned bundle
+	data, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	unsigned := filepath.Join(t.TempDir(), "unsigned.tar")
+	writeTar(t, unsigned, map[string][]byte{bundleManifestFile: data})
+	_, err = module.verifyBundle(map[string]interface{}{"path": unsigned})
+	assert.ErrorIs(t, err, errArtifactUnsigned)
+
+	// a file outside of the bundle
+	escaping := manifest
+	escaping.ConfigOverlay = &bundleFile{File: "../escaped", Sha256: sha256Hex([]byte("x")), Size: 1}
+	_, err = module.verifyBundle(map[string]interface{}{"path": writeBundle(t, priv, escaping, map[string][]byte{"../escaped": []byte("x")})})
+	assert.ErrorIs(t, err, errInvalidBundle)
+
+	// a viam-server version that would name a path outside of the cache
+	traversal := manifest
+	traversal.ViamServer = &bundleViamServer{bundleFile: manifest.ViamServer.bundleFile, Version: "../../../tmp/x"}
+	_, err = module.verifyBundle(map[string]interface{}{"path": writeBundle(t, priv, traversal, files)})
+	assert.ErrorIs(t, err, errInvalidBundle)
+
+	module.cfg.SigningKeys = nil
+	_, err = module.verifyBundle(map[string]interface{}{"path": writeBundle(t, priv, manifest, files)})
+	assert.ErrorIs(t, err, errNoSigningKeys)
+
+	_, err = (&Config{SigningKeys: []string{"bm90IGEga2V5"}}).Validate("path")
+	assert.ErrorIs(t, err, errInvalidSigningKey)
+}
+
+func TestApplyBundle(t *testing.T) {
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	ctx := context.Background()
+	pub, priv := newSigningKey(t)
+	root := t.TempDir()
+	defer func(binary, cache, modules string, cached func(string) string, partId func() (string, error)) {
+		viamServerBinary, viamCacheDir, offlineModulesDir, cachedConfigPath, machinePartId = binary, cache, modules, cached, partId
+	}(viamServerBinary, viamCacheDir, offlineModulesDir, cachedConfigPath, machinePartId)
+	viamServerBinary = filepath.Join(root, "bin", "viam-server")
+	viamCacheDir = filepath.Join(root, "cache")
+	offlineModulesDir = filepath.Join(root, "modules")
+	cachedConfigPath = func(partId string) string { return filepath.Join(root, "cached_cloud_config_"+partId+".json") }
+	machinePartId = func() (string, error) { return "part", nil }
+
+	require.NoError(t, os.MkdirAll(filepath.Dir(viamServerBinary), 0o755))
+	require.NoError(t, os.Symlink(filepath.Join(viamCacheDir, "viam-server-v0.49.0"), viamServerBinary))
+	cached := `{"cloud": {"id": "part"}, "components": [{"name": "cam", "model": "old"}], "modules": [{"name": "sensor", "type": "registry", "module_id": "acme:sensor"}]}`
+	require.NoError(t, os.WriteFile(cachedConfigPath("part"), []byte(cached), 0o600))
+
+	manager := &fakeServiceManager{}
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: ctx, cfg: &Config{SigningKeys: []string{pub}}, serviceManager: manager}
+	manifest, files := testBundle(t)
+	path := writeBundle(t, priv, manifest, files)
+
+	resp, err := module.doCommand(ctx, map[string]interface{}{"command": "apply_bundle", "path": path, "delay_seconds": 0})
+	require.NoError(t, err)
+	assert.Equal(t, 1, resp["ok"])
+	assert.Equal(t, filepath.Join(viamCacheDir, "viam-server-v0.49.0"), resp["previous_viam_server"])
+	assert.Equal(t, 1, manager.restartCount())
+
+	link, err := os.Readlink(viamServerBinary)
+	require.NoError(t, err)
+	staged, err := os.ReadFile(link)
+	require.NoError(t, err)
+	assert.Equal(t, files["viam-server"], staged)
+	y, err := isVersion("0.50.0")
+	require.NoError(t, err)
+	assert.True(t, y)
+
+	data, err := os.ReadFile(cachedConfigPath("part"))
+	require.NoError(t, err)
+	var conf map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &conf))
+	assert.Equal(t, map[string]interface{}{"id": "part"}, conf["cloud"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"name": "cam", "model": "webcam"},
+		map[string]interface{}{"name": "arm", "model": "fake"},
+	}, conf["components"])
+	exe := filepath.Join(offlineModulesDir, "sensor", "1.0.0", "bin", "sensor")
+	assert.Equal(t, []interface{}{map[string]interface{}{"name": "sensor", "type": "local", "executable_path": exe}}, conf["modules"])
+	assert.NoError(t, checkExecutable(exe))
+	events, _, _ := module.events.since(0)
+	assert.Contains(t, busEventTypes(events), eventUpdateSucceeded)
+
+	// without a cached config nothing is staged
+	require.NoError(t, os.Remove(cachedConfigPath("part")))
+	manifest.ViamServer.Version = "0.51.0"
+	_, err = module.doCommand(ctx, map[string]interface{}{"command": "apply_bundle", "path": writeBundle(t, priv, manifest, files), "restart": false})
+	assert.ErrorIs(t, err, errNoCachedConfig)
+	link, err = os.Readlink(viamServerBinary)
+	require.NoError(t, err)
+	assert.Contains(t, link, "0.50.0")
+	assert.Equal(t, 1, manager.restartCount())
+}
+
+func busEventTypes(events []busEvent) []string {
+	var types []string
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	return types
+}
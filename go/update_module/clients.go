@@ -0,0 +1,286 @@
+package update_module
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	app_proto "go.viam.com/api/app/v1"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/module"
+	"go.viam.com/rdk/robot/client"
+	"go.viam.com/utils/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+
+	configutils "github.com/thegreatco/viamutils/config"
+)
+
+const (
+	dialAttempts   = 4
+	maxDialBackoff = 10 * time.Second
+)
+
+var (
+	initialDialBackoff = 500 * time.Millisecond
+
+	// dialAppConn and dialRobotClient open new connections, tests replace them to avoid the network
+	dialAppConn = func(ctx context.Context, logger logging.Logger, creds *credentials) (rpc.ClientConn, error) {
+		return rpc.DialDirectGRPC(ctx, appAddress, logger, creds.dialOption())
+	}
+	dialRobotClient = func(ctx context.Context, logger logging.Logger, address string, creds *credentials) (*client.RobotClient, error) {
+		if creds == nil {
+			// the parent socket is only reachable by this module and needs no credentials
+			return client.New(ctx, address, logger, client.WithDisableSessions())
+		}
+		return client.New(ctx, address, logger, client.WithDialOptions(creds.dialOption()))
+	}
+	// moduleSocketArg is the module's own socket path, viam-server passes it as the first argument
+	moduleSocketArg = func() string {
+		if len(os.Args) < 2 {
+			return ""
+		}
+		return os.Args[1]
+	}
+
+	errNoParentSocket = errors.New("parent socket unknown, module not started by viam-server")
+)
+
+// clients are the long lived connections owned by the module, created lazily and rebuilt when they fail
+// or the credentials they were dialed with change
+type clients struct {
+	appConn      rpc.ClientConn
+	appClient    app_proto.AppServiceClient
+	appCreds     credentials
+	robotClient  *client.RobotClient
+	robotAddress string
+	robotCreds   credentials
+}
+
+// appConn is the dialed app connection, watching its calls for failures. utils wraps the gRPC
+// connection of a dial with credentials in a type that doesn't expose its state, so a call failing with
+// Unavailable is what marks the connection for redialing.
+type appConn struct {
+	rpc.ClientConn
+	failed atomic.Bool
+}
+
+func (c *appConn) Invoke(ctx context.Context, method string, args, reply any, opts ...grpc.CallOption) error {
+	err := c.ClientConn.Invoke(ctx, method, args, reply, opts...)
+	c.observe(err)
+	return err
+}
+
+func (c *appConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	stream, err := c.ClientConn.NewStream(ctx, desc, method, opts...)
+	c.observe(err)
+	return stream, err
+}
+
+func (c *appConn) observe(err error) {
+	if status.Code(err) == codes.Unavailable {
+		c.failed.Store(true)
+	}
+}
+
+// connHealthy reports whether the connection can be reused. An app connection whose calls failed as
+// unavailable is replaced, connections that don't expose their state otherwise are assumed healthy and
+// gRPC reconnects idle ones itself.
+func connHealthy(conn rpc.ClientConn) bool {
+	if c, ok := conn.(*appConn); ok {
+		if c.failed.Load() {
+			return false
+		}
+		conn = c.ClientConn
+	}
+	stater, ok := conn.(interface{ GetState() connectivity.State })
+	if !ok {
+		return true
+	}
+	switch stater.GetState() {
+	case connectivity.TransientFailure, connectivity.Shutdown:
+		return false
+	}
+	return true
+}
+
+// retryWithBackoff calls fn until it succeeds, the attempts run out or ctx is done
+func retryWithBackoff(ctx context.Context, logger logging.Logger, what string, attempts int, fn func(context.Context) error) error {
+	backoff := initialDialBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(ctx); err == nil {
+			return nil
+		}
+		if attempt >= attempts {
+			return fmt.Errorf("%s failed after %d attempts: %w", what, attempt, err)
+		}
+		logger.Warnf("%s failed, retrying in %v: %v", what, backoff, err)
+		select {
+		case <-ctx.Done():
+			return errors.Join(ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxDialBackoff)
+	}
+}
+
+// GetClient returns the cached app client, dialing a new one if there is none, it is unhealthy or it was
+// dialed with other credentials
+func (b *RobotUpdateModule) GetClient(ctx context.Context, creds *credentials) (app_proto.AppServiceClient, error) {
+	b.clientsMu.Lock()
+	defer b.clientsMu.Unlock()
+	c := &b.clients
+	if c.appClient != nil && c.appCreds == *creds && connHealthy(c.appConn) {
+		return c.appClient, nil
+	}
+	c.closeApp(b.logger)
+
+	var conn rpc.ClientConn
+	err := retryWithBackoff(ctx, b.logger, "dialing app", dialAttempts, func(ctx context.Context) error {
+		var err error
+		conn, err = dialAppConn(ctx, b.logger, creds)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.appConn = &appConn{ClientConn: conn}
+	c.appClient = app_proto.NewAppServiceClient(c.appConn)
+	c.appCreds = *creds
+	return c.appClient, nil
+}
+
+// parentAddress returns the address of the viam-server that started this module. viam-server creates
+// its socket, parent.sock, in the same directory as the module sockets.
+func parentAddress() (string, error) {
+	socket := moduleSocketArg()
+	if socket == "" {
+		return "", errNoParentSocket
+	}
+	addr, err := module.CreateSocketAddress(filepath.Dir(socket), "parent")
+	if err != nil {
+		return "", err
+	}
+	return "unix://" + addr, nil
+}
+
+// getRobotClient returns a client for the viam-server this module runs under, over the local parent
+// socket. The cloud FQDN, which needs credentials and connectivity, is only used when the local
+// connection fails and fallback_to_cloud_fqdn is set. Each address is dialed up to attempts times.
+func (b *RobotUpdateModule) getRobotClient(ctx context.Context, cmd map[string]interface{}, attempts int) (*client.RobotClient, error) {
+	b.mu.Lock()
+	fallback := b.cfg != nil && b.cfg.FallbackToCloudFqdn
+	b.mu.Unlock()
+
+	address, err := parentAddress()
+	if err == nil {
+		var rc *client.RobotClient
+		rc, err = b.cachedRobotClient(ctx, address, nil, attempts)
+		if err == nil {
+			return rc, nil
+		}
+	}
+	if !fallback {
+		return nil, err
+	}
+	b.logger.Warnf("Error connecting to viam-server over the parent socket, falling back to the cloud FQDN: %v", err)
+
+	creds, err := b.getCredentials(cmd)
+	if err != nil {
+		return nil, err
+	}
+	auditCredentials(ctx, creds)
+	config, err := configutils.GetMachineConfig()
+	if err != nil {
+		return nil, err
+	}
+	return b.cachedRobotClient(ctx, config.Cloud.FQDN, creds, attempts)
+}
+
+// cachedRobotClient returns the cached robot client if it is connected to the address with the same
+// credentials, otherwise it dials a new one
+func (b *RobotUpdateModule) cachedRobotClient(ctx context.Context, address string, creds *credentials, attempts int) (*client.RobotClient, error) {
+	b.clientsMu.Lock()
+	defer b.clientsMu.Unlock()
+	c := &b.clients
+	var key credentials
+	if creds != nil {
+		key = *creds
+	}
+	if c.robotClient != nil && c.robotAddress == address && c.robotCreds == key && c.robotClient.Connected() {
+		return c.robotClient, nil
+	}
+	c.closeRobot(ctx, b.logger)
+
+	var robotClient *client.RobotClient
+	err := retryWithBackoff(ctx, b.logger, "dialing robot", attempts, func(ctx context.Context) error {
+		var err error
+		robotClient, err = dialRobotClient(ctx, b.logger, address, creds)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.robotClient = robotClient
+	c.robotAddress = address
+	c.robotCreds = key
+	return robotClient, nil
+}
+
+// closeClients closes all cached connections, they are redialed on next use
+func (b *RobotUpdateModule) closeClients(ctx context.Context) {
+	b.clientsMu.Lock()
+	defer b.clientsMu.Unlock()
+	b.clients.closeApp(b.logger)
+	b.clients.closeRobot(ctx, b.logger)
+}
+
+func (c *clients) closeApp(logger logging.Logger) {
+	if c.appConn == nil {
+		return
+	}
+	if err := c.appConn.Close(); err != nil {
+		logger.Debugf("Error closing app connection: %v", err)
+	}
+	c.appConn = nil
+	c.appClient = nil
+	c.appCreds = credentials{}
+}
+
+func (c *clients) closeRobot(ctx context.Context, logger logging.Logger) {
+	if c.robotClient == nil {
+		return
+	}
+	if err := c.robotClient.Close(ctx); err != nil {
+		logger.Debugf("Error closing robot client: %v", err)
+	}
+	c.robotClient = nil
+	c.robotAddress = ""
+	c.robotCreds = credentials{}
+}
+
+// credentialsChanged reports whether a new config may resolve to different credentials
+func credentialsChanged(old, new *Config) bool {
+	if old == nil || new == nil {
+		return old != new
+	}
+	if old.ApiKeyName != new.ApiKeyName || old.ApiKey != new.ApiKey || old.DisallowInlineCredentials != new.DisallowInlineCredentials {
+		return true
+	}
+	if len(old.CredentialSources) != len(new.CredentialSources) {
+		return true
+	}
+	for i := range old.CredentialSources {
+		if old.CredentialSources[i] != new.CredentialSources[i] {
+			return true
+		}
+	}
+	return false
+}
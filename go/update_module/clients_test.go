@@ -0,0 +1,165 @@
+package update_module
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/viamrobotics/webrtc/v3"
+	app_proto "go.viam.com/api/app/v1"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/utils/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+)
+
+type fakeClientConn struct {
+	grpc.ClientConnInterface
+	state  connectivity.State
+	closed bool
+}
+
+func (c *fakeClientConn) PeerConn() *webrtc.PeerConnection { return nil }
+func (c *fakeClientConn) Close() error                     { c.closed = true; return nil }
+func (c *fakeClientConn) GetState() connectivity.State     { return c.state }
+
+func TestCachedAppClient(t *testing.T) {
+	logger := logging.NewTestLogger(t)
+	ctx := context.Background()
+
+	var dialed []*fakeClientConn
+	failures := 0
+	defer func(backoff time.Duration) { initialDialBackoff = backoff }(initialDialBackoff)
+	initialDialBackoff = time.Millisecond
+	defer func(dial func(context.Context, logging.Logger, *credentials) (rpc.ClientConn, error)) {
+		dialAppConn = dial
+	}(dialAppConn)
+	dialAppConn = func(ctx context.Context, logger logging.Logger, creds *credentials) (rpc.ClientConn, error) {
+		if failures > 0 {
+			failures--
+			return nil, errors.New("unavailable")
+		}
+		conn := &fakeClientConn{state: connectivity.Ready}
+		dialed = append(dialed, conn)
+		return conn, nil
+	}
+
+	module := RobotUpdateModule{logger: logger, ctx: ctx}
+	creds := apiKeyCredentials("key_name", "key", credentialSourceConfig)
+
+	first, err := module.GetClient(ctx, creds)
+	require.NoError(t, err)
+	second, err := module.GetClient(ctx, creds)
+	require.NoError(t, err)
+	assert.Same(t, first, second)
+	assert.Len(t, dialed, 1)
+
+	// a failed connection is replaced, retrying with backoff
+	dialed[0].state = connectivity.TransientFailure
+	failures = 1
+	_, err = module.GetClient(ctx, creds)
+	require.NoError(t, err)
+	assert.Len(t, dialed, 2)
+	assert.True(t, dialed[0].closed)
+
+	// new credentials get a new connection
+	_, err = module.GetClient(ctx, apiKeyCredentials("other_name", "other", credentialSourceRequest))
+	require.NoError(t, err)
+	assert.Len(t, dialed, 3)
+	assert.True(t, dialed[1].closed)
+
+	failures = dialAttempts
+	dialed[2].state = connectivity.Shutdown
+	_, err = module.GetClient(ctx, creds)
+	assert.Error(t, err)
+
+	_, err = module.GetClient(ctx, creds)
+	require.NoError(t, err)
+	require.NoError(t, module.Close(ctx))
+	assert.True(t, dialed[3].closed)
+}
+
+func TestAppConnUnavailable(t *testing.T) {
+	logger := logging.NewTestLogger(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// utils only returns from dialing once connected, so the app is a gRPC server that is stopped later
+	serve := func(address string) (*grpc.Server, string) {
+		listener, err := net.Listen("tcp", address)
+		require.NoError(t, err)
+		server := grpc.NewServer()
+		go server.Serve(listener)
+		return server, listener.Addr().String()
+	}
+	server, address := serve("127.0.0.1:0")
+	var dialed []rpc.ClientConn
+	defer func(dial func(context.Context, logging.Logger, *credentials) (rpc.ClientConn, error)) {
+		dialAppConn = dial
+	}(dialAppConn)
+	dialAppConn = func(ctx context.Context, logger logging.Logger, creds *credentials) (rpc.ClientConn, error) {
+		conn, err := rpc.DialDirectGRPC(ctx, address, logger, creds.dialOption(), rpc.WithInsecure())
+		if err == nil {
+			dialed = append(dialed, conn)
+		}
+		return conn, err
+	}
+
+	module := RobotUpdateModule{logger: logger, ctx: ctx}
+	defer module.closeClients(ctx)
+	creds := apiKeyCredentials("key_name", "key", credentialSourceConfig)
+	client, err := module.GetClient(ctx, creds)
+	require.NoError(t, err)
+	require.Len(t, dialed, 1)
+	// the connection utils returns for a dial with credentials doesn't expose its state
+	_, ok := dialed[0].(interface{ GetState() connectivity.State })
+	assert.False(t, ok)
+	assert.True(t, connHealthy(module.clients.appConn))
+
+	server.Stop()
+	_, err = client.GetRobot(ctx, &app_proto.GetRobotRequest{Id: "robot"})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.False(t, connHealthy(module.clients.appConn))
+
+	// the failed connection is replaced once the app is back
+	server, _ = serve(address)
+	defer server.Stop()
+	_, err = module.GetClient(ctx, creds)
+	require.NoError(t, err)
+	assert.Len(t, dialed, 2)
+	assert.True(t, connHealthy(module.clients.appConn))
+}
+
+func TestCredentialsChanged(t *testing.T) {
+	assert.False(t, credentialsChanged(&Config{}, &Config{ServiceUnit: "viam-server"}))
+	assert.True(t, credentialsChanged(&Config{}, &Config{ApiKeyName: "a", ApiKey: "b"}))
+	assert.True(t, credentialsChanged(&Config{CredentialSources: []string{"env"}}, &Config{CredentialSources: []string{"file"}}))
+	assert.True(t, credentialsChanged(nil, &Config{}))
+}
+
+func TestParentAddress(t *testing.T) {
+	defer func(arg func() string) { moduleSocketArg = arg }(moduleSocketArg)
+
+	moduleSocketArg = func() string { return "" }
+	_, err := parentAddress()
+	assert.Equal(t, errNoParentSocket, err)
+
+	dir := t.TempDir()
+	moduleSocketArg = func() string { return filepath.Join(dir, "robot-update-abcde.sock") }
+	addr, err := parentAddress()
+	require.NoError(t, err)
+	assert.Equal(t, "unix://"+filepath.Join(dir, "parent.sock"), addr)
+
+	// without a parent and without the cloud fallback there is nothing to dial
+	moduleSocketArg = func() string { return "" }
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t)}
+	_, err = module.getRobotClient(context.Background(), map[string]interface{}{}, dialAttempts)
+	assert.Equal(t, errNoParentSocket, err)
+}
@@ -1,8 +1,168 @@
 package update_module
 
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
 type Config struct {
+	// ServiceManager selects how viam-agent is restarted, "systemd" (D-Bus, the default) or "systemctl"
+	ServiceManager string `json:"service_manager,omitempty"`
+	// ServiceUnit is the unit restarted by the restart commands, defaults to viam-agent
+	ServiceUnit string `json:"service_unit,omitempty"`
+	// RestartVerifyTimeoutSeconds is how long to wait for the unit to come back to active after a restart
+	RestartVerifyTimeoutSeconds int `json:"restart_verify_timeout_seconds,omitempty"`
+	// RestartDelaySeconds is how long restarts are deferred so the DoCommand response is delivered first,
+	// defaults to 5 seconds, 0 restarts synchronously
+	RestartDelaySeconds *float64 `json:"restart_delay_seconds,omitempty"`
+	// MaintenanceWindows limit when update, restart, restart_on_rdk_update, restore_snapshot,
+	// rollback_revision, self_update, apply_bundle and reconcile may run, none means any time
+	MaintenanceWindows []MaintenanceWindow `json:"maintenance_windows,omitempty"`
+	// MaintenancePolicy is the default for commands outside a window, "refuse" (the default), "queue" or "force"
+	MaintenancePolicy string `json:"maintenance_policy,omitempty"`
+	// InterlockResources are bases, arms, motors or gantries that must not be moving for disruptive commands
+	InterlockResources []string `json:"interlock_resources,omitempty"`
+	// StopInterlockResources stops moving interlock resources instead of refusing the command
+	StopInterlockResources bool `json:"stop_interlock_resources,omitempty"`
+	// Hooks run before and after disruptive commands
+	Hooks []Hook `json:"hooks,omitempty"`
+	// ApiKeyName and ApiKey are used when the config credential source is reached
+	ApiKeyName string `json:"api_key_name,omitempty"`
+	ApiKey     string `json:"api_key,omitempty"`
+	// CredentialSources is the order credentials are looked up in, defaults to
+	// request, config, env, file, machine_config, cloud
+	CredentialSources []string `json:"credential_sources,omitempty"`
+	// DisallowInlineCredentials rejects any command carrying apiKey, including set_credentials
+	DisallowInlineCredentials bool `json:"disallow_inline_credentials,omitempty"`
+	// FallbackToCloudFqdn dials the machine through its cloud FQDN when the local parent socket fails
+	FallbackToCloudFqdn bool `json:"fallback_to_cloud_fqdn,omitempty"`
+	// MetricsAddress is a host:port to serve Prometheus metrics on at /metrics, e.g. 127.0.0.1:9464. Metrics
+	// are always available through the metrics command.
+	MetricsAddress string `json:"metrics_address,omitempty"`
+	// Webhooks are notified of update and restart events
+	Webhooks []Webhook `json:"webhooks,omitempty"`
+	// DesiredState is the part config the reconciliation loop converges on, DesiredStateFile is a JSON
+	// file with the same document, read on every pass
+	DesiredState     *DesiredState `json:"desired_state,omitempty"`
+	DesiredStateFile string        `json:"desired_state_file,omitempty"`
+	// ReconcileIntervalSeconds is how often the part config is compared to the desired state, defaults to 300
+	ReconcileIntervalSeconds int `json:"reconcile_interval_seconds,omitempty"`
+	// ReconcileDryRun reports drift without changing the part config
+	ReconcileDryRun bool `json:"reconcile_dry_run,omitempty"`
+	// DriftBaselineFile is a saved part config detect_drift compares against, the desired state is used
+	// when it is unset
+	DriftBaselineFile string `json:"drift_baseline_file,omitempty"`
+	// DriftCheckIntervalSeconds checks for drift in the background so the status sensor reports it, 0 only
+	// checks on detect_drift
+	DriftCheckIntervalSeconds int `json:"drift_check_interval_seconds,omitempty"`
+	// SnapshotRetention is how many config snapshots are kept, defaults to 20, SnapshotMaxAgeDays also
+	// removes older snapshots. The newest snapshot is always kept.
+	SnapshotRetention  int `json:"snapshot_retention,omitempty"`
+	SnapshotMaxAgeDays int `json:"snapshot_max_age_days,omitempty"`
+	// ModuleName is this module's name in the part's modules for self_update, by default the entry with
+	// the module id viam-server started the module with
+	ModuleName string `json:"module_name,omitempty"`
+	// SigningKeys are base64 ed25519 or minisign public keys. Offline update bundles and, when any are set,
+	// viam-server binaries must be signed by one of them.
+	SigningKeys []string `json:"signing_keys,omitempty"`
+	// QueueOffline persists update commands that fail because the app can't be reached and retries them
+	// with backoff until it can be, OfflineQueueMaxAgeHours drops them after a while, defaults to 24
+	QueueOffline            bool `json:"queue_offline,omitempty"`
+	OfflineQueueMaxAgeHours int  `json:"offline_queue_max_age_hours,omitempty"`
 }
 
 func (cfg *Config) Validate(path string) ([]string, error) {
-	return nil, nil
+	if _, err := newServiceManager(cfg.ServiceManager); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if cfg.RestartVerifyTimeoutSeconds < 0 {
+		return nil, fmt.Errorf("%s: restart_verify_timeout_seconds must not be negative", path)
+	}
+	if cfg.RestartDelaySeconds != nil && *cfg.RestartDelaySeconds < 0 {
+		return nil, fmt.Errorf("%s: restart_delay_seconds must not be negative", path)
+	}
+	for i, w := range cfg.MaintenanceWindows {
+		if _, err := w.parse(); err != nil {
+			return nil, fmt.Errorf("%s.maintenance_windows.%d: %w", path, i, err)
+		}
+	}
+	if err := validateMaintenancePolicy(cfg.MaintenancePolicy); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, h := range cfg.Hooks {
+		if err := h.validate(); err != nil {
+			return nil, fmt.Errorf("%s.hooks.%d: %w", path, i, err)
+		}
+	}
+	if (cfg.ApiKeyName == "") != (cfg.ApiKey == "") {
+		return nil, fmt.Errorf("%s: api_key_name and api_key must be set together", path)
+	}
+	if err := validateCredentialSources(cfg.CredentialSources); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, w := range cfg.Webhooks {
+		if err := w.validate(); err != nil {
+			return nil, fmt.Errorf("%s.webhooks.%d: %w", path, i, err)
+		}
+	}
+	if cfg.DesiredState != nil && cfg.DesiredStateFile != "" {
+		return nil, fmt.Errorf("%s: desired_state and desired_state_file must not be set together", path)
+	}
+	if cfg.DesiredState != nil {
+		if err := cfg.DesiredState.validate(); err != nil {
+			return nil, fmt.Errorf("%s.desired_state: %w", path, err)
+		}
+	}
+	if cfg.ReconcileIntervalSeconds < 0 {
+		return nil, fmt.Errorf("%s: reconcile_interval_seconds must not be negative", path)
+	}
+	if cfg.DriftCheckIntervalSeconds < 0 {
+		return nil, fmt.Errorf("%s: drift_check_interval_seconds must not be negative", path)
+	}
+	if cfg.SnapshotRetention < 0 || cfg.SnapshotMaxAgeDays < 0 {
+		return nil, fmt.Errorf("%s: snapshot_retention and snapshot_max_age_days must not be negative", path)
+	}
+	if cfg.OfflineQueueMaxAgeHours < 0 {
+		return nil, fmt.Errorf("%s: offline_queue_max_age_hours must not be negative", path)
+	}
+	for i, k := range cfg.SigningKeys {
+		if _, err := parseSigningKey(k); err != nil {
+			return nil, fmt.Errorf("%s.signing_keys.%d: %w", path, i, err)
+		}
+	}
+	if cfg.MetricsAddress != "" {
+		if _, _, err := net.SplitHostPort(cfg.MetricsAddress); err != nil {
+			return nil, fmt.Errorf("%s: metrics_address: %w", path, err)
+		}
+	}
+	deps := make([]string, 0, len(cfg.InterlockResources))
+	for _, name := range cfg.InterlockResources {
+		if name == "" {
+			return nil, fmt.Errorf("%s: interlock_resources must not contain empty names", path)
+		}
+		deps = append(deps, name)
+	}
+	return deps, nil
+}
+
+func (cfg *Config) serviceUnit() string {
+	if cfg == nil || cfg.ServiceUnit == "" {
+		return defaultServiceUnit
+	}
+	return cfg.ServiceUnit
+}
+
+func (cfg *Config) restartVerifyTimeout() time.Duration {
+	if cfg == nil || cfg.RestartVerifyTimeoutSeconds == 0 {
+		return defaultRestartVerifyTimeout
+	}
+	return time.Duration(cfg.RestartVerifyTimeoutSeconds) * time.Second
+}
+
+func (cfg *Config) restartDelay() time.Duration {
+	if cfg == nil || cfg.RestartDelaySeconds == nil {
+		return defaultRestartDelay
+	}
+	return time.Duration(*cfg.RestartDelaySeconds * float64(time.Second))
 }
@@ -0,0 +1,313 @@
+package update_module
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	rdkutils "go.viam.com/rdk/utils"
+	"go.viam.com/utils/rpc"
+
+	configutils "github.com/thegreatco/viamutils/config"
+)
+
+const (
+	credentialSourceRequest       = "request"
+	credentialSourceConfig        = "config"
+	credentialSourceEnv           = "env"
+	credentialSourceFile          = "file"
+	credentialSourceMachineConfig = "machine_config"
+	credentialSourceCloud         = "cloud"
+
+	credentialsFile    = "credentials.json"
+	credentialsKeyFile = "credentials.key"
+	redacted           = "<redacted>"
+	apiKeyNameEnv      = "VIAM_API_KEY_ID"
+	apiKeyEnv          = "VIAM_API_KEY"
+)
+
+var (
+	defaultCredentialSources = []string{
+		credentialSourceRequest,
+		credentialSourceConfig,
+		credentialSourceEnv,
+		credentialSourceFile,
+		credentialSourceMachineConfig,
+		credentialSourceCloud,
+	}
+	// viamJsonPath is where viam-agent writes the machine's cloud id and secret
+	viamJsonPath = "/etc/viam.json"
+
+	// inlineSecretKeys are DoCommand fields that carry secrets and are never logged or stored
+	inlineSecretKeys = []string{"apiKey"}
+
+	errUnknownCredentialSource       = errors.New("unknown credential source")
+	errInlineCredentialsNotPermitted = errors.New("inline credentials are not permitted, use set_credentials or the component config")
+	errInvalidCredentialsKey         = errors.New("invalid credentials key")
+)
+
+// credentials are the entity and secret used to dial app and the machine
+type credentials struct {
+	entity   string
+	payload  string
+	credType rpc.CredentialsType
+	// source is the credential source the credentials were found in
+	source string
+}
+
+func (c *credentials) dialOption() rpc.DialOption {
+	return rpc.WithEntityCredentials(c.entity, rpc.Credentials{Type: c.credType, Payload: c.payload})
+}
+
+func apiKeyCredentials(apiKeyName, apiKey, source string) *credentials {
+	if apiKeyName == "" || apiKey == "" {
+		return nil
+	}
+	return &credentials{entity: apiKeyName, payload: apiKey, credType: rpc.CredentialsTypeAPIKey, source: source}
+}
+
+// credentialsFileContents is the format of the secrets file in the module data directory. set_credentials
+// writes the key encrypted into Ciphertext, a plaintext ApiKey is still accepted for hand provisioning.
+type credentialsFileContents struct {
+	ApiKeyName string `json:"api_key_name"`
+	ApiKey     string `json:"api_key,omitempty"`
+	Nonce      []byte `json:"nonce,omitempty"`
+	Ciphertext []byte `json:"ciphertext,omitempty"`
+}
+
+func validateCredentialSources(sources []string) error {
+	for _, s := range sources {
+		found := false
+		for _, d := range defaultCredentialSources {
+			found = found || s == d
+		}
+		if !found {
+			return fmt.Errorf("%w: %s", errUnknownCredentialSource, s)
+		}
+	}
+	return nil
+}
+
+// getCredentials walks the configured credential sources in order and returns the first credentials found
+func (b *RobotUpdateModule) getCredentials(cmd map[string]interface{}) (*credentials, error) {
+	b.mu.Lock()
+	cfg := b.cfg
+	b.mu.Unlock()
+	sources := defaultCredentialSources
+	if cfg != nil && len(cfg.CredentialSources) > 0 {
+		sources = cfg.CredentialSources
+	}
+
+	for _, source := range sources {
+		creds, err := credentialsFromSource(source, cfg, cmd)
+		if err != nil {
+			b.logger.Debugf("No credentials from %s: %v", source, err)
+			continue
+		}
+		if creds != nil {
+			b.logger.Infof("Using %s credentials from %s", creds.entity, creds.source)
+			return creds, nil
+		}
+	}
+	return nil, errCredentialsNotFound
+}
+
+// credentialsFromSource returns nil credentials when the source has none
+func credentialsFromSource(source string, cfg *Config, cmd map[string]interface{}) (*credentials, error) {
+	switch source {
+	case credentialSourceRequest:
+		if cfg != nil && cfg.DisallowInlineCredentials {
+			return nil, nil
+		}
+		apiKeyName, apiKey, err := getApiCredentialsFromRequest(cmd)
+		if err != nil {
+			return nil, err
+		}
+		return apiKeyCredentials(apiKeyName, apiKey, source), nil
+	case credentialSourceConfig:
+		if cfg == nil {
+			return nil, nil
+		}
+		return apiKeyCredentials(cfg.ApiKeyName, cfg.ApiKey, source), nil
+	case credentialSourceEnv:
+		return apiKeyCredentials(os.Getenv(apiKeyNameEnv), os.Getenv(apiKeyEnv), source), nil
+	case credentialSourceFile:
+		dir, err := dataDir()
+		if err != nil {
+			return nil, err
+		}
+		apiKeyName, apiKey, err := loadStoredCredentials(dir)
+		if err != nil {
+			return nil, err
+		}
+		return apiKeyCredentials(apiKeyName, apiKey, source), nil
+	case credentialSourceMachineConfig:
+		apiKeyName, apiKey, err := configutils.GetCredentialsFromConfig()
+		if err != nil {
+			return nil, err
+		}
+		return apiKeyCredentials(apiKeyName, apiKey, source), nil
+	case credentialSourceCloud:
+		data, err := os.ReadFile(viamJsonPath)
+		if err != nil {
+			return nil, err
+		}
+		var viamJson struct {
+			Cloud struct {
+				ID     string `json:"id"`
+				Secret string `json:"secret"`
+			} `json:"cloud"`
+		}
+		if err := json.Unmarshal(data, &viamJson); err != nil {
+			return nil, err
+		}
+		if viamJson.Cloud.ID == "" || viamJson.Cloud.Secret == "" {
+			return nil, nil
+		}
+		return &credentials{entity: viamJson.Cloud.ID, payload: viamJson.Cloud.Secret, credType: rdkutils.CredentialsTypeRobotSecret, source: source}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", errUnknownCredentialSource, source)
+}
+
+// hasInlineSecrets reports whether the command carries any secret fields
+func hasInlineSecrets(cmd map[string]interface{}) bool {
+	for _, k := range inlineSecretKeys {
+		if _, ok := cmd[k]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// redactCommand returns a copy of the command that is safe to log
+func redactCommand(cmd map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(cmd))
+	for k, v := range cmd {
+		out[k] = v
+	}
+	for _, k := range inlineSecretKeys {
+		if _, ok := out[k]; ok {
+			out[k] = redacted
+		}
+	}
+	return out
+}
+
+// setCredentials handles the set_credentials command, storing the API key encrypted in the data directory
+// so later commands don't need to carry it
+func (b *RobotUpdateModule) setCredentials(cmd map[string]interface{}) (map[string]interface{}, error) {
+	apiKeyName, apiKey, err := getApiCredentialsFromRequest(cmd)
+	if err != nil || apiKeyName == "" || apiKey == "" {
+		return map[string]interface{}{"error": errCredentialsNotFound.Error()}, errCredentialsNotFound
+	}
+	dir, err := dataDir()
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	if err := storeCredentials(dir, apiKeyName, apiKey); err != nil {
+		b.logger.Errorf("Error storing credentials: %v", err)
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	b.logger.Infof("Stored credentials for %s", apiKeyName)
+	return map[string]interface{}{"ok": 1, "apiKeyName": apiKeyName}, nil
+}
+
+// credentialsKey returns the key used to encrypt stored credentials, generating it on first use. The key
+// lives beside the credentials, so it only keeps the API key out of copies of the credentials file alone
+// (backups, support bundles). Anyone who can read the data directory can decrypt the credentials.
+func credentialsKey(dir string) ([]byte, error) {
+	path := filepath.Join(dir, credentialsKeyFile)
+	key, err := os.ReadFile(path)
+	if err == nil {
+		if len(key) != 32 {
+			// a new key would silently orphan the stored credentials
+			return nil, fmt.Errorf("%w: %s has %d bytes, remove it and set_credentials again", errInvalidCredentialsKey, path, len(key))
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key = make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if errors.Is(err, os.ErrExist) {
+		// another writer generated it first
+		return credentialsKey(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(key)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func credentialsCipher(dir string) (cipher.AEAD, error) {
+	key, err := credentialsKey(dir)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func storeCredentials(dir, apiKeyName, apiKey string) error {
+	gcm, err := credentialsCipher(dir)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	contents := credentialsFileContents{
+		ApiKeyName: apiKeyName,
+		Nonce:      nonce,
+		Ciphertext: gcm.Seal(nil, nonce, []byte(apiKey), []byte(apiKeyName)),
+	}
+	data, err := json.Marshal(contents)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, credentialsFile), data, 0o600)
+}
+
+func loadStoredCredentials(dir string) (string, string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, credentialsFile))
+	if err != nil {
+		return "", "", err
+	}
+	var contents credentialsFileContents
+	if err := json.Unmarshal(data, &contents); err != nil {
+		return "", "", err
+	}
+	if contents.Ciphertext == nil {
+		return contents.ApiKeyName, contents.ApiKey, nil
+	}
+	gcm, err := credentialsCipher(dir)
+	if err != nil {
+		return "", "", err
+	}
+	apiKey, err := gcm.Open(nil, contents.Nonce, contents.Ciphertext, []byte(contents.ApiKeyName))
+	if err != nil {
+		return "", "", fmt.Errorf("decrypting stored credentials: %w", err)
+	}
+	return contents.ApiKeyName, string(apiKey), nil
+}
@@ -0,0 +1,112 @@
+package update_module
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.viam.com/rdk/logging"
+	rdkutils "go.viam.com/rdk/utils"
+	"go.viam.com/utils/rpc"
+)
+
+func TestCredentialChain(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("VIAM_MODULE_DATA", dir)
+	t.Setenv(apiKeyNameEnv, "")
+	t.Setenv(apiKeyEnv, "")
+	defer func(path string) { viamJsonPath = path }(viamJsonPath)
+	viamJsonPath = "testdata/viam.json"
+
+	logger := logging.NewTestLogger(t)
+	cfg := &Config{ApiKeyName: "config_key_name", ApiKey: "config_key"}
+	module := RobotUpdateModule{logger: logger, cfg: cfg}
+	request := map[string]interface{}{"apiKeyName": "request_key_name", "apiKey": "request_key"}
+
+	creds, err := module.getCredentials(request)
+	require.NoError(t, err)
+	assert.Equal(t, credentialSourceRequest, creds.source)
+	assert.Equal(t, "request_key_name", creds.entity)
+
+	creds, err = module.getCredentials(map[string]interface{}{})
+	require.NoError(t, err)
+	assert.Equal(t, credentialSourceConfig, creds.source)
+	assert.Equal(t, "config_key", creds.payload)
+
+	cfg.CredentialSources = []string{credentialSourceEnv, credentialSourceFile, credentialSourceCloud, credentialSourceRequest}
+	creds, err = module.getCredentials(request)
+	require.NoError(t, err)
+	assert.Equal(t, credentialSourceCloud, creds.source)
+	assert.Equal(t, "cloud_id", creds.entity)
+	assert.Equal(t, rpc.CredentialsType(rdkutils.CredentialsTypeRobotSecret), creds.credType)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, credentialsFile), []byte(`{"api_key_name":"file_key_name","api_key":"file_key"}`), 0o600))
+	creds, err = module.getCredentials(request)
+	require.NoError(t, err)
+	assert.Equal(t, credentialSourceFile, creds.source)
+	assert.Equal(t, "file_key_name", creds.entity)
+
+	t.Setenv(apiKeyNameEnv, "env_key_name")
+	t.Setenv(apiKeyEnv, "env_key")
+	creds, err = module.getCredentials(request)
+	require.NoError(t, err)
+	assert.Equal(t, credentialSourceEnv, creds.source)
+	assert.Equal(t, rpc.CredentialsTypeAPIKey, creds.credType)
+
+	cfg.CredentialSources = []string{credentialSourceConfig}
+	cfg.ApiKeyName, cfg.ApiKey = "", ""
+	_, err = module.getCredentials(request)
+	assert.Equal(t, errCredentialsNotFound, err)
+
+	assert.ErrorIs(t, validateCredentialSources([]string{"env", "vault"}), errUnknownCredentialSource)
+}
+
+func TestSetCredentials(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("VIAM_MODULE_DATA", dir)
+	logger := logging.NewTestLogger(t)
+	ctx := context.Background()
+	cfg := &Config{CredentialSources: []string{credentialSourceFile}}
+	module := RobotUpdateModule{logger: logger, ctx: ctx, cfg: cfg}
+
+	resp, err := module.DoCommand(ctx, map[string]interface{}{"command": "set_credentials", "apiKeyName": "stored_key_name", "apiKey": "stored_key"})
+	require.NoError(t, err)
+	assert.Equal(t, "stored_key_name", resp["apiKeyName"])
+	assert.NotContains(t, resp, "apiKey")
+
+	// the key is not stored in plaintext
+	data, err := os.ReadFile(filepath.Join(dir, credentialsFile))
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), `"stored_key"`)
+
+	creds, err := module.getCredentials(map[string]interface{}{})
+	require.NoError(t, err)
+	assert.Equal(t, credentialSourceFile, creds.source)
+	assert.Equal(t, "stored_key", creds.payload)
+
+	// a damaged key is an error rather than replaced, which would lose the stored credentials
+	require.NoError(t, os.WriteFile(filepath.Join(dir, credentialsKeyFile), []byte("short"), 0o600))
+	_, err = credentialsKey(dir)
+	assert.ErrorIs(t, err, errInvalidCredentialsKey)
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "set_credentials", "apiKeyName": "other", "apiKey": "other"})
+	assert.ErrorIs(t, err, errInvalidCredentialsKey)
+	data, err = os.ReadFile(filepath.Join(dir, credentialsKeyFile))
+	require.NoError(t, err)
+	assert.Equal(t, "short", string(data))
+
+	cfg.DisallowInlineCredentials = true
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "set_credentials", "apiKeyName": "other", "apiKey": "other"})
+	assert.Equal(t, errInlineCredentialsNotPermitted, err)
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "restart", "apiKeyName": "other", "apiKey": "other"})
+	assert.Equal(t, errInlineCredentialsNotPermitted, err)
+
+	cfg.CredentialSources = []string{credentialSourceRequest}
+	_, err = module.getCredentials(map[string]interface{}{"apiKeyName": "other", "apiKey": "other"})
+	assert.Equal(t, errCredentialsNotFound, err)
+
+	assert.Equal(t, map[string]interface{}{"command": "update", "apiKeyName": "name", "apiKey": redacted},
+		redactCommand(map[string]interface{}{"command": "update", "apiKeyName": "name", "apiKey": "secret"}))
+}
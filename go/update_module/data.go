@@ -0,0 +1,60 @@
+package update_module
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"viam-robot-update-module/utils"
+)
+
+// dataDir returns the module's data directory, creating it if needed. viam-server provides it in
+// VIAM_MODULE_DATA, outside of viam-server a directory under the system temp dir is used.
+func dataDir() (string, error) {
+	dir := os.Getenv("VIAM_MODULE_DATA")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), utils.LoggerName)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// componentFile returns the path of name in the data directory for this component. Every component of
+// the module process shares the data directory, so state one component works through is kept apart by
+// its name.
+func (b *RobotUpdateModule) componentFile(name string) (string, error) {
+	dir, err := dataDir()
+	if err != nil {
+		return "", err
+	}
+	if c := b.componentName(); c != "" {
+		name = url.PathEscape(c) + "_" + name
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// lockDataFile serializes read-modify-write cycles of the file at path, mu between the goroutines of
+// this process and an flock on path.lock with other processes, like the self update watchdog. The
+// returned func releases both.
+func lockDataFile(mu *sync.Mutex, path string) (func(), error) {
+	mu.Lock()
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		mu.Unlock()
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		mu.Unlock()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+		mu.Unlock()
+	}, nil
+}
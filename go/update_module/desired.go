@@ -0,0 +1,248 @@
+package update_module
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	driftFragment       = "fragment"
+	driftAgentSubsystem = "agent_subsystem"
+	driftModule         = "module"
+
+	actionAdd        = "add"
+	actionRemove     = "remove"
+	actionSetVersion = "set_version"
+)
+
+var errInvalidDesiredState = errors.New("invalid desired state")
+
+// DesiredState is the part config the reconciliation loop converges on. Only what is listed is managed.
+type DesiredState struct {
+	// Fragments are all of the part's fragments, others are removed. Unset leaves the fragments alone.
+	Fragments []DesiredFragment `json:"fragments,omitempty"`
+	// AgentSubsystems pins viam-agent subsystems, e.g. viam-server, to versions, "" removes the pin
+	AgentSubsystems map[string]string `json:"agent_subsystems,omitempty"`
+	// Modules pins registry modules to versions, modules with a module_id are added if missing
+	Modules []DesiredModule `json:"modules,omitempty"`
+}
+
+type DesiredFragment struct {
+	ID string `json:"id"`
+	// Version pins the fragment, empty leaves the part on whichever version it uses
+	Version string `json:"version,omitempty"`
+}
+
+type DesiredModule struct {
+	Name     string `json:"name"`
+	ModuleID string `json:"module_id,omitempty"`
+	Version  string `json:"version"`
+}
+
+// driftItem is a difference between the part config and the desired state, and the action that
+// converges it
+type driftItem struct {
+	kind   string
+	name   string
+	want   string
+	have   string
+	action string
+	// err is set when the drift can't be converged automatically
+	err error
+}
+
+func (d driftItem) toMap() map[string]interface{} {
+	m := map[string]interface{}{"kind": d.kind, "name": d.name, "want": d.want, "have": d.have}
+	if d.action != "" {
+		m["action"] = d.action
+	}
+	if d.err != nil {
+		m["error"] = d.err.Error()
+	}
+	return m
+}
+
+func (s *DesiredState) validate() error {
+	seen := map[string]bool{}
+	for _, f := range s.Fragments {
+		if f.ID == "" {
+			return fmt.Errorf("%w: fragments need an id", errInvalidDesiredState)
+		}
+		if seen[f.ID] {
+			return fmt.Errorf("%w: fragment %s is listed twice", errInvalidDesiredState, f.ID)
+		}
+		seen[f.ID] = true
+	}
+	for name := range s.AgentSubsystems {
+		if name == "" {
+			return fmt.Errorf("%w: agent_subsystems need a name", errInvalidDesiredState)
+		}
+	}
+	for _, m := range s.Modules {
+		if m.Name == "" || m.Version == "" {
+			return fmt.Errorf("%w: modules need a name and a version", errInvalidDesiredState)
+		}
+	}
+	return nil
+}
+
+// loadDesiredState reads a desired state document from a JSON file
+func loadDesiredState(path string) (*DesiredState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s DesiredState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", errInvalidDesiredState, path, err)
+	}
+	if err := s.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &s, nil
+}
+
+// fragmentId returns the id of a fragments entry, which is either the id or an object with id and version
+func fragmentId(v *structpb.Value) string {
+	if s := v.GetStructValue(); s != nil {
+		return s.Fields["id"].GetStringValue()
+	}
+	return v.GetStringValue()
+}
+
+func fragmentVersion(v *structpb.Value) string {
+	return v.GetStructValue().GetFields()["version"].GetStringValue()
+}
+
+// applyDesiredState converges conf on the desired state in place and returns the drift it found
+func applyDesiredState(conf *structpb.Struct, desired *DesiredState) []driftItem {
+	if conf.Fields == nil {
+		conf.Fields = map[string]*structpb.Value{}
+	}
+	var drift []driftItem
+	if desired.Fragments != nil {
+		drift = append(drift, applyDesiredFragments(conf, desired.Fragments)...)
+	}
+	drift = append(drift, applyDesiredSubsystems(conf, desired.AgentSubsystems)...)
+	drift = append(drift, applyDesiredModules(conf, desired.Modules)...)
+	return drift
+}
+
+func applyDesiredFragments(conf *structpb.Struct, desired []DesiredFragment) []driftItem {
+	var drift []driftItem
+	want := map[string]DesiredFragment{}
+	for _, f := range desired {
+		want[f.ID] = f
+	}
+	have := map[string]bool{}
+	var fragments []interface{}
+	for _, v := range conf.Fields["fragments"].GetListValue().GetValues() {
+		id := fragmentId(v)
+		f, ok := want[id]
+		if !ok {
+			drift = append(drift, driftItem{kind: driftFragment, name: id, have: id, action: actionRemove})
+			continue
+		}
+		have[id] = true
+		if f.Version != "" && fragmentVersion(v) != f.Version {
+			drift = append(drift, driftItem{kind: driftFragment, name: id, want: f.Version, have: fragmentVersion(v), action: actionSetVersion})
+			fragments = append(fragments, map[string]interface{}{"id": id, "version": f.Version})
+			continue
+		}
+		fragments = append(fragments, v.AsInterface())
+	}
+	for _, f := range desired {
+		if have[f.ID] {
+			continue
+		}
+		drift = append(drift, driftItem{kind: driftFragment, name: f.ID, want: f.Version, action: actionAdd})
+		if f.Version == "" {
+			fragments = append(fragments, f.ID)
+		} else {
+			fragments = append(fragments, map[string]interface{}{"id": f.ID, "version": f.Version})
+		}
+	}
+	if len(drift) > 0 {
+		// the values came from a struct or are strings and maps, so this can't fail
+		list, _ := structpb.NewList(fragments)
+		conf.Fields["fragments"] = structpb.NewListValue(list)
+	}
+	return drift
+}
+
+func applyDesiredSubsystems(conf *structpb.Struct, desired map[string]string) []driftItem {
+	names := make([]string, 0, len(desired))
+	for name := range desired {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var drift []driftItem
+	for _, name := range names {
+		subsystem := childStruct(childStruct(childStruct(conf, "agent_config"), "subsystems"), name)
+		have := subsystem.Fields["pin_version"].GetStringValue()
+		if have == desired[name] {
+			continue
+		}
+		drift = append(drift, driftItem{kind: driftAgentSubsystem, name: name, want: desired[name], have: have, action: actionSetVersion})
+		subsystem.Fields["pin_version"] = structpb.NewStringValue(desired[name])
+	}
+	return drift
+}
+
+func applyDesiredModules(conf *structpb.Struct, desired []DesiredModule) []driftItem {
+	var drift []driftItem
+	modules := conf.Fields["modules"].GetListValue()
+	for _, want := range desired {
+		var found *structpb.Struct
+		for _, v := range modules.GetValues() {
+			if m := v.GetStructValue(); m.GetFields()["name"].GetStringValue() == want.Name {
+				found = m
+				break
+			}
+		}
+		if found != nil {
+			have := found.Fields["version"].GetStringValue()
+			if have != want.Version {
+				drift = append(drift, driftItem{kind: driftModule, name: want.Name, want: want.Version, have: have, action: actionSetVersion})
+				found.Fields["version"] = structpb.NewStringValue(want.Version)
+			}
+			continue
+		}
+		item := driftItem{kind: driftModule, name: want.Name, want: want.Version, action: actionAdd}
+		if want.ModuleID == "" {
+			item.err = errors.New("module is missing and has no module_id to add it with")
+			drift = append(drift, item)
+			continue
+		}
+		drift = append(drift, item)
+		if modules == nil {
+			modules = &structpb.ListValue{}
+			conf.Fields["modules"] = structpb.NewListValue(modules)
+		}
+		modules.Values = append(modules.Values, structpb.NewStructValue(&structpb.Struct{Fields: map[string]*structpb.Value{
+			"type":      structpb.NewStringValue("registry"),
+			"name":      structpb.NewStringValue(want.Name),
+			"module_id": structpb.NewStringValue(want.ModuleID),
+			"version":   structpb.NewStringValue(want.Version),
+		}}))
+	}
+	return drift
+}
+
+// childStruct returns the struct field of s, creating it if it is missing
+func childStruct(s *structpb.Struct, key string) *structpb.Struct {
+	if c := s.Fields[key].GetStructValue(); c != nil {
+		if c.Fields == nil {
+			c.Fields = map[string]*structpb.Value{}
+		}
+		return c
+	}
+	c := &structpb.Struct{Fields: map[string]*structpb.Value{}}
+	s.Fields[key] = structpb.NewStructValue(c)
+	return c
+}
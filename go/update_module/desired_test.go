@@ -0,0 +1,97 @@
+package update_module
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestApplyDesiredState(t *testing.T) {
+	conf, err := structpb.NewStruct(map[string]interface{}{
+		"fragments": []interface{}{"keep", "drop", map[string]interface{}{"id": "pinned", "version": "1"}},
+		"modules": []interface{}{
+			map[string]interface{}{"type": "registry", "name": "camera", "module_id": "acme:camera", "version": "0.1.0"},
+		},
+		"agent_config": map[string]interface{}{
+			"subsystems": map[string]interface{}{"viam-server": map[string]interface{}{"pin_version": "", "release_channel": "stable"}},
+		},
+	})
+	require.NoError(t, err)
+	desired := &DesiredState{
+		Fragments:       []DesiredFragment{{ID: "keep"}, {ID: "pinned", Version: "2"}, {ID: "added", Version: "3"}},
+		AgentSubsystems: map[string]string{"viam-server": "0.50.0", "viam-agent": "0.12.0"},
+		Modules: []DesiredModule{
+			{Name: "camera", Version: "0.2.0"},
+			{Name: "lidar", ModuleID: "acme:lidar", Version: "1.0.0"},
+			{Name: "gripper", Version: "1.0.0"},
+		},
+	}
+
+	drift := applyDesiredState(conf, desired)
+	var actions []string
+	for _, d := range drift {
+		actions = append(actions, d.action+" "+d.kind+" "+d.name)
+	}
+	assert.Equal(t, []string{
+		"remove fragment drop",
+		"set_version fragment pinned",
+		"add fragment added",
+		"set_version agent_subsystem viam-agent",
+		"set_version agent_subsystem viam-server",
+		"set_version module camera",
+		"add module lidar",
+		"add module gripper",
+	}, actions)
+	assert.Error(t, drift[len(drift)-1].err)
+
+	after := conf.AsMap()
+	assert.Equal(t, []interface{}{
+		"keep",
+		map[string]interface{}{"id": "pinned", "version": "2"},
+		map[string]interface{}{"id": "added", "version": "3"},
+	}, after["fragments"])
+	subsystems := after["agent_config"].(map[string]interface{})["subsystems"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"pin_version": "0.50.0", "release_channel": "stable"}, subsystems["viam-server"])
+	assert.Equal(t, map[string]interface{}{"pin_version": "0.12.0"}, subsystems["viam-agent"])
+	modules := after["modules"].([]interface{})
+	require.Len(t, modules, 2)
+	assert.Equal(t, "0.2.0", modules[0].(map[string]interface{})["version"])
+	assert.Equal(t, "acme:lidar", modules[1].(map[string]interface{})["module_id"])
+
+	// once converged only the drift that can't be fixed remains
+	drift = applyDesiredState(conf, desired)
+	require.Len(t, drift, 1)
+	assert.Equal(t, "gripper", drift[0].name)
+
+	// fragments are left alone unless listed
+	empty := &structpb.Struct{}
+	assert.Empty(t, applyDesiredState(empty, &DesiredState{}))
+	assert.Empty(t, empty.Fields)
+}
+
+func TestLoadDesiredState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "desired.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"fragments": [{"id": "a", "version": "1"}], "agent_subsystems": {"viam-server": "0.50.0"}}`), 0o600))
+	s, err := loadDesiredState(path)
+	require.NoError(t, err)
+	assert.Equal(t, &DesiredState{Fragments: []DesiredFragment{{ID: "a", Version: "1"}}, AgentSubsystems: map[string]string{"viam-server": "0.50.0"}}, s)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"fragments": [{"id": "a"}, {"id": "a"}]}`), 0o600))
+	_, err = loadDesiredState(path)
+	assert.ErrorIs(t, err, errInvalidDesiredState)
+	require.NoError(t, os.WriteFile(path, []byte(`{"modules": [{"name": "camera"}]}`), 0o600))
+	_, err = loadDesiredState(path)
+	assert.ErrorIs(t, err, errInvalidDesiredState)
+	require.NoError(t, os.WriteFile(path, []byte(`not json`), 0o600))
+	_, err = loadDesiredState(path)
+	assert.ErrorIs(t, err, errInvalidDesiredState)
+
+	_, err = (&Config{DesiredState: &DesiredState{}, DesiredStateFile: path}).Validate("path")
+	assert.Error(t, err)
+	_, err = (&Config{DesiredState: &DesiredState{Fragments: []DesiredFragment{{}}}}).Validate("path")
+	assert.ErrorIs(t, err, errInvalidDesiredState)
+}
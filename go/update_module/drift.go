@@ -0,0 +1,384 @@
+package update_module
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	app_proto "go.viam.com/api/app/v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// drift classes reported by detect_drift
+const (
+	driftExtraComponent   = "extra_component"
+	driftMissingComponent = "missing_component"
+	driftChangedComponent = "changed_component"
+	driftExtraService     = "extra_service"
+	driftMissingService   = "missing_service"
+	driftChangedService   = "changed_service"
+	driftExtraModule      = "extra_module"
+	driftMissingModule    = "missing_module"
+	driftModuleVersion    = "module_version"
+	driftChangedModule    = "changed_module"
+	driftExtraFragment    = "extra_fragment"
+	driftMissingFragment  = "missing_fragment"
+	driftFragmentVersion  = "fragment_version"
+	driftFragmentMod      = "fragment_mod"
+	driftAgentPin         = "agent_pin"
+
+	driftBaselineDesiredState = "desired_state"
+)
+
+var errNoDriftBaseline = errors.New("no drift baseline, pass snapshot or baseline_file, or configure drift_baseline_file or a desired state")
+
+// driftReport is the outcome of comparing the part config to a baseline
+type driftReport struct {
+	at       time.Time
+	partId   string
+	baseline string
+	drift    []driftItem
+	err      error
+}
+
+func (r *driftReport) counts() map[string]interface{} {
+	counts := map[string]interface{}{}
+	for _, d := range r.drift {
+		n, _ := counts[d.kind].(int)
+		counts[d.kind] = n + 1
+	}
+	return counts
+}
+
+func (r *driftReport) toMap() map[string]interface{} {
+	drift := make([]interface{}, 0, len(r.drift))
+	for _, d := range r.drift {
+		drift = append(drift, d.toMap())
+	}
+	m := map[string]interface{}{
+		"checked_at": r.at.Format(time.RFC3339),
+		"baseline":   r.baseline,
+		"in_sync":    len(r.drift) == 0,
+		"drift":      drift,
+		"counts":     r.counts(),
+	}
+	if r.partId != "" {
+		m["part_id"] = r.partId
+	}
+	if r.err != nil {
+		m["error"] = r.err.Error()
+	} else {
+		m["ok"] = 1
+	}
+	return m
+}
+
+func (cfg *Config) driftCheckInterval() time.Duration {
+	if cfg == nil {
+		return 0
+	}
+	return time.Duration(cfg.DriftCheckIntervalSeconds) * time.Second
+}
+
+// loadConfigBaseline reads a part config saved as JSON, as copied from the app's raw JSON view
+func loadConfigBaseline(path string) (*structpb.Struct, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return structpb.NewStruct(m)
+}
+
+// runDriftCheck checks the part config for drift every drift check interval, until ctx is done
+func (b *RobotUpdateModule) runDriftCheck(ctx context.Context) {
+	for {
+		b.mu.Lock()
+		interval := b.cfg.driftCheckInterval()
+		b.mu.Unlock()
+		if interval == 0 {
+			// checks are off until a reconfigure turns them on
+			interval = defaultReconcileInterval
+		} else if report := b.detectDrift(ctx, "", "", map[string]interface{}{}); report.err != nil {
+			b.logger.Warnf("Error checking for config drift: %v", report.err)
+		}
+		if err := sleepContext(ctx, interval); err != nil {
+			return
+		}
+	}
+}
+
+// detectDriftCommand handles the detect_drift command. snapshot is the id of a config snapshot and
+// baseline_file a saved part config to compare against instead of the configured baseline.
+func (b *RobotUpdateModule) detectDriftCommand(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	snapshotId, _ := cmd["snapshot"].(string)
+	baselineFile, _ := cmd["baseline_file"].(string)
+	report := b.detectDrift(ctx, snapshotId, baselineFile, cmd)
+	return report.toMap(), report.err
+}
+
+// detectDrift compares the part config to the snapshot, the baseline file, the configured drift baseline
+// file or the desired state, in that order, and records the report for the status sensor
+func (b *RobotUpdateModule) detectDrift(ctx context.Context, snapshotId, baselineFile string, cmd map[string]interface{}) *driftReport {
+	b.mu.Lock()
+	cfg := b.cfg
+	b.mu.Unlock()
+	report := &driftReport{at: time.Now()}
+	defer b.recordDrift(report)
+
+	var desired *DesiredState
+	var baseline *structpb.Struct
+	if baselineFile == "" && cfg != nil {
+		baselineFile = cfg.DriftBaselineFile
+	}
+	switch {
+	case snapshotId != "":
+		report.baseline = snapshotBaseline(snapshotId)
+		var snapshot *configSnapshot
+		if snapshot, report.err = loadSnapshot(snapshotId); report.err == nil {
+			baseline, report.err = snapshot.robotConfig()
+		}
+	case baselineFile != "":
+		report.baseline = baselineFile
+		baseline, report.err = loadConfigBaseline(baselineFile)
+	default:
+		report.baseline = driftBaselineDesiredState
+		if desired, report.err = cfg.desiredState(); errors.Is(report.err, errNoDesiredState) {
+			report.err = errNoDriftBaseline
+		}
+	}
+	if report.err != nil {
+		return report
+	}
+
+	client, partId, err := b.partClient(ctx, "detect_drift", cmd)
+	if err != nil {
+		report.err = err
+		return report
+	}
+	report.partId = partId
+	b.publishStep("detect_drift", "getting robot part")
+	resp, err := client.GetRobotPart(ctx, &app_proto.GetRobotPartRequest{Id: partId})
+	if report.err = stepError(ctx, "getting robot part", err); report.err != nil {
+		return report
+	}
+	current := resp.GetPart().GetRobotConfig()
+	if current == nil {
+		current = &structpb.Struct{}
+	}
+	if desired != nil {
+		report.drift = desiredStateDrift(current, desired)
+	} else {
+		report.drift = compareConfigs(baseline, current)
+	}
+	if len(report.drift) > 0 {
+		b.logger.Infof("Part config drifted from %s in %d places", report.baseline, len(report.drift))
+	}
+	return report
+}
+
+func (b *RobotUpdateModule) recordDrift(report *driftReport) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastDrift = report
+}
+
+// desiredStateDrift classifies how conf deviates from the desired state. The desired state is applied to
+// a copy of conf so the drift is reported in the same terms as a comparison to a saved config.
+func desiredStateDrift(conf *structpb.Struct, desired *DesiredState) []driftItem {
+	want := proto.Clone(conf).(*structpb.Struct)
+	var unconvergeable []driftItem
+	for _, d := range applyDesiredState(want, desired) {
+		if d.err != nil {
+			unconvergeable = append(unconvergeable, driftItem{kind: driftMissingModule, name: d.name, want: d.want, err: d.err})
+		}
+	}
+	return append(compareConfigs(want, conf), unconvergeable...)
+}
+
+// compareConfigs classifies the differences between the current part config and the baseline
+func compareConfigs(baseline, current *structpb.Struct) []driftItem {
+	var drift []driftItem
+	drift = append(drift, compareFragments(baseline, current)...)
+	drift = append(drift, compareFragmentMods(baseline, current)...)
+	drift = append(drift, compareNamed(baseline, current, "components", driftExtraComponent, driftMissingComponent, driftChangedComponent)...)
+	drift = append(drift, compareNamed(baseline, current, "services", driftExtraService, driftMissingService, driftChangedService)...)
+	drift = append(drift, compareModules(baseline, current)...)
+	drift = append(drift, compareAgentPins(baseline, current)...)
+	return drift
+}
+
+func compareFragments(baseline, current *structpb.Struct) []driftItem {
+	versions := func(conf *structpb.Struct) ([]string, map[string]string) {
+		var ids []string
+		m := map[string]string{}
+		for _, v := range conf.GetFields()["fragments"].GetListValue().GetValues() {
+			id := fragmentId(v)
+			ids = append(ids, id)
+			m[id] = fragmentVersion(v)
+		}
+		return ids, m
+	}
+	wantIds, want := versions(baseline)
+	haveIds, have := versions(current)
+	var drift []driftItem
+	for _, id := range wantIds {
+		v, ok := have[id]
+		switch {
+		case !ok:
+			drift = append(drift, driftItem{kind: driftMissingFragment, name: id, want: want[id]})
+		case v != want[id]:
+			drift = append(drift, driftItem{kind: driftFragmentVersion, name: id, want: want[id], have: v})
+		}
+	}
+	for _, id := range haveIds {
+		if _, ok := want[id]; !ok {
+			drift = append(drift, driftItem{kind: driftExtraFragment, name: id, have: have[id]})
+		}
+	}
+	return drift
+}
+
+// fragmentMods flattens the fragment_mods of conf to the value each fragment/operator/path is set to
+func fragmentMods(conf *structpb.Struct) map[string]string {
+	mods := map[string]string{}
+	for _, fm := range conf.GetFields()["fragment_mods"].GetListValue().GetValues() {
+		fields := fm.GetStructValue().GetFields()
+		id := fields["fragment_id"].GetStringValue()
+		for _, mod := range fields["mods"].GetListValue().GetValues() {
+			for op, paths := range mod.GetStructValue().GetFields() {
+				for path, v := range paths.GetStructValue().GetFields() {
+					mods[fmt.Sprintf("%s %s %s", id, op, path)] = valueString(v)
+				}
+			}
+		}
+	}
+	return mods
+}
+
+func compareFragmentMods(baseline, current *structpb.Struct) []driftItem {
+	want := fragmentMods(baseline)
+	have := fragmentMods(current)
+	var drift []driftItem
+	for _, key := range sortedKeys(want, have) {
+		w, inWant := want[key]
+		h, inHave := have[key]
+		if inWant && inHave && w == h {
+			continue
+		}
+		drift = append(drift, driftItem{kind: driftFragmentMod, name: key, want: w, have: h})
+	}
+	return drift
+}
+
+// namedEntries indexes the list field of conf by the name of each entry
+func namedEntries(conf *structpb.Struct, field string) ([]string, map[string]*structpb.Struct) {
+	var names []string
+	m := map[string]*structpb.Struct{}
+	for _, v := range conf.GetFields()[field].GetListValue().GetValues() {
+		s := v.GetStructValue()
+		name := s.GetFields()["name"].GetStringValue()
+		names = append(names, name)
+		m[name] = s
+	}
+	return names, m
+}
+
+func compareNamed(baseline, current *structpb.Struct, field, extra, missing, changed string) []driftItem {
+	wantNames, want := namedEntries(baseline, field)
+	haveNames, have := namedEntries(current, field)
+	var drift []driftItem
+	for _, name := range wantNames {
+		h, ok := have[name]
+		switch {
+		case !ok:
+			drift = append(drift, driftItem{kind: missing, name: name})
+		case !proto.Equal(want[name], h):
+			drift = append(drift, driftItem{kind: changed, name: name, want: configHash(want[name]), have: configHash(h)})
+		}
+	}
+	for _, name := range haveNames {
+		if _, ok := want[name]; !ok {
+			drift = append(drift, driftItem{kind: extra, name: name})
+		}
+	}
+	return drift
+}
+
+func compareModules(baseline, current *structpb.Struct) []driftItem {
+	_, want := namedEntries(baseline, "modules")
+	_, have := namedEntries(current, "modules")
+	var drift []driftItem
+	for _, d := range compareNamed(baseline, current, "modules", driftExtraModule, driftMissingModule, driftChangedModule) {
+		if d.kind != driftChangedModule {
+			drift = append(drift, d)
+			continue
+		}
+		wantVersion := want[d.name].Fields["version"].GetStringValue()
+		haveVersion := have[d.name].Fields["version"].GetStringValue()
+		if wantVersion != haveVersion {
+			d = driftItem{kind: driftModuleVersion, name: d.name, want: wantVersion, have: haveVersion}
+		}
+		drift = append(drift, d)
+	}
+	return drift
+}
+
+// agentPins returns the pin_version of each viam-agent subsystem in conf
+func agentPins(conf *structpb.Struct) map[string]string {
+	pins := map[string]string{}
+	subsystems := conf.GetFields()["agent_config"].GetStructValue().GetFields()["subsystems"].GetStructValue()
+	for name, v := range subsystems.GetFields() {
+		if pin := v.GetStructValue().GetFields()["pin_version"].GetStringValue(); pin != "" {
+			pins[name] = pin
+		}
+	}
+	return pins
+}
+
+func compareAgentPins(baseline, current *structpb.Struct) []driftItem {
+	want := agentPins(baseline)
+	have := agentPins(current)
+	var drift []driftItem
+	for _, name := range sortedKeys(want, have) {
+		if want[name] != have[name] {
+			drift = append(drift, driftItem{kind: driftAgentPin, name: name, want: want[name], have: have[name]})
+		}
+	}
+	return drift
+}
+
+// valueString renders a config value for a drift report, strings as is and anything else as JSON
+func valueString(v *structpb.Value) string {
+	if s, ok := v.GetKind().(*structpb.Value_StringValue); ok {
+		return s.StringValue
+	}
+	data, err := json.Marshal(v.AsInterface())
+	if err != nil {
+		return v.String()
+	}
+	return string(data)
+}
+
+func sortedKeys(maps ...map[string]string) []string {
+	seen := map[string]bool{}
+	var keys []string
+	for _, m := range maps {
+		for k := range m {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
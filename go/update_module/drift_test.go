@@ -0,0 +1,143 @@
+package update_module
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.viam.com/rdk/logging"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func driftKinds(drift []driftItem) []string {
+	var kinds []string
+	for _, d := range drift {
+		kinds = append(kinds, d.kind+" "+d.name)
+	}
+	return kinds
+}
+
+func TestCompareConfigs(t *testing.T) {
+	baseline, err := structpb.NewStruct(map[string]interface{}{
+		"fragments": []interface{}{"base", map[string]interface{}{"id": "pinned", "version": "1"}, "gone"},
+		"fragment_mods": []interface{}{map[string]interface{}{
+			"fragment_id": "base",
+			"mods":        []interface{}{map[string]interface{}{"$set": map[string]interface{}{"components.cam.attributes.fps": 30.0}}},
+		}},
+		"components": []interface{}{
+			map[string]interface{}{"name": "cam", "model": "webcam"},
+			map[string]interface{}{"name": "arm", "model": "ur5e"},
+		},
+		"modules": []interface{}{
+			map[string]interface{}{"name": "camera", "module_id": "acme:camera", "version": "1.0.0"},
+			map[string]interface{}{"name": "lidar", "module_id": "acme:lidar", "version": "2.0.0"},
+		},
+		"agent_config": map[string]interface{}{"subsystems": map[string]interface{}{"viam-server": map[string]interface{}{"pin_version": "0.50.0"}}},
+	})
+	require.NoError(t, err)
+	current, err := structpb.NewStruct(map[string]interface{}{
+		"fragments": []interface{}{"base", map[string]interface{}{"id": "pinned", "version": "2"}, "extra"},
+		"fragment_mods": []interface{}{map[string]interface{}{
+			"fragment_id": "base",
+			"mods": []interface{}{
+				map[string]interface{}{"$set": map[string]interface{}{"components.cam.attributes.fps": 15.0}},
+				map[string]interface{}{"$unset": map[string]interface{}{"components.arm.attributes.speed": ""}},
+			},
+		}},
+		"components": []interface{}{
+			map[string]interface{}{"name": "cam", "model": "webcam", "attributes": map[string]interface{}{"debug": true}},
+			map[string]interface{}{"name": "gripper", "model": "fake"},
+		},
+		"services": []interface{}{map[string]interface{}{"name": "slam"}},
+		"modules": []interface{}{
+			map[string]interface{}{"name": "camera", "module_id": "acme:camera", "version": "1.1.0"},
+			map[string]interface{}{"name": "lidar", "module_id": "acme:lidar", "version": "2.0.0", "env": map[string]interface{}{"X": "1"}},
+		},
+		"agent_config": map[string]interface{}{"subsystems": map[string]interface{}{"viam-server": map[string]interface{}{"pin_version": "0.51.0"}}},
+	})
+	require.NoError(t, err)
+
+	drift := compareConfigs(baseline, current)
+	assert.Equal(t, []string{
+		"fragment_version pinned",
+		"missing_fragment gone",
+		"extra_fragment extra",
+		"fragment_mod base $set components.cam.attributes.fps",
+		"fragment_mod base $unset components.arm.attributes.speed",
+		"changed_component cam",
+		"missing_component arm",
+		"extra_component gripper",
+		"extra_service slam",
+		"module_version camera",
+		"changed_module lidar",
+		"agent_pin viam-server",
+	}, driftKinds(drift))
+	assert.Equal(t, "30", drift[3].want)
+	assert.Equal(t, "15", drift[3].have)
+	assert.Empty(t, compareConfigs(current, current))
+}
+
+func TestDesiredStateDrift(t *testing.T) {
+	conf, err := structpb.NewStruct(map[string]interface{}{"fragments": []interface{}{"a", "b"}})
+	require.NoError(t, err)
+	drift := desiredStateDrift(conf, &DesiredState{
+		Fragments:       []DesiredFragment{{ID: "a", Version: "3"}},
+		AgentSubsystems: map[string]string{"viam-server": "0.50.0"},
+		Modules:         []DesiredModule{{Name: "camera", Version: "1.0.0"}},
+	})
+	assert.Equal(t, []string{"fragment_version a", "extra_fragment b", "agent_pin viam-server", "missing_module camera"}, driftKinds(drift))
+	assert.Error(t, drift[3].err)
+	// the part config itself is left alone
+	assert.Equal(t, []interface{}{"a", "b"}, conf.AsMap()["fragments"])
+}
+
+func TestDetectDrift(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeFleetClient()
+	client.addMachine(t, "loc", "robot", "base", "extra")
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: ctx}
+	usePartClient(t, &module, client)
+	resp, err := module.doCommand(ctx, map[string]interface{}{"command": "detect_drift"})
+	assert.ErrorIs(t, err, errNoDriftBaseline)
+	assert.Contains(t, resp["error"], "no drift baseline")
+
+	module.cfg = partTestConfig()
+	module.cfg.DesiredState = &DesiredState{Fragments: []DesiredFragment{{ID: "base"}}}
+
+	resp, err = module.doCommand(ctx, map[string]interface{}{"command": "detect_drift"})
+	require.NoError(t, err)
+	assert.Equal(t, driftBaselineDesiredState, resp["baseline"])
+	assert.Equal(t, false, resp["in_sync"])
+	assert.Equal(t, map[string]interface{}{driftExtraFragment: 1}, resp["counts"])
+	_, err = structpb.NewStruct(resp)
+	assert.NoError(t, err)
+
+	// a saved config takes precedence over the desired state
+	path := filepath.Join(t.TempDir(), "baseline.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"fragments": ["base", "extra"], "components": [{"name": "cam"}]}`), 0o600))
+	resp, err = module.doCommand(ctx, map[string]interface{}{"command": "detect_drift", "baseline_file": path})
+	require.NoError(t, err)
+	assert.Equal(t, path, resp["baseline"])
+	assert.Equal(t, map[string]interface{}{driftMissingComponent: 1}, resp["counts"])
+	assert.Empty(t, client.updated)
+
+	s := module.status(ctx)
+	assert.Equal(t, path, s["drift_baseline"])
+	assert.Equal(t, false, s["drift_in_sync"])
+	assert.Equal(t, 1, s["drift_count"])
+
+	// a part that reads back empty drifts from everything in the baseline
+	client.parts["robot"][0].RobotConfig = nil
+	report := module.detectDrift(ctx, "", path, map[string]interface{}{})
+	require.NoError(t, report.err)
+	assert.Equal(t, []string{"missing_fragment base", "missing_fragment extra", "missing_component cam"}, driftKinds(report.drift))
+
+	_, err = (&Config{DriftCheckIntervalSeconds: -1}).Validate("path")
+	assert.Error(t, err)
+	_, err = module.doCommand(ctx, map[string]interface{}{"command": "detect_drift", "baseline_file": filepath.Join(t.TempDir(), "missing.json")})
+	assert.Error(t, err)
+	assert.Contains(t, module.status(ctx), "drift_error")
+}
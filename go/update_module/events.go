@@ -0,0 +1,208 @@
+package update_module
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	eventStep           = "step"
+	eventJobQueued      = "job_queued"
+	eventJobStarted     = "job_started"
+	eventJobCancelled   = "job_cancelled"
+	eventVersionChanged = "version_changed"
+	eventConfigApplied  = "config_applied"
+
+	// maxBusEvents is how many events the bus keeps for watchers that fall behind
+	maxBusEvents     = 1000
+	defaultEventWait = 30 * time.Second
+	maxEventWait     = 5 * time.Minute
+)
+
+var (
+	// viamServerBinary is the symlink viam-agent points at the installed viam-server version
+	viamServerBinary    = "/opt/viam/bin/viam-server"
+	versionPollInterval = 10 * time.Second
+
+	errInvalidCursor = errors.New("cursor must be a non-negative whole number")
+)
+
+// busEvent is a lifecycle event published on the module's event bus
+type busEvent struct {
+	Seq    uint64            `json:"seq"`
+	Time   time.Time         `json:"time"`
+	Type   string            `json:"type"`
+	Params map[string]string `json:"params,omitempty"`
+	Error  string            `json:"error,omitempty"`
+}
+
+// eventBus keeps the most recent events in order, the zero value is ready to use
+type eventBus struct {
+	mu     sync.Mutex
+	seq    uint64
+	events []busEvent
+	// published is closed and replaced whenever an event is published, waking long polls
+	published chan struct{}
+}
+
+func (e *eventBus) publish(eventType string, params map[string]string, eventErr error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.seq++
+	ev := busEvent{Seq: e.seq, Time: time.Now().UTC(), Type: eventType, Params: params}
+	if eventErr != nil {
+		ev.Error = eventErr.Error()
+	}
+	e.events = append(e.events, ev)
+	if len(e.events) > maxBusEvents {
+		e.events = append([]busEvent(nil), e.events[len(e.events)-maxBusEvents:]...)
+	}
+	if e.published != nil {
+		close(e.published)
+		e.published = nil
+	}
+}
+
+// since returns the events after the cursor, the cursor to pass next time and whether events after the
+// cursor were already dropped
+func (e *eventBus) since(cursor uint64) ([]busEvent, uint64, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if cursor > e.seq {
+		// the cursor is from before the module restarted
+		cursor = 0
+	}
+	var out []busEvent
+	for _, ev := range e.events {
+		if ev.Seq > cursor {
+			out = append(out, ev)
+		}
+	}
+	missed := len(e.events) > 0 && e.events[0].Seq > cursor+1
+	return out, e.seq, missed
+}
+
+// wait returns a channel closed at the next publish
+func (e *eventBus) wait() <-chan struct{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.published == nil {
+		e.published = make(chan struct{})
+	}
+	return e.published
+}
+
+// publishStep records a step transition of a running command
+func (b *RobotUpdateModule) publishStep(command, step string) {
+	b.logger.Debugf("%s: %s", command, step)
+	b.events.publish(eventStep, map[string]string{"command": command, "step": step}, nil)
+}
+
+// watchEvents handles the watch_events command. It returns the events after cursor, waiting up to
+// wait_seconds (default 30) for one if there are none yet. Pass the returned cursor to the next call.
+func (b *RobotUpdateModule) watchEvents(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	var cursor uint64
+	if _, ok := cmd["cursor"]; ok {
+		c, err := intFromRequest(cmd, "cursor")
+		if err != nil || c < 0 {
+			return map[string]interface{}{"error": errInvalidCursor.Error()}, errInvalidCursor
+		}
+		cursor = uint64(c)
+	}
+	wait := defaultEventWait
+	if _, ok := cmd["wait_seconds"]; ok {
+		w, err := secondsFromRequest(cmd, "wait_seconds")
+		if err != nil {
+			return map[string]interface{}{"error": err.Error()}, err
+		}
+		wait = min(w, maxEventWait)
+	}
+	types := map[string]bool{}
+	if list, ok := cmd["types"].([]interface{}); ok {
+		for _, t := range list {
+			if s, ok := t.(string); ok {
+				types[s] = true
+			}
+		}
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		published := b.events.wait()
+		events, next, missed := b.events.since(cursor)
+		matches := make([]interface{}, 0, len(events))
+		for _, ev := range events {
+			if len(types) > 0 && !types[ev.Type] {
+				continue
+			}
+			matches = append(matches, eventToMap(ev))
+		}
+		if len(matches) > 0 || missed {
+			return map[string]interface{}{"ok": 1, "events": matches, "cursor": next, "missed": missed}, nil
+		}
+		// nothing to return yet, the cursor moves past filtered out events
+		cursor = next
+		select {
+		case <-published:
+		case <-timer.C:
+			return map[string]interface{}{"ok": 1, "events": matches, "cursor": next, "missed": false}, nil
+		case <-ctx.Done():
+			return map[string]interface{}{"ok": 1, "events": matches, "cursor": next, "missed": false}, nil
+		}
+	}
+}
+
+// eventToMap converts the event to values DoCommand can encode
+func eventToMap(ev busEvent) map[string]interface{} {
+	m := map[string]interface{}{"seq": ev.Seq, "time": ev.Time.Format(time.RFC3339Nano), "type": ev.Type}
+	if len(ev.Params) > 0 {
+		params := make(map[string]interface{}, len(ev.Params))
+		for k, v := range ev.Params {
+			params[k] = v
+		}
+		m["params"] = params
+	}
+	if ev.Error != "" {
+		m["error"] = ev.Error
+	}
+	return m
+}
+
+// watchInstalledVersion publishes version_changed when viam-agent points the viam-server symlink at
+// another version, until ctx is done
+func (b *RobotUpdateModule) watchInstalledVersion(ctx context.Context, binary string, interval time.Duration) {
+	current, _ := os.Readlink(binary)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		target, err := os.Readlink(binary)
+		if err != nil || target == current {
+			continue
+		}
+		b.logger.Infof("viam-server changed from %s to %s", current, target)
+		b.events.publish(eventVersionChanged, map[string]string{"old": current, "new": target}, nil)
+		current = target
+	}
+}
+
+// configDigest is a short hash of the component config, so config_applied events show when it changed
+func configDigest(cfg *Config) string {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,135 @@
+package update_module
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.viam.com/rdk/components/generic"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func eventTypes(resp map[string]interface{}) []string {
+	var types []string
+	for _, e := range resp["events"].([]interface{}) {
+		types = append(types, e.(map[string]interface{})["type"].(string))
+	}
+	return types
+}
+
+func TestEventBus(t *testing.T) {
+	var bus eventBus
+	events, cursor, missed := bus.since(0)
+	assert.Empty(t, events)
+	assert.EqualValues(t, 0, cursor)
+	assert.False(t, missed)
+
+	for i := 0; i < maxBusEvents+5; i++ {
+		bus.publish(eventStep, nil, nil)
+	}
+	events, cursor, missed = bus.since(0)
+	assert.Len(t, events, maxBusEvents)
+	assert.EqualValues(t, maxBusEvents+5, cursor)
+	assert.True(t, missed)
+	events, _, missed = bus.since(cursor - 1)
+	assert.Len(t, events, 1)
+	assert.False(t, missed)
+	// a cursor from before a module restart starts over
+	events, _, _ = bus.since(cursor + 100)
+	assert.Len(t, events, maxBusEvents)
+}
+
+func TestWatchEvents(t *testing.T) {
+	ctx := context.Background()
+	manager := &fakeServiceManager{}
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: ctx, serviceManager: manager}
+
+	_, err := module.DoCommand(ctx, map[string]interface{}{"command": "restart", "delay_seconds": 0})
+	require.NoError(t, err)
+	resp, err := module.DoCommand(ctx, map[string]interface{}{"command": "watch_events"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{eventStep, eventStep, eventStep, eventStep, eventStep, eventRestartCompleted}, eventTypes(resp))
+	steps := resp["events"].([]interface{})
+	assert.Equal(t, "restarting viam-agent", steps[2].(map[string]interface{})["params"].(map[string]interface{})["step"])
+	_, err = structpb.NewStruct(resp)
+	assert.NoError(t, err)
+	cursor := resp["cursor"]
+
+	// nothing new, the long poll times out empty
+	start := time.Now()
+	resp, err = module.DoCommand(ctx, map[string]interface{}{"command": "watch_events", "cursor": cursor, "wait_seconds": 0.05})
+	require.NoError(t, err)
+	assert.Empty(t, resp["events"])
+	assert.Equal(t, cursor, resp["cursor"])
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// a publish wakes a waiting watcher, filtered out events are skipped
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		module.publishStep("update", "dialing app")
+		module.notify(eventUpdateStarted, nil, nil)
+	}()
+	resp, err = module.DoCommand(ctx, map[string]interface{}{"command": "watch_events", "cursor": cursor, "wait_seconds": 5, "types": []interface{}{eventUpdateStarted}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{eventUpdateStarted}, eventTypes(resp))
+
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "watch_events", "cursor": -1})
+	assert.ErrorIs(t, err, errInvalidCursor)
+}
+
+func TestWatchEventsCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: ctx}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	resp, err := module.DoCommand(context.Background(), map[string]interface{}{"command": "watch_events", "wait_seconds": 60})
+	require.NoError(t, err)
+	assert.Empty(t, resp["events"])
+}
+
+func TestConfigAppliedEvent(t *testing.T) {
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	ctx := context.Background()
+	logger := logging.NewTestLogger(t)
+	res, err := NewUpdateModule(ctx, nil, resource.Config{Name: "updater", API: generic.API, Model: Model, ConvertedAttributes: &Config{}}, logger)
+	require.NoError(t, err)
+	defer res.Close(ctx)
+
+	require.NoError(t, res.Reconfigure(ctx, nil, resource.Config{Name: "updater", API: generic.API, Model: Model, ConvertedAttributes: &Config{ServiceUnit: "viam-server"}}))
+	resp, err := res.DoCommand(ctx, map[string]interface{}{"command": "watch_events", "types": []interface{}{eventConfigApplied}})
+	require.NoError(t, err)
+	events := resp["events"].([]interface{})
+	require.Len(t, events, 2)
+	first := events[0].(map[string]interface{})["params"].(map[string]interface{})["digest"]
+	second := events[1].(map[string]interface{})["params"].(map[string]interface{})["digest"]
+	assert.NotEqual(t, first, second)
+}
+
+func TestWatchInstalledVersion(t *testing.T) {
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "viam-server")
+	require.NoError(t, os.Symlink(filepath.Join(dir, "viam-server-0.49.0"), binary))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: ctx}
+	go module.watchInstalledVersion(ctx, binary, 5*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	require.NoError(t, os.Remove(binary))
+	require.NoError(t, os.Symlink(filepath.Join(dir, "viam-server-0.50.0"), binary))
+	resp, err := module.DoCommand(ctx, map[string]interface{}{"command": "watch_events", "wait_seconds": 5})
+	require.NoError(t, err)
+	require.Equal(t, []string{eventVersionChanged}, eventTypes(resp))
+	params := resp["events"].([]interface{})[0].(map[string]interface{})["params"].(map[string]interface{})
+	assert.Equal(t, filepath.Join(dir, "viam-server-0.49.0"), params["old"])
+	assert.Equal(t, filepath.Join(dir, "viam-server-0.50.0"), params["new"])
+}
@@ -0,0 +1,199 @@
+package update_module
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	app_proto "go.viam.com/api/app/v1"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	// revisionCurrent is the id of the part's current config
+	revisionCurrent = "current"
+	revisionIdLen   = 12
+)
+
+var (
+	errRevisionMissing  = errors.New("no revision provided")
+	errRevisionNotFound = errors.New("revision not found in the part history")
+	errInvalidLimit     = errors.New("limit must be a positive whole number")
+)
+
+// partRevision is a version of the part config from app's part history. Revisions are identified by a
+// prefix of the config hash, so ids don't shift as the part is edited.
+type partRevision struct {
+	id      string
+	current bool
+	conf    *structpb.Struct
+	// savedAt and editedBy are the edit that made this revision, unknown for the oldest revision
+	savedAt  time.Time
+	editedBy *app_proto.AuthenticatorInfo
+}
+
+func (r *partRevision) toMap(index int) map[string]interface{} {
+	m := map[string]interface{}{
+		"id":       r.id,
+		"revision": index,
+		"current":  r.current,
+		"hash":     configHash(r.conf),
+	}
+	if !r.savedAt.IsZero() {
+		m["saved_at"] = r.savedAt.Format(time.RFC3339)
+	}
+	if r.editedBy != nil {
+		m["edited_by"] = r.editedBy.GetValue()
+		m["editor_type"] = strings.ToLower(strings.TrimPrefix(r.editedBy.GetType().String(), "AUTHENTICATION_TYPE_"))
+	}
+	return m
+}
+
+func revisionId(conf *structpb.Struct) string {
+	return configHash(conf)[:revisionIdLen]
+}
+
+// partRevisions returns the part's current config followed by the configs it replaced, newest first.
+// Each history entry holds the part as it was before the edit it records.
+func partRevisions(ctx context.Context, client app_proto.AppServiceClient, partId string) ([]*partRevision, *app_proto.RobotPart, error) {
+	part, err := client.GetRobotPart(ctx, &app_proto.GetRobotPartRequest{Id: partId})
+	if err = stepError(ctx, "getting robot part", err); err != nil {
+		return nil, nil, err
+	}
+	resp, err := client.GetRobotPartHistory(ctx, &app_proto.GetRobotPartHistoryRequest{Id: partId})
+	if err = stepError(ctx, "getting robot part history", err); err != nil {
+		return nil, nil, err
+	}
+	history := resp.GetHistory()
+	sort.SliceStable(history, func(i, j int) bool { return history[i].GetWhen().AsTime().After(history[j].GetWhen().AsTime()) })
+
+	confs := []*structpb.Struct{part.GetPart().GetRobotConfig()}
+	for _, h := range history {
+		confs = append(confs, h.GetOld().GetRobotConfig())
+	}
+	revisions := make([]*partRevision, 0, len(confs))
+	for i, conf := range confs {
+		if conf == nil {
+			conf = &structpb.Struct{}
+		}
+		r := &partRevision{id: revisionId(conf), current: i == 0, conf: conf}
+		if i < len(history) {
+			r.savedAt = history[i].GetWhen().AsTime()
+			r.editedBy = history[i].GetEditedBy()
+		}
+		revisions = append(revisions, r)
+	}
+	return revisions, part.GetPart(), nil
+}
+
+// findRevision returns the newest revision with the id, or the current one
+func findRevision(revisions []*partRevision, id string) (*partRevision, error) {
+	for _, r := range revisions {
+		if (id == revisionCurrent && r.current) || r.id == id {
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", errRevisionNotFound, id)
+}
+
+// partHistory handles the part_history command, listing the revisions of the part config newest first.
+// limit bounds how many are listed.
+func (b *RobotUpdateModule) partHistory(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	limit := 0
+	if _, ok := cmd["limit"]; ok {
+		n, err := intFromRequest(cmd, "limit")
+		if err != nil || n < 1 {
+			return map[string]interface{}{"error": errInvalidLimit.Error()}, errInvalidLimit
+		}
+		limit = n
+	}
+	client, partId, err := b.partClient(ctx, "part_history", cmd)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	revisions, _, err := partRevisions(ctx, client, partId)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	if limit > 0 && len(revisions) > limit {
+		revisions = revisions[:limit]
+	}
+	list := make([]interface{}, 0, len(revisions))
+	for i, r := range revisions {
+		list = append(list, r.toMap(i))
+	}
+	return map[string]interface{}{"ok": 1, "part_id": partId, "revisions": list}, nil
+}
+
+// diffRevisions handles the diff_revisions command, comparing revision to, the current config by default,
+// to revision from
+func (b *RobotUpdateModule) diffRevisions(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	from, _ := cmd["from"].(string)
+	if from == "" {
+		return map[string]interface{}{"error": errRevisionMissing.Error()}, errRevisionMissing
+	}
+	to, _ := cmd["to"].(string)
+	if to == "" {
+		to = revisionCurrent
+	}
+	client, partId, err := b.partClient(ctx, "diff_revisions", cmd)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	revisions, _, err := partRevisions(ctx, client, partId)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	fromRevision, err := findRevision(revisions, from)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	toRevision, err := findRevision(revisions, to)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	report := &driftReport{at: time.Now(), partId: partId, baseline: "revision:" + fromRevision.id}
+	report.drift = compareConfigs(fromRevision.conf, toRevision.conf)
+	resp := report.toMap()
+	resp["against"] = to
+	return resp, nil
+}
+
+// rollbackRevision handles the rollback_revision command, writing a revision from the part history back
+// to the part with the same checks and hooks as restore_snapshot
+func (b *RobotUpdateModule) rollbackRevision(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	id, _ := cmd["revision"].(string)
+	if id == "" {
+		return map[string]interface{}{"error": errRevisionMissing.Error()}, errRevisionMissing
+	}
+	client, partId, err := b.partClient(ctx, "rollback_revision", cmd)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	b.publishStep("rollback_revision", "getting part history")
+	revisions, part, err := partRevisions(ctx, client, partId)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	revision, err := findRevision(revisions, id)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	if revision.id == revisions[0].id {
+		return map[string]interface{}{"ok": 1, "msg": "part config is already at revision " + revision.id, "revision": revision.id}, nil
+	}
+
+	params := map[string]string{"revision": revision.id}
+	op := operation{Command: "rollback_revision", Params: params}
+	resp, err := b.restorePartConfig(ctx, client, part.GetRobot(), op, revision.conf, "before rolling back to revision "+revision.id, "")
+	resp["revision"] = revision.id
+	if err := responseError(resp, err); err != nil {
+		b.notify(eventUpdateFailed, params, err)
+	} else {
+		b.notify(eventRevisionRestored, params, nil)
+	}
+	return resp, err
+}
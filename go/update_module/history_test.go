@@ -0,0 +1,110 @@
+package update_module
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	app_proto "go.viam.com/api/app/v1"
+	"go.viam.com/rdk/logging"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestPartRevisions(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeFleetClient()
+	client.addMachine(t, "loc", "robot", "c")
+	older, err := structpb.NewStruct(map[string]interface{}{"fragments": []interface{}{"a"}})
+	require.NoError(t, err)
+	newer, err := structpb.NewStruct(map[string]interface{}{"fragments": []interface{}{"b"}})
+	require.NoError(t, err)
+	now := time.Now()
+	// out of order, the older edit first
+	client.history["robot-main"] = []*app_proto.RobotPartHistoryEntry{
+		{When: timestamppb.New(now.Add(-time.Hour)), Old: &app_proto.RobotPart{RobotConfig: older}, EditedBy: &app_proto.AuthenticatorInfo{Type: app_proto.AuthenticationType_AUTHENTICATION_TYPE_WEB_OAUTH, Value: "alice@example.com"}},
+		{When: timestamppb.New(now), Old: &app_proto.RobotPart{RobotConfig: newer}, EditedBy: &app_proto.AuthenticatorInfo{Type: app_proto.AuthenticationType_AUTHENTICATION_TYPE_API_KEY, Value: "key-name"}},
+	}
+
+	revisions, part, err := partRevisions(ctx, client, "robot-main")
+	require.NoError(t, err)
+	assert.Equal(t, "robot", part.Robot)
+	require.Len(t, revisions, 3)
+	assert.True(t, revisions[0].current)
+	assert.Equal(t, revisionId(client.parts["robot"][0].RobotConfig), revisions[0].id)
+	assert.Equal(t, revisionId(newer), revisions[1].id)
+	assert.Equal(t, revisionId(older), revisions[2].id)
+
+	// the newest edit made the current config
+	m := revisions[0].toMap(0)
+	assert.Equal(t, "key-name", m["edited_by"])
+	assert.Equal(t, "api_key", m["editor_type"])
+	assert.Equal(t, now.Format(time.RFC3339), m["saved_at"])
+	m = revisions[1].toMap(1)
+	assert.Equal(t, "alice@example.com", m["edited_by"])
+	assert.Equal(t, "web_oauth", m["editor_type"])
+	// nothing is known about who made the oldest revision
+	assert.NotContains(t, revisions[2].toMap(2), "edited_by")
+	assert.NotContains(t, revisions[2].toMap(2), "saved_at")
+
+	r, err := findRevision(revisions, revisionCurrent)
+	require.NoError(t, err)
+	assert.Same(t, revisions[0], r)
+	_, err = findRevision(revisions, "nope")
+	assert.ErrorIs(t, err, errRevisionNotFound)
+}
+
+func TestPartHistoryCommands(t *testing.T) {
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	ctx := context.Background()
+	client := newFakeFleetClient()
+	client.addMachine(t, "loc", "robot", "a")
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: ctx, cfg: partTestConfig()}
+	usePartClient(t, &module, client)
+	original := revisionId(client.parts["robot"][0].RobotConfig)
+
+	// an edit, as made in the app
+	conf, err := structpb.NewStruct(map[string]interface{}{"fragments": []interface{}{"a", "b"}})
+	require.NoError(t, err)
+	_, err = client.UpdateRobotPart(ctx, &app_proto.UpdateRobotPartRequest{Id: "robot-main", Name: "robot-main", RobotConfig: conf})
+	require.NoError(t, err)
+
+	resp, err := module.doCommand(ctx, map[string]interface{}{"command": "part_history"})
+	require.NoError(t, err)
+	revisions := resp["revisions"].([]interface{})
+	require.Len(t, revisions, 2)
+	assert.Equal(t, original, revisions[1].(map[string]interface{})["id"])
+	_, err = structpb.NewStruct(resp)
+	assert.NoError(t, err)
+	resp, err = module.doCommand(ctx, map[string]interface{}{"command": "part_history", "limit": 1.0})
+	require.NoError(t, err)
+	assert.Len(t, resp["revisions"], 1)
+	_, err = module.doCommand(ctx, map[string]interface{}{"command": "part_history", "limit": 0.0})
+	assert.ErrorIs(t, err, errInvalidLimit)
+
+	resp, err = module.doCommand(ctx, map[string]interface{}{"command": "diff_revisions", "from": original})
+	require.NoError(t, err)
+	assert.Equal(t, revisionCurrent, resp["against"])
+	assert.Equal(t, map[string]interface{}{driftExtraFragment: 1}, resp["counts"])
+
+	resp, err = module.doCommand(ctx, map[string]interface{}{"command": "rollback_revision", "revision": original})
+	require.NoError(t, err)
+	assert.Equal(t, 1, resp["ok"])
+	assert.Equal(t, []string{"a"}, client.fragments("robot-main"))
+	assert.NotEmpty(t, resp["pre_restore_snapshot_id"])
+	events, _, _ := module.events.since(0)
+	assert.Equal(t, eventRevisionRestored, events[len(events)-1].Type)
+
+	// rolling back to where the part already is doesn't write it
+	resp, err = module.doCommand(ctx, map[string]interface{}{"command": "rollback_revision", "revision": original})
+	require.NoError(t, err)
+	assert.Contains(t, resp["msg"], "already at revision")
+	assert.Len(t, client.updated, 2)
+
+	_, err = module.doCommand(ctx, map[string]interface{}{"command": "rollback_revision"})
+	assert.ErrorIs(t, err, errRevisionMissing)
+	_, err = module.doCommand(ctx, map[string]interface{}{"command": "diff_revisions", "from": "nope"})
+	assert.ErrorIs(t, err, errRevisionNotFound)
+}
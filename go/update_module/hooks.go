@@ -0,0 +1,262 @@
+package update_module
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	hookStagePre  = "pre"
+	hookStagePost = "post"
+
+	defaultHookTimeout = 60 * time.Second
+	// pending post-restart hooks are persisted here since restarting viam-agent also restarts this module
+	pendingPostHooksFile = "pending_post_hooks.json"
+	maxHookOutput        = 1024
+)
+
+var (
+	errInvalidHook    = errors.New("invalid hook")
+	errPreHookFailed  = errors.New("pre hook failed")
+	errPostHookFailed = errors.New("post hook failed")
+)
+
+// Hook is an executable or shell snippet run before or after a disruptive command. Hooks receive the
+// operation in VIAM_UPDATE_* environment variables.
+type Hook struct {
+	Name string `json:"name,omitempty"`
+	// Stage is "pre" or "post", a failing pre hook aborts the operation
+	Stage string `json:"stage"`
+	// Commands limits the hook to some of update, restart, restart_on_rdk_update, restore_snapshot,
+	// rollback_revision, self_update, apply_bundle and reconcile, empty means all of them
+	Commands []string `json:"commands,omitempty"`
+	// Path and Args run an executable, Shell runs a snippet with /bin/sh -c, exactly one must be set
+	Path           string            `json:"path,omitempty"`
+	Args           []string          `json:"args,omitempty"`
+	Shell          string            `json:"shell,omitempty"`
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"`
+	Env            map[string]string `json:"env,omitempty"`
+}
+
+func (h *Hook) validate() error {
+	if h.Stage != hookStagePre && h.Stage != hookStagePost {
+		return fmt.Errorf("%w: stage must be %q or %q", errInvalidHook, hookStagePre, hookStagePost)
+	}
+	if (h.Path == "") == (h.Shell == "") {
+		return fmt.Errorf("%w: exactly one of path or shell is required", errInvalidHook)
+	}
+	if len(h.Args) > 0 && h.Path == "" {
+		return fmt.Errorf("%w: args require path", errInvalidHook)
+	}
+	if h.TimeoutSeconds < 0 {
+		return fmt.Errorf("%w: timeout_seconds must not be negative", errInvalidHook)
+	}
+	for _, c := range h.Commands {
+		if !commands[c].disruptive {
+			return fmt.Errorf("%w: unknown command %q", errInvalidHook, c)
+		}
+	}
+	return nil
+}
+
+func (h *Hook) displayName() string {
+	if h.Name != "" {
+		return h.Name
+	}
+	if h.Path != "" {
+		return h.Path
+	}
+	return h.Shell
+}
+
+func (h *Hook) appliesTo(stage, command string) bool {
+	if h.Stage != stage {
+		return false
+	}
+	if len(h.Commands) == 0 {
+		return true
+	}
+	for _, c := range h.Commands {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
+
+// operation describes a disruptive command for hooks
+type operation struct {
+	Command string `json:"command"`
+	// Params are exposed to hooks as VIAM_UPDATE_<KEY>, e.g. VIAM_UPDATE_VERSION
+	Params map[string]string `json:"params,omitempty"`
+}
+
+func (h *Hook) run(ctx context.Context, stage string, op operation, result error) (string, error) {
+	timeout := defaultHookTimeout
+	if h.TimeoutSeconds > 0 {
+		timeout = time.Duration(h.TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if h.Path != "" {
+		cmd = exec.CommandContext(ctx, h.Path, h.Args...)
+	} else {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", h.Shell)
+	}
+	env := os.Environ()
+	for k, v := range h.Env {
+		env = append(env, k+"="+v)
+	}
+	env = append(env, "VIAM_UPDATE_OPERATION="+op.Command, "VIAM_UPDATE_STAGE="+stage)
+	for k, v := range op.Params {
+		env = append(env, "VIAM_UPDATE_"+strings.ToUpper(k)+"="+v)
+	}
+	if stage == hookStagePost {
+		if result == nil {
+			env = append(env, "VIAM_UPDATE_RESULT=success")
+		} else {
+			env = append(env, "VIAM_UPDATE_RESULT=failure", "VIAM_UPDATE_ERROR="+result.Error())
+		}
+	}
+	cmd.Env = env
+	// don't wait on children of a killed shell that still hold the output pipe
+	cmd.WaitDelay = time.Second
+
+	out, err := cmd.CombinedOutput()
+	output := strings.TrimSpace(string(out))
+	if len(output) > maxHookOutput {
+		output = output[len(output)-maxHookOutput:]
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return output, fmt.Errorf("%s timed out after %v", h.displayName(), timeout)
+	}
+	if err != nil {
+		return output, fmt.Errorf("%s: %v: %s", h.displayName(), err, output)
+	}
+	return output, nil
+}
+
+// hasHooks reports whether any configured hook applies to the stage and command
+func (b *RobotUpdateModule) hasHooks(stage, command string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cfg == nil {
+		return false
+	}
+	for i := range b.cfg.Hooks {
+		if b.cfg.Hooks[i].appliesTo(stage, command) {
+			return true
+		}
+	}
+	return false
+}
+
+// runHooks runs the hooks for the stage and command in order. Pre hooks stop at the first failure, post
+// hooks all run and the failures are joined.
+func (b *RobotUpdateModule) runHooks(ctx context.Context, stage string, op operation, result error) error {
+	b.mu.Lock()
+	var hooks []Hook
+	if b.cfg != nil {
+		hooks = b.cfg.Hooks
+	}
+	b.mu.Unlock()
+
+	var errs []error
+	for i := range hooks {
+		h := &hooks[i]
+		if !h.appliesTo(stage, op.Command) {
+			continue
+		}
+		b.logger.Infof("Running %s %s hook %s", op.Command, stage, h.displayName())
+		output, err := h.run(ctx, stage, op, result)
+		if output != "" {
+			b.logger.Infof("Hook %s output: %s", h.displayName(), output)
+		}
+		if err == nil {
+			continue
+		}
+		b.logger.Errorf("Hook failed: %v", err)
+		if stage == hookStagePre {
+			return fmt.Errorf("%w: %v", errPreHookFailed, err)
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %v", errPostHookFailed, errors.Join(errs...))
+	}
+	return nil
+}
+
+// savePendingPostHooks records the operation so its post hooks run when the component starts after a
+// restart. Each component saves its own, so components sharing the data directory don't run or clear
+// each other's.
+func (b *RobotUpdateModule) savePendingPostHooks(op operation) error {
+	path, err := b.componentFile(pendingPostHooksFile)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockDataFile(&b.pendingHooksMu, path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return writeFileAtomic(path, data)
+}
+
+// takePendingPostHooks returns and clears the operation saved by savePendingPostHooks, if any
+func (b *RobotUpdateModule) takePendingPostHooks() (*operation, error) {
+	path, err := b.componentFile(pendingPostHooksFile)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := lockDataFile(&b.pendingHooksMu, path)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil {
+		return nil, err
+	}
+	var op operation
+	if err := json.Unmarshal(data, &op); err != nil {
+		return nil, err
+	}
+	return &op, nil
+}
+
+// runPendingPostHooks runs post hooks left over from a restart that also restarted this module and reports
+// the restart as completed
+func (b *RobotUpdateModule) runPendingPostHooks(ctx context.Context) {
+	op, err := b.takePendingPostHooks()
+	if err != nil {
+		b.logger.Errorf("Error reading pending post hooks: %v", err)
+		return
+	}
+	if op == nil {
+		return
+	}
+	b.notify(eventRestartCompleted, op.eventParams(), nil)
+	b.logger.Infof("Running post hooks for %s after restart", op.Command)
+	if err := b.runHooks(ctx, hookStagePost, *op, nil); err != nil {
+		b.logger.Errorf("Error running post hooks after restart: %v", err)
+	}
+}
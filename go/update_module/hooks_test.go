@@ -0,0 +1,83 @@
+package update_module
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.viam.com/rdk/components/generic"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+)
+
+func TestRestartHooks(t *testing.T) {
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	logger := logging.NewTestLogger(t)
+	ctx := context.Background()
+	out := filepath.Join(t.TempDir(), "hooks.log")
+
+	cfg := &Config{Hooks: []Hook{
+		{Stage: hookStagePre, Shell: `echo "pre $VIAM_UPDATE_OPERATION $PARK" >> ` + out, Env: map[string]string{"PARK": "parked"}},
+		{Stage: hookStagePost, Commands: []string{"restart"}, Shell: `echo "post $VIAM_UPDATE_RESULT" >> ` + out},
+		{Stage: hookStagePost, Commands: []string{"update"}, Shell: `echo "update only" >> ` + out},
+	}}
+	manager := &fakeServiceManager{}
+	module := RobotUpdateModule{logger: logger, ctx: ctx, cfg: cfg, serviceManager: manager}
+
+	_, err := module.DoCommand(ctx, map[string]interface{}{"command": "restart", "delay_seconds": 0})
+	require.NoError(t, err)
+	log, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "pre restart parked\npost success\n", string(log))
+
+	// a failing pre hook aborts the restart
+	cfg.Hooks = append([]Hook{{Stage: hookStagePre, Shell: "echo not parked; exit 3"}}, cfg.Hooks...)
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "restart", "delay_seconds": 0})
+	assert.ErrorIs(t, err, errPreHookFailed)
+	assert.Contains(t, err.Error(), "not parked")
+	assert.Equal(t, 1, manager.restartCount())
+
+	cfg.Hooks = []Hook{{Stage: hookStagePre, Shell: "sleep 5", TimeoutSeconds: 1}}
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "restart", "delay_seconds": 0})
+	assert.ErrorIs(t, err, errPreHookFailed)
+	assert.Contains(t, err.Error(), "timed out")
+}
+
+func TestPendingPostHooks(t *testing.T) {
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	logger := logging.NewTestLogger(t)
+	ctx := context.Background()
+	out := filepath.Join(t.TempDir(), "hooks.log")
+
+	cfg := &Config{Hooks: []Hook{{Stage: hookStagePost, Shell: `echo "$VIAM_UPDATE_OPERATION $VIAM_UPDATE_VERSION" >> ` + out}}}
+	module := RobotUpdateModule{Named: resource.NewName(generic.API, "first").AsNamed(), logger: logger, ctx: ctx, cfg: cfg}
+	other := RobotUpdateModule{Named: resource.NewName(generic.API, "second").AsNamed(), logger: logger, ctx: ctx, cfg: cfg}
+
+	// simulate the module being killed by the restart after saving its post hooks
+	require.NoError(t, module.savePendingPostHooks(operation{Command: "restart_on_rdk_update", Params: map[string]string{"version": "0.50.0"}}))
+	// another component sharing the data directory leaves them alone
+	other.runPendingPostHooks(ctx)
+	_, err := os.Stat(out)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	module.runPendingPostHooks(ctx)
+	log, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "restart_on_rdk_update 0.50.0\n", string(log))
+
+	// the pending hooks only run once
+	module.runPendingPostHooks(ctx)
+	log, err = os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "restart_on_rdk_update 0.50.0\n", string(log))
+}
+
+func TestHookValidate(t *testing.T) {
+	assert.NoError(t, (&Hook{Stage: hookStagePre, Path: "/usr/bin/true"}).validate())
+	assert.ErrorIs(t, (&Hook{Stage: "during", Path: "/usr/bin/true"}).validate(), errInvalidHook)
+	assert.ErrorIs(t, (&Hook{Stage: hookStagePre}).validate(), errInvalidHook)
+	assert.ErrorIs(t, (&Hook{Stage: hookStagePre, Path: "/usr/bin/true", Shell: "true"}).validate(), errInvalidHook)
+	assert.ErrorIs(t, (&Hook{Stage: hookStagePre, Shell: "true", Commands: []string{"reboot"}}).validate(), errInvalidHook)
+}
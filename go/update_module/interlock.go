@@ -0,0 +1,94 @@
+package update_module
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.viam.com/rdk/resource"
+)
+
+var (
+	errInterlockNotActuator = errors.New("interlock resource cannot move")
+	errInterlockMoving      = errors.New("interlock resource is moving")
+	errInterlockUnknown     = errors.New("could not determine if interlock resource is moving")
+)
+
+// interlock is a configured resource that must be stationary before a disruptive command runs
+type interlock struct {
+	name     string
+	actuator resource.Actuator
+}
+
+// interlocksFromDependencies resolves the configured interlock resources, which are passed to us as
+// dependencies by Validate, into actuators
+func interlocksFromDependencies(deps resource.Dependencies, names []string) ([]interlock, error) {
+	interlocks := make([]interlock, 0, len(names))
+	for _, name := range names {
+		var found resource.Resource
+		for depName, dep := range deps {
+			if depName.ShortName() == name || depName.Name == name {
+				found = dep
+				break
+			}
+		}
+		if found == nil {
+			return nil, resource.DependencyNotFoundError(resource.Name{Name: name})
+		}
+		actuator, ok := found.(resource.Actuator)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", errInterlockNotActuator, name)
+		}
+		interlocks = append(interlocks, interlock{name: name, actuator: actuator})
+	}
+	return interlocks, nil
+}
+
+// checkInterlocks returns an error describing the first interlock resource that is moving. When stop is
+// set moving resources are stopped first and only refuse if they are still moving afterwards.
+func (b *RobotUpdateModule) checkInterlocks(ctx context.Context, stop bool) error {
+	b.mu.Lock()
+	interlocks := b.interlocks
+	b.mu.Unlock()
+
+	for _, i := range interlocks {
+		moving, err := i.actuator.IsMoving(ctx)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", errInterlockUnknown, i.name, err)
+		}
+		if !moving {
+			continue
+		}
+		if !stop {
+			return fmt.Errorf("%w: %s", errInterlockMoving, i.name)
+		}
+
+		b.logger.Infof("Stopping %s before proceeding", i.name)
+		if err := i.actuator.Stop(ctx, nil); err != nil {
+			return fmt.Errorf("%w: %s: stop failed: %v", errInterlockMoving, i.name, err)
+		}
+		if moving, err = i.actuator.IsMoving(ctx); err != nil {
+			return fmt.Errorf("%w: %s: %v", errInterlockUnknown, i.name, err)
+		}
+		if moving {
+			return fmt.Errorf("%w: %s is still moving after stop", errInterlockMoving, i.name)
+		}
+	}
+	return nil
+}
+
+// gateInterlocks checks the interlocks for a disruptive command, stop_moving in the command overrides the
+// configured stop_interlock_resources
+func (b *RobotUpdateModule) gateInterlocks(ctx context.Context, command string, cmd map[string]interface{}) (map[string]interface{}, error) {
+	b.mu.Lock()
+	stop := b.cfg != nil && b.cfg.StopInterlockResources
+	b.mu.Unlock()
+	if v, ok := cmd["stop_moving"].(bool); ok {
+		stop = v
+	}
+	if err := stepError(ctx, "checking interlocks", b.checkInterlocks(ctx, stop)); err != nil {
+		b.logger.Warnf("Refusing %s: %v", command, err)
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	return nil, nil
+}
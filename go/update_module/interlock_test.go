@@ -0,0 +1,73 @@
+package update_module
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.viam.com/rdk/components/base"
+	"go.viam.com/rdk/components/generic"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+)
+
+// fakeActuator is a base that keeps moving until Stop is called, unless stuck is set
+type fakeActuator struct {
+	resource.Named
+	resource.TriviallyCloseable
+	resource.TriviallyReconfigurable
+	moving bool
+	stuck  bool
+	stops  int
+}
+
+func (f *fakeActuator) IsMoving(ctx context.Context) (bool, error) {
+	return f.moving, nil
+}
+
+func (f *fakeActuator) Stop(ctx context.Context, extra map[string]interface{}) error {
+	f.stops++
+	if !f.stuck {
+		f.moving = false
+	}
+	return nil
+}
+
+func (f *fakeActuator) DoCommand(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	return nil, nil
+}
+
+func TestInterlocks(t *testing.T) {
+	logger := logging.NewTestLogger(t)
+	ctx := context.Background()
+	manager := &fakeServiceManager{}
+
+	baseName := base.Named("base1")
+	actuator := &fakeActuator{Named: baseName.AsNamed(), moving: true}
+	deps := resource.Dependencies{
+		baseName:               actuator,
+		generic.Named("other"): &fakeActuator{Named: generic.Named("other").AsNamed()},
+	}
+	interlocks, err := interlocksFromDependencies(deps, []string{"base1"})
+	require.NoError(t, err)
+	_, err = interlocksFromDependencies(deps, []string{"arm1"})
+	assert.Error(t, err)
+
+	module := RobotUpdateModule{logger: logger, ctx: ctx, serviceManager: manager, interlocks: interlocks}
+	resp, err := module.DoCommand(ctx, map[string]interface{}{"command": "restart", "delay_seconds": 0})
+	assert.ErrorIs(t, err, errInterlockMoving)
+	assert.Contains(t, resp["error"], "base1")
+	assert.Equal(t, 0, manager.restartCount())
+
+	actuator.stuck = true
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "restart", "delay_seconds": 0, "stop_moving": true})
+	assert.ErrorIs(t, err, errInterlockMoving)
+	assert.Equal(t, 1, actuator.stops)
+
+	actuator.stuck = false
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "restart", "delay_seconds": 0, "stop_moving": true})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, actuator.stops)
+	assert.Equal(t, 1, manager.restartCount())
+}
@@ -0,0 +1,447 @@
+package update_module
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maintenancePolicyRefuse = "refuse"
+	maintenancePolicyQueue  = "queue"
+	maintenancePolicyForce  = "force"
+
+	// how far ahead to look for the next window before giving up
+	maintenanceSearchHorizon = 366 * 24 * time.Hour
+)
+
+var (
+	errOutsideMaintenanceWindow = errors.New("outside maintenance window")
+	errNoUpcomingWindow         = errors.New("no upcoming maintenance window")
+	errInvalidMaintenancePolicy = errors.New("invalid maintenance policy")
+	errInvalidMaintenanceWindow = errors.New("invalid maintenance window")
+	weekdays                    = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+)
+
+// MaintenanceWindow is a recurring period during which disruptive commands may run. A window is either a
+// cron expression for the start time with a duration, or a start and end time of day on a set of days.
+type MaintenanceWindow struct {
+	// Cron is a 5 field cron expression (minute hour day-of-month month day-of-week) for the window start
+	Cron            string `json:"cron,omitempty"`
+	DurationMinutes int    `json:"duration_minutes,omitempty"`
+	// Days are three letter day names, e.g. ["sat", "sun"], empty means every day
+	Days []string `json:"days,omitempty"`
+	// Start and End are 24 hour HH:MM times, an End before Start spans midnight
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+	// TimeZone is an IANA time zone name, defaults to UTC
+	TimeZone string `json:"time_zone,omitempty"`
+}
+
+// maintenanceWindow is a validated MaintenanceWindow, both forms are reduced to a cron schedule of start times
+type maintenanceWindow struct {
+	schedule *cronSchedule
+	duration time.Duration
+	location *time.Location
+}
+
+func (w *MaintenanceWindow) parse() (*maintenanceWindow, error) {
+	loc := time.UTC
+	if w.TimeZone != "" {
+		l, err := time.LoadLocation(w.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidMaintenanceWindow, err)
+		}
+		loc = l
+	}
+
+	spec := w.Cron
+	duration := time.Duration(w.DurationMinutes) * time.Minute
+	if spec != "" {
+		if w.Start != "" || w.End != "" || len(w.Days) > 0 {
+			return nil, fmt.Errorf("%w: cron cannot be combined with days, start or end", errInvalidMaintenanceWindow)
+		}
+		if duration <= 0 {
+			return nil, fmt.Errorf("%w: duration_minutes is required with cron", errInvalidMaintenanceWindow)
+		}
+	} else {
+		start, err := parseTimeOfDay(w.Start)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(w.End)
+		if err != nil {
+			return nil, err
+		}
+		duration = end - start
+		if duration <= 0 {
+			duration += 24 * time.Hour
+		}
+		days := "*"
+		if len(w.Days) > 0 {
+			nums := make([]string, 0, len(w.Days))
+			for _, d := range w.Days {
+				n, ok := weekdays[strings.ToLower(d)]
+				if !ok {
+					return nil, fmt.Errorf("%w: unknown day %q", errInvalidMaintenanceWindow, d)
+				}
+				nums = append(nums, strconv.Itoa(n))
+			}
+			days = strings.Join(nums, ",")
+		}
+		spec = fmt.Sprintf("%d %d * * %s", int(start.Minutes())%60, int(start.Hours()), days)
+	}
+
+	schedule, err := parseCron(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &maintenanceWindow{schedule: schedule, duration: duration, location: loc}, nil
+}
+
+// contains reports whether t falls within an occurrence of the window
+func (w *maintenanceWindow) contains(t time.Time) bool {
+	t = t.In(w.location).Truncate(time.Minute)
+	for s := t; s.After(t.Add(-w.duration)); s = s.Add(-time.Minute) {
+		if w.schedule.matches(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextStart returns the first window start strictly after t
+func (w *maintenanceWindow) nextStart(t time.Time) (time.Time, bool) {
+	t = t.In(w.location)
+	limit := t.Add(maintenanceSearchHorizon)
+	s := t.Truncate(time.Minute).Add(time.Minute)
+	for s.Before(limit) {
+		if !w.schedule.matchesDay(s) {
+			// skip to the start of the next day
+			y, m, d := s.Date()
+			s = time.Date(y, m, d+1, 0, 0, 0, 0, w.location)
+			continue
+		}
+		if w.schedule.matches(s) {
+			return s, true
+		}
+		s = s.Add(time.Minute)
+	}
+	return time.Time{}, false
+}
+
+// maintenanceWindows parses the configured windows, it is only called on validated configs
+func (cfg *Config) maintenanceWindows() []*maintenanceWindow {
+	if cfg == nil {
+		return nil
+	}
+	windows := make([]*maintenanceWindow, 0, len(cfg.MaintenanceWindows))
+	for _, w := range cfg.MaintenanceWindows {
+		if parsed, err := w.parse(); err == nil {
+			windows = append(windows, parsed)
+		}
+	}
+	return windows
+}
+
+func (cfg *Config) maintenancePolicy() string {
+	if cfg == nil || cfg.MaintenancePolicy == "" {
+		return maintenancePolicyRefuse
+	}
+	return cfg.MaintenancePolicy
+}
+
+func validateMaintenancePolicy(policy string) error {
+	switch policy {
+	case "", maintenancePolicyRefuse, maintenancePolicyQueue, maintenancePolicyForce:
+		return nil
+	}
+	return fmt.Errorf("%w: %s", errInvalidMaintenancePolicy, policy)
+}
+
+// inMaintenanceWindow reports whether t is inside any window and when the next window starts. When no
+// windows are configured every time is a maintenance window.
+func inMaintenanceWindow(windows []*maintenanceWindow, t time.Time) (bool, time.Time, bool) {
+	if len(windows) == 0 {
+		return true, time.Time{}, false
+	}
+	in := false
+	var next time.Time
+	found := false
+	for _, w := range windows {
+		if w.contains(t) {
+			in = true
+		}
+		if s, ok := w.nextStart(t); ok && (!found || s.Before(next)) {
+			next = s
+			found = true
+		}
+	}
+	return in, next, found
+}
+
+// queuedCommand is a disruptive command waiting for the next maintenance window
+type queuedCommand struct {
+	id      int
+	command string
+	at      time.Time
+	timer   *time.Timer
+}
+
+// gateMaintenance applies the maintenance window policy to a disruptive command. It returns handled=false
+// when the command may run now, otherwise the response to return to the caller.
+func (b *RobotUpdateModule) gateMaintenance(command string, cmd map[string]interface{}) (map[string]interface{}, bool, error) {
+	b.mu.Lock()
+	windows := b.cfg.maintenanceWindows()
+	policy := b.cfg.maintenancePolicy()
+	b.mu.Unlock()
+	if p, ok := cmd["maintenance_policy"].(string); ok && p != "" {
+		policy = p
+	}
+	if err := validateMaintenancePolicy(policy); err != nil {
+		return map[string]interface{}{"error": err.Error()}, true, err
+	}
+
+	in, next, found := inMaintenanceWindow(windows, b.gateTime(command, cmd))
+	if in {
+		return nil, false, nil
+	}
+	if policy == maintenancePolicyForce {
+		b.logger.Warnf("Running %s outside of a maintenance window, forced by policy", command)
+		return nil, false, nil
+	}
+	if !found {
+		b.logger.Errorf("Refusing %s, %v", command, errNoUpcomingWindow)
+		return map[string]interface{}{"error": errNoUpcomingWindow.Error()}, true, errNoUpcomingWindow
+	}
+
+	nextWindow := next.Format(time.RFC3339)
+	if policy == maintenancePolicyRefuse {
+		b.logger.Infof("Refusing %s outside of a maintenance window, next window starts %s", command, nextWindow)
+		return map[string]interface{}{"error": errOutsideMaintenanceWindow.Error(), "next_window": nextWindow}, true, errOutsideMaintenanceWindow
+	}
+
+	if command == "restart" {
+		p := b.scheduleRestart(next, operation{Command: "restart"})
+		return map[string]interface{}{"ok": 1, "queued": true, "restart_at": p.at.Format(time.RFC3339), "next_window": nextWindow}, true, nil
+	}
+	q := b.queueCommand(command, cmd, next)
+	return map[string]interface{}{"ok": 1, "queued": true, "queue_id": q.id, "next_window": nextWindow}, true, nil
+}
+
+// gateTime is when the command makes its change, the restart time for commands that schedule a restart
+func (b *RobotUpdateModule) gateTime(command string, cmd map[string]interface{}) time.Time {
+	now := time.Now()
+	if !commands[command].restarting {
+		return now
+	}
+	if restart, ok := cmd["restart"].(bool); ok && !restart {
+		return now
+	}
+	// an invalid time is refused by the command itself
+	at, err := b.restartTimeFromRequest(cmd)
+	if err != nil || !at.After(now) {
+		return now
+	}
+	return at
+}
+
+// windowCheck returns the check a restart scheduled by the command makes when it fires, that it is
+// still inside a maintenance window. Commands forced outside of windows get none.
+func (b *RobotUpdateModule) windowCheck(cmd map[string]interface{}) func() error {
+	b.mu.Lock()
+	policy := b.cfg.maintenancePolicy()
+	b.mu.Unlock()
+	if p, ok := cmd["maintenance_policy"].(string); ok && p != "" {
+		policy = p
+	}
+	if policy == maintenancePolicyForce {
+		return nil
+	}
+	return func() error {
+		b.mu.Lock()
+		windows := b.cfg.maintenanceWindows()
+		b.mu.Unlock()
+		in, next, found := inMaintenanceWindow(windows, time.Now())
+		switch {
+		case in:
+			return nil
+		case found:
+			return fmt.Errorf("%w, next window starts %s", errOutsideMaintenanceWindow, next.Format(time.RFC3339))
+		}
+		return errNoUpcomingWindow
+	}
+}
+
+// queueCommand re-runs the command at the given time with the force policy
+func (b *RobotUpdateModule) queueCommand(command string, cmd map[string]interface{}, at time.Time) *queuedCommand {
+	queued := make(map[string]interface{}, len(cmd)+1)
+	for k, v := range cmd {
+		queued[k] = v
+	}
+	queued["maintenance_policy"] = maintenancePolicyForce
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastQueueId++
+	q := &queuedCommand{id: b.lastQueueId, command: command, at: at}
+	q.timer = time.AfterFunc(time.Until(at), func() {
+		b.mu.Lock()
+		delete(b.queuedCommands, q.id)
+		ctx := b.ctx
+		b.mu.Unlock()
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		b.logger.Infof("Running queued %s", command)
+		b.events.publish(eventJobStarted, map[string]string{"command": command, "job_id": strconv.Itoa(q.id)}, nil)
+		if _, err := b.DoCommand(ctx, queued); err != nil {
+			b.logger.Errorf("Error running queued %s: %v", command, err)
+		}
+	})
+	if b.queuedCommands == nil {
+		b.queuedCommands = make(map[int]*queuedCommand)
+	}
+	b.queuedCommands[q.id] = q
+	b.logger.Infof("Queued %s until maintenance window at %v", command, at)
+	b.events.publish(eventJobQueued, map[string]string{"command": command, "job_id": strconv.Itoa(q.id), "run_at": at.Format(time.RFC3339)}, nil)
+	return q
+}
+
+// cancelQueuedCommands stops all commands waiting for a maintenance window
+func (b *RobotUpdateModule) cancelQueuedCommands() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, q := range b.queuedCommands {
+		q.timer.Stop()
+		delete(b.queuedCommands, id)
+		b.events.publish(eventJobCancelled, map[string]string{"command": q.command, "job_id": strconv.Itoa(id)}, nil)
+	}
+}
+
+// maintenanceStatus reports whether a window is open, when the next one starts and what is queued
+func (b *RobotUpdateModule) maintenanceStatus() map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	windows := b.cfg.maintenanceWindows()
+	in, next, found := inMaintenanceWindow(windows, time.Now())
+	resp := map[string]interface{}{"in_window": in, "windows_configured": len(windows), "policy": b.cfg.maintenancePolicy()}
+	if found {
+		resp["next_window"] = next.Format(time.RFC3339)
+	}
+	queued := make([]interface{}, 0, len(b.queuedCommands))
+	for _, q := range b.queuedCommands {
+		queued = append(queued, map[string]interface{}{"queue_id": q.id, "command": q.command, "run_at": q.at.Format(time.RFC3339)})
+	}
+	resp["queued"] = queued
+	return resp
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%w: time of day %q must be HH:MM", errInvalidMaintenanceWindow, s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// cronSchedule is a parsed 5 field cron expression
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	domStar, dowStar              bool
+}
+
+func parseCron(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%w: cron %q must have 5 fields", errInvalidMaintenanceWindow, spec)
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+	sets := make([]map[int]bool, 5)
+	for i, f := range fields {
+		set, err := parseCronField(f, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("%w: cron %q: %v", errInvalidMaintenanceWindow, spec, err)
+		}
+		sets[i] = set
+	}
+	return &cronSchedule{
+		minute:  sets[0],
+		hour:    sets[1],
+		dom:     sets[2],
+		month:   sets[3],
+		dow:     sets[4],
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}, nil
+}
+
+// parseCronField parses lists of values, ranges and steps, e.g. "*/15", "1-5", "0,30"
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			step = s
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			v, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			lo, hi = v, v
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid range %q", part)
+				}
+			}
+		}
+		// 7 is an alias for sunday
+		if max == 6 && hi == 7 {
+			set[0] = true
+			if lo == 7 {
+				continue
+			}
+			hi = 6
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// matchesDay applies the usual cron rule, when both day fields are restricted either may match
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	if !c.month[int(t.Month())] {
+		return false
+	}
+	dom := c.dom[t.Day()]
+	dow := c.dow[int(t.Weekday())]
+	switch {
+	case c.domStar && c.dowStar:
+		return true
+	case c.domStar:
+		return dow
+	case c.dowStar:
+		return dom
+	}
+	return dom || dow
+}
+
+func (c *cronSchedule) matches(t time.Time) bool {
+	return c.minute[t.Minute()] && c.hour[t.Hour()] && c.matchesDay(t)
+}
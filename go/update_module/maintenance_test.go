@@ -0,0 +1,140 @@
+package update_module
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.viam.com/rdk/logging"
+)
+
+func TestMaintenanceWindowDayTimeRange(t *testing.T) {
+	// Saturday 22:00 to Sunday 02:00 New York time
+	w, err := (&MaintenanceWindow{Days: []string{"sat"}, Start: "22:00", End: "02:00", TimeZone: "America/New_York"}).parse()
+	require.NoError(t, err)
+	ny, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+
+	assert.True(t, w.contains(time.Date(2024, 6, 1, 22, 0, 0, 0, ny)))
+	assert.True(t, w.contains(time.Date(2024, 6, 2, 1, 59, 0, 0, ny)))
+	assert.False(t, w.contains(time.Date(2024, 6, 2, 2, 0, 0, 0, ny)))
+	assert.False(t, w.contains(time.Date(2024, 6, 1, 21, 59, 0, 0, ny)))
+	// the same instant expressed in UTC
+	assert.True(t, w.contains(time.Date(2024, 6, 2, 3, 0, 0, 0, time.UTC)))
+
+	next, ok := w.nextStart(time.Date(2024, 6, 3, 12, 0, 0, 0, ny))
+	assert.True(t, ok)
+	assert.True(t, next.Equal(time.Date(2024, 6, 8, 22, 0, 0, 0, ny)))
+}
+
+func TestMaintenanceWindowCron(t *testing.T) {
+	// every weekday at 03:30 for 45 minutes
+	w, err := (&MaintenanceWindow{Cron: "30 3 * * 1-5", DurationMinutes: 45}).parse()
+	require.NoError(t, err)
+
+	assert.True(t, w.contains(time.Date(2024, 6, 3, 4, 14, 0, 0, time.UTC)))
+	assert.False(t, w.contains(time.Date(2024, 6, 3, 4, 15, 0, 0, time.UTC)))
+	assert.False(t, w.contains(time.Date(2024, 6, 1, 3, 45, 0, 0, time.UTC)))
+
+	next, ok := w.nextStart(time.Date(2024, 6, 7, 3, 30, 0, 0, time.UTC))
+	assert.True(t, ok)
+	assert.True(t, next.Equal(time.Date(2024, 6, 10, 3, 30, 0, 0, time.UTC)))
+
+	for _, bad := range []MaintenanceWindow{
+		{Cron: "30 3 * *", DurationMinutes: 45},
+		{Cron: "61 3 * * *", DurationMinutes: 45},
+		{Cron: "30 3 * * *"},
+		{Start: "25:00", End: "02:00"},
+		{Days: []string{"someday"}, Start: "01:00", End: "02:00"},
+		{Start: "01:00", End: "02:00", TimeZone: "Mars/Olympus_Mons"},
+	} {
+		_, err := bad.parse()
+		assert.ErrorIs(t, err, errInvalidMaintenanceWindow, "%+v", bad)
+	}
+}
+
+func TestMaintenancePolicies(t *testing.T) {
+	logger := logging.NewTestLogger(t)
+	ctx := context.Background()
+	manager := &fakeServiceManager{}
+
+	// a one minute window that started two hours ago, so we are always outside of it
+	start := time.Now().UTC().Add(-2 * time.Hour)
+	cfg := &Config{MaintenanceWindows: []MaintenanceWindow{{Start: start.Format("15:04"), End: start.Add(time.Minute).Format("15:04")}}}
+	module := RobotUpdateModule{logger: logger, ctx: ctx, cfg: cfg, serviceManager: manager}
+
+	resp, err := module.DoCommand(ctx, map[string]interface{}{"command": "restart", "delay_seconds": 0})
+	assert.ErrorIs(t, err, errOutsideMaintenanceWindow)
+	assert.Contains(t, resp, "next_window")
+	assert.Equal(t, 0, manager.restartCount())
+
+	// only reconcile has a dry run, dry_run on other commands doesn't get them past the gate
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "restart", "delay_seconds": 0, "dry_run": true})
+	assert.ErrorIs(t, err, errOutsideMaintenanceWindow)
+	assert.Equal(t, 0, manager.restartCount())
+
+	resp, err = module.DoCommand(ctx, map[string]interface{}{"command": "restart", "maintenance_policy": "queue"})
+	assert.NoError(t, err)
+	assert.Equal(t, true, resp["queued"])
+	assert.Equal(t, resp["next_window"], resp["restart_at"])
+	assert.Equal(t, true, module.restartStatus()["pending"])
+	module.cancelRestart()
+
+	resp, err = module.DoCommand(ctx, map[string]interface{}{"command": "update", "maintenance_policy": "queue"})
+	assert.NoError(t, err)
+	assert.Equal(t, true, resp["queued"])
+	status := module.maintenanceStatus()
+	assert.Equal(t, false, status["in_window"])
+	assert.Len(t, status["queued"], 1)
+	module.cancelQueuedCommands()
+
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "restart", "delay_seconds": 0, "maintenance_policy": "force"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, manager.restartCount())
+
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "restart", "maintenance_policy": "whenever"})
+	assert.ErrorIs(t, err, errInvalidMaintenancePolicy)
+
+	// non disruptive commands are never gated
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "pending_restart"})
+	assert.NoError(t, err)
+}
+
+func TestMaintenanceWindowAtRestart(t *testing.T) {
+	ctx := context.Background()
+	manager := &fakeServiceManager{}
+	// a window from a minute ago to two minutes from now
+	start := time.Now().UTC().Add(-time.Minute)
+	cfg := &Config{MaintenanceWindows: []MaintenanceWindow{{Start: start.Format("15:04"), End: start.Add(3 * time.Minute).Format("15:04")}}}
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: ctx, cfg: cfg, serviceManager: manager}
+
+	// the window is checked for when the restart would happen
+	resp, err := module.DoCommand(ctx, map[string]interface{}{"command": "restart", "delay_seconds": 3600})
+	assert.ErrorIs(t, err, errOutsideMaintenanceWindow)
+	assert.Contains(t, resp, "next_window")
+	resp, err = module.DoCommand(ctx, map[string]interface{}{"command": "restart", "delay_seconds": 30})
+	require.NoError(t, err)
+	assert.Contains(t, resp, "restart_at")
+
+	// and again when the restart fires, a window that has since closed refuses it
+	module.cfg = &Config{MaintenanceWindows: []MaintenanceWindow{{Start: start.Add(-2 * time.Hour).Format("15:04"), End: start.Add(-time.Hour).Format("15:04")}}}
+	module.mu.Lock()
+	p := module.pendingRestart
+	module.mu.Unlock()
+	require.NotNil(t, p)
+	p.timer.Stop()
+	module.runPendingRestart(p)
+	assert.Equal(t, 0, manager.restartCount())
+	assert.Contains(t, module.restartStatus()["last_restart_error"], errOutsideMaintenanceWindow.Error())
+
+	// forced restarts skip the check
+	module.scheduleRestart(time.Now().Add(time.Hour), operation{Command: "restart"}, module.windowCheck(map[string]interface{}{"maintenance_policy": "force"}))
+	module.mu.Lock()
+	p = module.pendingRestart
+	module.mu.Unlock()
+	p.timer.Stop()
+	module.runPendingRestart(p)
+	assert.Equal(t, 1, manager.restartCount())
+}
@@ -0,0 +1,247 @@
+package update_module
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metricCommands              = "robot_update_commands_total"
+	metricUpdateRobotPart       = "robot_update_update_robot_part_seconds"
+	metricRestartToHealthy      = "robot_update_restart_to_healthy_seconds"
+	metricVersionWait           = "robot_update_version_wait_seconds"
+	metricsPath                 = "/metrics"
+	metricsServerShutdownPeriod = 5 * time.Second
+)
+
+type metricDef struct {
+	help string
+	// buckets are the histogram upper bounds in seconds, counters have none
+	buckets []float64
+}
+
+var metricDefs = map[string]metricDef{
+	metricCommands:         {help: "DoCommand calls by command and result."},
+	metricUpdateRobotPart:  {help: "Latency of UpdateRobotPart calls to app.", buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}},
+	metricRestartToHealthy: {help: "Time from restarting the service unit until it reports active.", buckets: []float64{1, 2.5, 5, 10, 20, 30, 60, 120, 300}},
+	metricVersionWait:      {help: "Time restart_on_rdk_update waited for the new viam-server version.", buckets: []float64{1, 5, 10, 15, 20, 30, 60}},
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// metrics are the module's counters and histograms, the zero value is ready to use
+type metrics struct {
+	mu sync.Mutex
+	// counters are keyed by metric name, then by rendered label set
+	counters   map[string]map[string]float64
+	histograms map[string]*histogram
+}
+
+func (m *metrics) inc(name string, labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counters == nil {
+		m.counters = map[string]map[string]float64{}
+	}
+	if m.counters[name] == nil {
+		m.counters[name] = map[string]float64{}
+	}
+	m.counters[name][renderLabels(labels)]++
+}
+
+func (m *metrics) observe(name string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.histograms == nil {
+		m.histograms = map[string]*histogram{}
+	}
+	h := m.histograms[name]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(metricDefs[name].buckets))}
+		m.histograms[name] = h
+	}
+	v := d.Seconds()
+	for i, le := range metricDefs[name].buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// countCommand records a DoCommand call. Commands this module doesn't know are counted together so
+// callers can't grow the label set without bound.
+func (m *metrics) countCommand(command string, resp map[string]interface{}, err error) {
+	if _, known := commands[command]; !known {
+		command = "unknown"
+	}
+	result := "ok"
+	if _, failed := resp["error"]; err != nil || failed {
+		result = "error"
+	}
+	m.inc(metricCommands, map[string]string{"command": command, "result": result})
+}
+
+func renderLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%q", k, labels[k]))
+	}
+	return strings.Join(parts, ",")
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedMetricNames() []string {
+	names := make([]string, 0, len(metricDefs))
+	for name := range metricDefs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writePrometheus writes the metrics in the Prometheus text exposition format
+func (m *metrics) writePrometheus(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sb strings.Builder
+	for _, name := range sortedMetricNames() {
+		def := metricDefs[name]
+		fmt.Fprintf(&sb, "# HELP %s %s\n", name, def.help)
+		if def.buckets == nil {
+			fmt.Fprintf(&sb, "# TYPE %s counter\n", name)
+			series := m.counters[name]
+			labelSets := make([]string, 0, len(series))
+			for labels := range series {
+				labelSets = append(labelSets, labels)
+			}
+			sort.Strings(labelSets)
+			for _, labels := range labelSets {
+				fmt.Fprintf(&sb, "%s{%s} %s\n", name, labels, formatFloat(series[labels]))
+			}
+			continue
+		}
+		fmt.Fprintf(&sb, "# TYPE %s histogram\n", name)
+		h := m.histograms[name]
+		if h == nil {
+			h = &histogram{counts: make([]uint64, len(def.buckets))}
+		}
+		for i, le := range def.buckets {
+			fmt.Fprintf(&sb, "%s_bucket{le=%q} %d\n", name, formatFloat(le), h.counts[i])
+		}
+		fmt.Fprintf(&sb, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+		fmt.Fprintf(&sb, "%s_sum %s\n", name, formatFloat(h.sum))
+		fmt.Fprintf(&sb, "%s_count %d\n", name, h.count)
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// metricsResponse handles the metrics command, returning the metrics as values and in Prometheus format
+func (b *RobotUpdateModule) metricsResponse() (map[string]interface{}, error) {
+	var sb strings.Builder
+	if err := b.metrics.writePrometheus(&sb); err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+
+	b.metrics.mu.Lock()
+	defer b.metrics.mu.Unlock()
+	counters := map[string]interface{}{}
+	for name, series := range b.metrics.counters {
+		for labels, v := range series {
+			counters[name+"{"+labels+"}"] = v
+		}
+	}
+	histograms := map[string]interface{}{}
+	for name, h := range b.metrics.histograms {
+		buckets := map[string]interface{}{}
+		for i, le := range metricDefs[name].buckets {
+			buckets[formatFloat(le)] = h.counts[i]
+		}
+		histograms[name] = map[string]interface{}{"count": h.count, "sum": h.sum, "buckets": buckets}
+	}
+	return map[string]interface{}{"ok": 1, "counters": counters, "histograms": histograms, "prometheus": sb.String()}, nil
+}
+
+// metricsServer serves the metrics over HTTP on the configured address
+type metricsServer struct {
+	// address is the configured address, listener may be on another port if it asked for port 0
+	address  string
+	listener net.Listener
+	server   *http.Server
+}
+
+func (b *RobotUpdateModule) startMetricsServer(address string) (*metricsServer, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("listening for metrics on %s: %w", address, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := b.metrics.writePrometheus(w); err != nil {
+			b.logger.Debugf("Error writing metrics: %v", err)
+		}
+	})
+	s := &metricsServer{address: address, listener: l, server: &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}}
+	go func() {
+		if err := s.server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			b.logger.Errorf("Metrics server stopped: %v", err)
+		}
+	}()
+	b.logger.Infof("Serving metrics on http://%s%s", l.Addr(), metricsPath)
+	return s, nil
+}
+
+func (s *metricsServer) close(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, metricsServerShutdownPeriod)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+// reconfigureMetricsServer starts, moves or stops the metrics server to match the configured address
+func (b *RobotUpdateModule) reconfigureMetricsServer(ctx context.Context, address string) error {
+	b.metricsServerMu.Lock()
+	defer b.metricsServerMu.Unlock()
+	if b.metricsServer != nil && b.metricsServer.address == address {
+		return nil
+	}
+	if err := b.metricsServer.close(ctx); err != nil {
+		b.logger.Warnf("Error stopping metrics server: %v", err)
+	}
+	b.metricsServer = nil
+	if address == "" {
+		return nil
+	}
+	s, err := b.startMetricsServer(address)
+	if err != nil {
+		return err
+	}
+	b.metricsServer = s
+	return nil
+}
@@ -0,0 +1,96 @@
+package update_module
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.viam.com/rdk/logging"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestMetrics(t *testing.T) {
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	ctx := context.Background()
+	manager := &fakeServiceManager{}
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: ctx, serviceManager: manager}
+
+	_, err := module.DoCommand(ctx, map[string]interface{}{"command": "restart", "delay_seconds": 0})
+	require.NoError(t, err)
+	manager.restartErr = assert.AnError
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "restart", "delay_seconds": 0})
+	require.Error(t, err)
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "no_such_command"})
+	require.Error(t, err)
+	// unknown commands that fail before dispatch aren't counted by name either
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "another_command", "timeout_seconds": "soon"})
+	require.Error(t, err)
+	module.metrics.observe(metricUpdateRobotPart, 200*time.Millisecond)
+
+	resp, err := module.DoCommand(ctx, map[string]interface{}{"command": "metrics"})
+	require.NoError(t, err)
+	counters := resp["counters"].(map[string]interface{})
+	assert.EqualValues(t, 1, counters[`robot_update_commands_total{command="restart",result="ok"}`])
+	assert.EqualValues(t, 1, counters[`robot_update_commands_total{command="restart",result="error"}`])
+	assert.EqualValues(t, 2, counters[`robot_update_commands_total{command="unknown",result="error"}`])
+	histograms := resp["histograms"].(map[string]interface{})
+	assert.EqualValues(t, 1, histograms[metricRestartToHealthy].(map[string]interface{})["count"])
+	part := histograms[metricUpdateRobotPart].(map[string]interface{})
+	assert.EqualValues(t, 0, part["buckets"].(map[string]interface{})["0.1"])
+	assert.EqualValues(t, 1, part["buckets"].(map[string]interface{})["0.25"])
+	_, err = structpb.NewStruct(resp)
+	assert.NoError(t, err)
+
+	text := resp["prometheus"].(string)
+	assert.Contains(t, text, "# TYPE robot_update_commands_total counter\n")
+	assert.Contains(t, text, "# TYPE robot_update_update_robot_part_seconds histogram\n")
+	assert.Contains(t, text, "robot_update_update_robot_part_seconds_bucket{le=\"0.25\"} 1\n")
+	assert.Contains(t, text, "robot_update_update_robot_part_seconds_bucket{le=\"+Inf\"} 1\n")
+	assert.Contains(t, text, "robot_update_update_robot_part_seconds_sum 0.2\n")
+	assert.Contains(t, text, "robot_update_version_wait_seconds_count 0\n")
+
+	// every command DoCommand handles is counted by name, metrics itself included
+	resp, err = module.DoCommand(ctx, map[string]interface{}{"command": "metrics"})
+	require.NoError(t, err)
+	counters = resp["counters"].(map[string]interface{})
+	assert.EqualValues(t, 1, counters[`robot_update_commands_total{command="metrics",result="ok"}`])
+}
+
+func TestMetricsServer(t *testing.T) {
+	ctx := context.Background()
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: ctx}
+	module.metrics.inc(metricCommands, map[string]string{"command": "update", "result": "ok"})
+
+	require.NoError(t, module.reconfigureMetricsServer(ctx, "127.0.0.1:0"))
+	server := module.metricsServer
+	require.NotNil(t, server)
+	// the same address keeps the running server
+	require.NoError(t, module.reconfigureMetricsServer(ctx, "127.0.0.1:0"))
+	assert.Same(t, server, module.metricsServer)
+
+	url := "http://" + server.listener.Addr().String() + metricsPath
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain"))
+	assert.Contains(t, string(body), `robot_update_commands_total{command="update",result="ok"} 1`)
+
+	require.NoError(t, module.Close(ctx))
+	assert.Nil(t, module.metricsServer)
+	_, err = http.Get(url)
+	assert.Error(t, err)
+}
+
+func TestMetricsAddressValidation(t *testing.T) {
+	_, err := (&Config{MetricsAddress: "localhost"}).Validate("path")
+	assert.Error(t, err)
+	_, err = (&Config{MetricsAddress: "127.0.0.1:9464"}).Validate("path")
+	assert.NoError(t, err)
+}
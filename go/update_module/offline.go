@@ -0,0 +1,399 @@
+package update_module
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	offlineQueueFile = "offline_queue.json"
+	// offlineIdKey marks a command run from the offline queue, a retry that can't reach the app stays
+	// in the queue instead of being queued again
+	offlineIdKey              = "offline_id"
+	defaultOfflineQueueMaxAge = 24 * time.Hour
+	maxOfflineBackoff         = 5 * time.Minute
+)
+
+var (
+	initialOfflineBackoff = 5 * time.Second
+
+	errOfflineIdMissing         = errors.New("no offline id provided, give id or all")
+	errOfflineOperationNotFound = errors.New("offline operation not found")
+)
+
+// offlineOperation is a command that failed because the app couldn't be reached, persisted so it is
+// retried after a restart of the module too
+type offlineOperation struct {
+	ID      string `json:"id"`
+	Command string `json:"command"`
+	// Request is the DoCommand payload without inline secrets, retries get credentials from the other
+	// credential sources
+	Request     map[string]interface{} `json:"request"`
+	QueuedAt    time.Time              `json:"queued_at"`
+	Attempts    int                    `json:"attempts"`
+	NextAttempt time.Time              `json:"next_attempt"`
+	LastError   string                 `json:"last_error,omitempty"`
+}
+
+func (o *offlineOperation) toMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"id":           o.ID,
+		"command":      o.Command,
+		"queued_at":    o.QueuedAt.Format(time.RFC3339),
+		"attempts":     o.Attempts,
+		"next_attempt": o.NextAttempt.Format(time.RFC3339),
+	}
+	params := map[string]interface{}{}
+	for k, v := range o.Request {
+		if k != "command" {
+			params[k] = v
+		}
+	}
+	m["params"] = params
+	if o.LastError != "" {
+		m["last_error"] = o.LastError
+	}
+	return m
+}
+
+// appUnreachable reports whether err means the app couldn't be reached, as opposed to the app refusing
+// the request or the command being cancelled
+func appUnreachable(err error) bool {
+	if err == nil || errors.Is(err, errCancelled) || errors.Is(err, errTimedOut) {
+		return false
+	}
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.Unavailable, codes.DeadlineExceeded:
+			return true
+		}
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// partWriteError is a failed UpdateRobotPart call. app may have applied the write before the error
+// reached the module, so the command isn't queued to run again.
+type partWriteError struct {
+	err error
+}
+
+func (e *partWriteError) Error() string {
+	return e.err.Error()
+}
+
+func (e *partWriteError) Unwrap() error {
+	return e.err
+}
+
+// partMayBeWritten reports whether err came from writing the part config
+func partMayBeWritten(err error) bool {
+	var writeErr *partWriteError
+	return errors.As(err, &writeErr)
+}
+
+func (b *RobotUpdateModule) offlineQueueMaxAge() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cfg == nil || b.cfg.OfflineQueueMaxAgeHours == 0 {
+		return defaultOfflineQueueMaxAge
+	}
+	return time.Duration(b.cfg.OfflineQueueMaxAgeHours) * time.Hour
+}
+
+// queueOfflineEnabled reports whether the command is queued when the app can't be reached, queue_offline
+// in the request overrides the config
+func (b *RobotUpdateModule) queueOfflineEnabled(cmd map[string]interface{}) bool {
+	if q, ok := cmd["queue_offline"].(bool); ok {
+		return q
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.cfg != nil && b.cfg.QueueOffline
+}
+
+// queueOffline persists a command that failed with err when queueing is enabled and err means the app
+// couldn't be reached before the part config was written. It returns the response to give the caller instead of the error, or false when the
+// command wasn't queued.
+func (b *RobotUpdateModule) queueOffline(command string, cmd map[string]interface{}, err error) (map[string]interface{}, bool) {
+	if _, retry := cmd[offlineIdKey]; retry || !appUnreachable(err) || !b.queueOfflineEnabled(cmd) {
+		return nil, false
+	}
+	if partMayBeWritten(err) {
+		b.logger.Warnf("Not queueing %s, the part config may have been written before the app became unreachable: %v", command, err)
+		return nil, false
+	}
+	request := make(map[string]interface{}, len(cmd))
+	for k, v := range cmd {
+		request[k] = v
+	}
+	if hasInlineSecrets(cmd) {
+		b.logger.Warnf("Inline credentials are not stored with the offline queued %s, retries use the other credential sources", command)
+		for _, k := range inlineSecretKeys {
+			delete(request, k)
+		}
+	}
+	now := time.Now().UTC()
+	op := offlineOperation{
+		ID:          newEventId(),
+		Command:     command,
+		Request:     request,
+		QueuedAt:    now,
+		Attempts:    1,
+		NextAttempt: now.Add(initialOfflineBackoff),
+		LastError:   err.Error(),
+	}
+
+	qerr := b.updateOfflineQueue(func(queue []offlineOperation) ([]offlineOperation, error) {
+		return append(queue, op), nil
+	})
+	if qerr != nil {
+		b.logger.Errorf("Error queueing %s while offline: %v", command, qerr)
+		return nil, false
+	}
+	b.logger.Warnf("App unreachable, queued %s as %s to retry when connectivity returns: %v", command, op.ID, err)
+	b.events.publish(eventJobQueued, map[string]string{"command": command, "job_id": op.ID, "reason": "offline"}, nil)
+	select {
+	case b.offlineWake <- struct{}{}:
+	default:
+	}
+	return map[string]interface{}{"ok": 1, "queued": true, "offline_id": op.ID, "reason": err.Error()}, true
+}
+
+func loadOfflineQueue(path string) ([]offlineOperation, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var queue []offlineOperation
+	if err := json.Unmarshal(data, &queue); err != nil {
+		return nil, err
+	}
+	return queue, nil
+}
+
+func saveOfflineQueue(path string, queue []offlineOperation) error {
+	if len(queue) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(queue)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// readOfflineQueue returns the operations queued for this component
+func (b *RobotUpdateModule) readOfflineQueue() ([]offlineOperation, error) {
+	path, err := b.componentFile(offlineQueueFile)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := lockDataFile(&b.offlineMu, path)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return loadOfflineQueue(path)
+}
+
+// updateOfflineQueue replaces this component's queue with what change returns. Each component retries
+// only its own queue, so an operation is run by the component it was sent to, with its credentials.
+func (b *RobotUpdateModule) updateOfflineQueue(change func([]offlineOperation) ([]offlineOperation, error)) error {
+	path, err := b.componentFile(offlineQueueFile)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockDataFile(&b.offlineMu, path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	queue, err := loadOfflineQueue(path)
+	if err != nil {
+		return err
+	}
+	queue, err = change(queue)
+	if err != nil {
+		return err
+	}
+	return saveOfflineQueue(path, queue)
+}
+
+// retryOfflineQueue retries due operations in the order they were queued and returns when the next retry
+// is due, or the zero time if the queue is empty. Operations wait for the ones queued before them so
+// updates are applied in order.
+func (b *RobotUpdateModule) retryOfflineQueue(ctx context.Context) time.Time {
+	queue, err := b.readOfflineQueue()
+	if err != nil {
+		b.logger.Errorf("Error reading offline queue: %v", err)
+		return time.Time{}
+	}
+
+	maxAge := b.offlineQueueMaxAge()
+	now := time.Now()
+	done := map[string]bool{}
+	retry := map[string]offlineOperation{}
+	var holdUntil time.Time
+	for _, op := range queue {
+		if now.Sub(op.QueuedAt) > maxAge {
+			b.logger.Errorf("Dropping offline queued %s %s after %d attempts: %s", op.Command, op.ID, op.Attempts, op.LastError)
+			b.events.publish(eventJobCancelled, map[string]string{"command": op.Command, "job_id": op.ID, "reason": "expired"}, nil)
+			done[op.ID] = true
+			continue
+		}
+		if !holdUntil.IsZero() {
+			if op.NextAttempt.Before(holdUntil) {
+				op.NextAttempt = holdUntil
+				retry[op.ID] = op
+			}
+			continue
+		}
+		if op.NextAttempt.After(now) {
+			holdUntil = op.NextAttempt
+			continue
+		}
+
+		b.logger.Infof("Retrying offline queued %s %s, attempt %d", op.Command, op.ID, op.Attempts+1)
+		b.events.publish(eventJobStarted, map[string]string{"command": op.Command, "job_id": op.ID}, nil)
+		request := make(map[string]interface{}, len(op.Request)+1)
+		for k, v := range op.Request {
+			request[k] = v
+		}
+		request[offlineIdKey] = op.ID
+		err := responseError(b.DoCommand(ctx, request))
+		if err == nil {
+			b.logger.Infof("Applied offline queued %s %s", op.Command, op.ID)
+			done[op.ID] = true
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		op.Attempts++
+		op.LastError = err.Error()
+		if !appUnreachable(err) {
+			b.logger.Errorf("Dropping offline queued %s %s, it failed once the app was reachable: %v", op.Command, op.ID, err)
+			done[op.ID] = true
+			continue
+		}
+		if partMayBeWritten(err) {
+			b.logger.Errorf("Dropping offline queued %s %s, the part config may have been written before it failed: %v", op.Command, op.ID, err)
+			done[op.ID] = true
+			continue
+		}
+		backoff := initialOfflineBackoff << min(op.Attempts-1, 20)
+		op.NextAttempt = now.Add(min(backoff, maxOfflineBackoff))
+		b.logger.Warnf("App still unreachable for %s %s, retrying at %v: %v", op.Command, op.ID, op.NextAttempt, err)
+		retry[op.ID] = op
+		holdUntil = op.NextAttempt
+	}
+
+	// operations may have been queued or cancelled while retrying, so merge into the queue as it is now
+	var next time.Time
+	err = b.updateOfflineQueue(func(queue []offlineOperation) ([]offlineOperation, error) {
+		remaining := queue[:0]
+		for _, op := range queue {
+			if done[op.ID] {
+				continue
+			}
+			if r, ok := retry[op.ID]; ok {
+				op = r
+			}
+			if next.IsZero() || op.NextAttempt.Before(next) {
+				next = op.NextAttempt
+			}
+			remaining = append(remaining, op)
+		}
+		return remaining, nil
+	})
+	if err != nil {
+		b.logger.Errorf("Error saving offline queue: %v", err)
+		return time.Time{}
+	}
+	return next
+}
+
+// runOfflineQueue retries queued operations until ctx is done, waking when operations are queued or
+// retries are due
+func (b *RobotUpdateModule) runOfflineQueue(ctx context.Context) {
+	for {
+		next := b.retryOfflineQueue(ctx)
+		var retry <-chan time.Time
+		var timer *time.Timer
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			retry = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-b.offlineWake:
+		case <-retry:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// offlineQueueCommand handles the offline_queue command, listing the operations waiting for the app
+func (b *RobotUpdateModule) offlineQueueCommand() (map[string]interface{}, error) {
+	queue, err := b.readOfflineQueue()
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	queued := make([]interface{}, 0, len(queue))
+	for _, op := range queue {
+		queued = append(queued, op.toMap())
+	}
+	return map[string]interface{}{"ok": 1, "queued": queued, "queue_offline": b.queueOfflineEnabled(map[string]interface{}{})}, nil
+}
+
+// cancelOffline handles the cancel_offline command, removing the operation with the given id or, with
+// all, every queued operation
+func (b *RobotUpdateModule) cancelOffline(cmd map[string]interface{}) (map[string]interface{}, error) {
+	id, _ := cmd["id"].(string)
+	all, _ := cmd["all"].(bool)
+	if id == "" && !all {
+		return map[string]interface{}{"error": errOfflineIdMissing.Error()}, errOfflineIdMissing
+	}
+
+	cancelled := []interface{}{}
+	err := b.updateOfflineQueue(func(queue []offlineOperation) ([]offlineOperation, error) {
+		remaining := queue[:0]
+		for _, op := range queue {
+			if !all && op.ID != id {
+				remaining = append(remaining, op)
+				continue
+			}
+			cancelled = append(cancelled, op.ID)
+			b.events.publish(eventJobCancelled, map[string]string{"command": op.Command, "job_id": op.ID}, nil)
+		}
+		if !all && len(cancelled) == 0 {
+			return nil, fmt.Errorf("%w: %s", errOfflineOperationNotFound, id)
+		}
+		return remaining, nil
+	})
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	b.logger.Infof("Cancelled offline queued operations %v", cancelled)
+	return map[string]interface{}{"ok": 1, "cancelled": cancelled}, nil
+}
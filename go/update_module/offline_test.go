@@ -0,0 +1,194 @@
+package update_module
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.viam.com/rdk/components/generic"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+	"go.viam.com/utils/rpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// makeOfflineQueueDue moves every retry of the offline queue to now
+func makeOfflineQueueDue(t *testing.T, module *RobotUpdateModule) {
+	require.NoError(t, module.updateOfflineQueue(func(queue []offlineOperation) ([]offlineOperation, error) {
+		for i := range queue {
+			queue[i].NextAttempt = time.Now().Add(-time.Second)
+		}
+		return queue, nil
+	}))
+}
+
+func TestOfflineQueue(t *testing.T) {
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	ctx := context.Background()
+	defer func(dial func(context.Context, logging.Logger, *credentials) (rpc.ClientConn, error), backoff time.Duration, id func() (string, error)) {
+		dialAppConn, initialDialBackoff, machineId = dial, backoff, id
+	}(dialAppConn, initialDialBackoff, machineId)
+	dialAppConn = func(ctx context.Context, logger logging.Logger, creds *credentials) (rpc.ClientConn, error) {
+		return nil, status.Error(codes.Unavailable, "no route to app")
+	}
+	initialDialBackoff = time.Millisecond
+	machineId = func() (string, error) { return "robot", nil }
+
+	cfg := partTestConfig()
+	cfg.QueueOffline = true
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: ctx, cfg: cfg}
+	update := map[string]interface{}{"command": "update", "oldFragmentId": "old", "newFragmentId": "new"}
+
+	resp, err := module.DoCommand(ctx, update)
+	require.NoError(t, err)
+	assert.Equal(t, true, resp["queued"])
+	id := resp["offline_id"].(string)
+	resp, err = module.DoCommand(ctx, map[string]interface{}{"command": "offline_queue"})
+	require.NoError(t, err)
+	queued := resp["queued"].([]interface{})
+	require.Len(t, queued, 1)
+	assert.Equal(t, "new", queued[0].(map[string]interface{})["params"].(map[string]interface{})["newFragmentId"])
+	assert.Equal(t, 1, module.jobCounts()["offline_queued"])
+
+	// queueing can be turned off per request
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "update", "oldFragmentId": "old", "newFragmentId": "new", "queue_offline": false})
+	assert.Error(t, err)
+
+	// a retry that still can't reach the app stays queued with a longer backoff
+	makeOfflineQueueDue(t, &module)
+	next := module.retryOfflineQueue(ctx)
+	assert.True(t, next.After(time.Now()))
+	queue, err := module.readOfflineQueue()
+	require.NoError(t, err)
+	require.Len(t, queue, 1)
+	assert.Equal(t, id, queue[0].ID)
+	assert.Equal(t, 2, queue[0].Attempts)
+
+	// once the app is reachable the update is applied and leaves the queue
+	client := newFakeFleetClient()
+	client.addMachine(t, "loc", "robot", "old", "other")
+	usePartClient(t, &module, client)
+	makeOfflineQueueDue(t, &module)
+	assert.True(t, module.retryOfflineQueue(ctx).IsZero())
+	assert.Equal(t, []string{"other", "new"}, client.fragments("robot-main"))
+	queue, err = module.readOfflineQueue()
+	require.NoError(t, err)
+	assert.Empty(t, queue)
+	events, _, _ := module.events.since(0)
+	assert.Contains(t, busEventTypes(events), eventUpdateSucceeded)
+
+	// the part may already have the new fragment when writing it fails, so that isn't queued
+	client.updateErrs["robot-main"] = status.Error(codes.Unavailable, "connection reset")
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "update", "oldFragmentId": "other", "newFragmentId": "newer"})
+	assert.ErrorIs(t, err, client.updateErrs["robot-main"])
+	queue, err = module.readOfflineQueue()
+	require.NoError(t, err)
+	assert.Empty(t, queue)
+}
+
+func TestOfflineQueuePerComponent(t *testing.T) {
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	ctx := context.Background()
+	defer func(id func() (string, error)) { machineId = id }(machineId)
+	machineId = func() (string, error) { return "robot", nil }
+	offline := status.Error(codes.Unavailable, "no route to app")
+
+	client := newFakeFleetClient()
+	client.addMachine(t, "loc", "robot", "old")
+	cfg := partTestConfig()
+	cfg.QueueOffline = true
+	first := RobotUpdateModule{Named: resource.NewName(generic.API, "first").AsNamed(), logger: logging.NewTestLogger(t), ctx: ctx, cfg: cfg}
+	second := RobotUpdateModule{Named: resource.NewName(generic.API, "second").AsNamed(), logger: logging.NewTestLogger(t), ctx: ctx, cfg: cfg}
+	usePartClient(t, &first, client)
+	usePartClient(t, &second, client)
+
+	_, ok := first.queueOffline("update", map[string]interface{}{"command": "update", "oldFragmentId": "old", "newFragmentId": "new"}, offline)
+	require.True(t, ok)
+	_, ok = second.queueOffline("update", map[string]interface{}{"command": "update", "oldFragmentId": "new", "newFragmentId": "newer"}, offline)
+	require.True(t, ok)
+
+	// both components share the data directory, each only runs what was queued with it
+	makeOfflineQueueDue(t, &first)
+	makeOfflineQueueDue(t, &second)
+	assert.True(t, first.retryOfflineQueue(ctx).IsZero())
+	assert.Len(t, client.updated, 1)
+	assert.Equal(t, []string{"new"}, client.fragments("robot-main"))
+	queue, err := second.readOfflineQueue()
+	require.NoError(t, err)
+	require.Len(t, queue, 1)
+	assert.Equal(t, "newer", queue[0].Request["newFragmentId"])
+
+	assert.True(t, second.retryOfflineQueue(ctx).IsZero())
+	assert.Len(t, client.updated, 2)
+	assert.Equal(t, []string{"newer"}, client.fragments("robot-main"))
+	assert.True(t, first.retryOfflineQueue(ctx).IsZero())
+	assert.Len(t, client.updated, 2)
+}
+
+func TestCancelOffline(t *testing.T) {
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	ctx := context.Background()
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: ctx, cfg: &Config{QueueOffline: true, OfflineQueueMaxAgeHours: 1}}
+	offline := status.Error(codes.Unavailable, "no route to app")
+
+	resp, ok := module.queueOffline("update", map[string]interface{}{"command": "update", "apiKey": "secret"}, offline)
+	require.True(t, ok)
+	first := resp["offline_id"].(string)
+	_, ok = module.queueOffline("update", map[string]interface{}{"command": "update"}, offline)
+	require.True(t, ok)
+	queue, err := module.readOfflineQueue()
+	require.NoError(t, err)
+	require.Len(t, queue, 2)
+	assert.NotContains(t, queue[0].Request, "apiKey")
+
+	// retries and refused requests are not queued
+	_, ok = module.queueOffline("update", map[string]interface{}{"command": "update", offlineIdKey: first}, offline)
+	assert.False(t, ok)
+	_, ok = module.queueOffline("update", map[string]interface{}{"command": "update"}, status.Error(codes.PermissionDenied, "no"))
+	assert.False(t, ok)
+
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "cancel_offline"})
+	assert.ErrorIs(t, err, errOfflineIdMissing)
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "cancel_offline", "id": "missing"})
+	assert.ErrorIs(t, err, errOfflineOperationNotFound)
+	resp, err = module.DoCommand(ctx, map[string]interface{}{"command": "cancel_offline", "id": first})
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{first}, resp["cancelled"])
+	queue, err = module.readOfflineQueue()
+	require.NoError(t, err)
+	require.Len(t, queue, 1)
+
+	// operations older than offline_queue_max_age_hours are dropped
+	require.NoError(t, module.updateOfflineQueue(func(queue []offlineOperation) ([]offlineOperation, error) {
+		queue[0].QueuedAt = time.Now().Add(-2 * time.Hour)
+		return queue, nil
+	}))
+	assert.True(t, module.retryOfflineQueue(ctx).IsZero())
+	queue, err = module.readOfflineQueue()
+	require.NoError(t, err)
+	assert.Empty(t, queue)
+
+	_, ok = module.queueOffline("update", map[string]interface{}{"command": "update"}, offline)
+	require.True(t, ok)
+	resp, err = module.DoCommand(ctx, map[string]interface{}{"command": "cancel_offline", "all": true})
+	require.NoError(t, err)
+	assert.Len(t, resp["cancelled"], 1)
+
+	_, err = (&Config{OfflineQueueMaxAgeHours: -1}).Validate("path")
+	assert.Error(t, err)
+}
+
+func TestAppUnreachable(t *testing.T) {
+	assert.True(t, appUnreachable(status.Error(codes.Unavailable, "unavailable")))
+	assert.True(t, appUnreachable(fmt.Errorf("dialing app failed after 4 attempts: %w", &net.DNSError{Err: "no such host", Name: "app.viam.com"})))
+	assert.True(t, appUnreachable(context.DeadlineExceeded))
+	assert.False(t, appUnreachable(status.Error(codes.Unauthenticated, "bad key")))
+	assert.False(t, appUnreachable(fmt.Errorf("%w during step dialing app", errCancelled)))
+	assert.False(t, appUnreachable(errRobotNotOnline))
+	assert.False(t, appUnreachable(nil))
+}
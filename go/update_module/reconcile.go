@@ -0,0 +1,264 @@
+package update_module
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	app_proto "go.viam.com/api/app/v1"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	configutils "github.com/thegreatco/viamutils/config"
+)
+
+const (
+	defaultReconcileInterval = 5 * time.Minute
+	eventReconciled          = "reconciled"
+)
+
+var (
+	// machineId and machinePartId return the ids of the machine and part this module runs on, tests
+	// replace them
+	machineId     = configutils.GetMachineId
+	machinePartId = configutils.GetMachinePartId
+
+	errNoDesiredState = errors.New("no desired_state or desired_state_file configured")
+)
+
+// reconcileResult is the outcome of a reconciliation pass
+type reconcileResult struct {
+	at      time.Time
+	partId  string
+	drift   []driftItem
+	dryRun  bool
+	applied bool
+	// deferred is set when drift was found outside of a maintenance window, deferredUntil is when the
+	// next window starts
+	deferred      bool
+	deferredUntil time.Time
+	err           error
+}
+
+func (r *reconcileResult) toMap() map[string]interface{} {
+	drift := make([]interface{}, 0, len(r.drift))
+	for _, d := range r.drift {
+		drift = append(drift, d.toMap())
+	}
+	m := map[string]interface{}{
+		"checked_at": r.at.Format(time.RFC3339),
+		"in_sync":    len(r.drift) == 0,
+		"drift":      drift,
+		"applied":    r.applied,
+		"dry_run":    r.dryRun,
+		"deferred":   r.deferred,
+	}
+	if r.partId != "" {
+		m["part_id"] = r.partId
+	}
+	if !r.deferredUntil.IsZero() {
+		m["deferred_until"] = r.deferredUntil.Format(time.RFC3339)
+	}
+	if r.err != nil {
+		m["error"] = r.err.Error()
+	} else {
+		m["ok"] = 1
+	}
+	return m
+}
+
+// desiredState returns the desired state from the file, read on every pass so edits apply without a
+// reconfigure, or from the config
+func (cfg *Config) desiredState() (*DesiredState, error) {
+	switch {
+	case cfg == nil:
+		return nil, errNoDesiredState
+	case cfg.DesiredStateFile != "":
+		return loadDesiredState(cfg.DesiredStateFile)
+	case cfg.DesiredState != nil:
+		return cfg.DesiredState, nil
+	}
+	return nil, errNoDesiredState
+}
+
+func (cfg *Config) reconcileInterval() time.Duration {
+	if cfg == nil || cfg.ReconcileIntervalSeconds == 0 {
+		return defaultReconcileInterval
+	}
+	return time.Duration(cfg.ReconcileIntervalSeconds) * time.Second
+}
+
+// runReconcile runs a reconciliation pass every reconcile interval while a desired state is configured,
+// until ctx is done
+func (b *RobotUpdateModule) runReconcile(ctx context.Context) {
+	for {
+		b.mu.Lock()
+		interval := b.cfg.reconcileInterval()
+		b.mu.Unlock()
+		if err := sleepContext(ctx, interval); err != nil {
+			return
+		}
+		b.mu.Lock()
+		configured := b.cfg != nil && (b.cfg.DesiredState != nil || b.cfg.DesiredStateFile != "")
+		b.mu.Unlock()
+		if configured {
+			b.reconcile(ctx, false, false)
+		}
+	}
+}
+
+// reconcileCommand handles the reconcile command, a pass run now. dry_run reports drift without
+// changing the part config. Like the other disruptive commands the maintenance window and interlocks
+// were checked by doCommand, maintenance_policy force applies it outside of maintenance windows.
+func (b *RobotUpdateModule) reconcileCommand(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	dryRun, _ := cmd["dry_run"].(bool)
+	result := b.reconcile(ctx, dryRun, true)
+	return result.toMap(), result.err
+}
+
+// reconcile compares the part config to the desired state and converges it, recording the result. gated
+// is set when the maintenance window and interlocks were already checked.
+func (b *RobotUpdateModule) reconcile(ctx context.Context, dryRun, gated bool) *reconcileResult {
+	b.reconcileMu.Lock()
+	defer b.reconcileMu.Unlock()
+	b.mu.Lock()
+	cfg := b.cfg
+	b.mu.Unlock()
+
+	result := &reconcileResult{at: time.Now(), dryRun: dryRun || (cfg != nil && cfg.ReconcileDryRun)}
+	defer b.recordReconcile(result)
+	desired, err := cfg.desiredState()
+	if err != nil {
+		result.err = err
+		b.logger.Warnf("Error reading desired state: %v", err)
+		return result
+	}
+	client, partId, err := b.partClient(ctx, "reconcile", map[string]interface{}{})
+	if err != nil {
+		result.err = err
+		b.logger.Warnf("Error getting client to reconcile: %v", err)
+		return result
+	}
+	result.partId = partId
+	b.reconcilePart(ctx, client, desired, result, gated)
+	return result
+}
+
+// partClient returns an app client using the command's credentials and the id of the part this module
+// runs on, for the commands that act on their own part
+func (b *RobotUpdateModule) partClient(ctx context.Context, command string, cmd map[string]interface{}) (app_proto.AppServiceClient, string, error) {
+	b.publishStep(command, "getting credentials")
+	creds, err := b.getCredentials(cmd)
+	if err != nil {
+		return nil, "", err
+	}
+	auditCredentials(ctx, creds)
+	b.publishStep(command, "dialing app")
+	client, err := b.GetClient(ctx, creds)
+	if err = stepError(ctx, "dialing app", err); err != nil {
+		return nil, "", err
+	}
+	partId, err := machinePartId()
+	if err != nil {
+		return nil, "", err
+	}
+	return client, partId, nil
+}
+
+// reconcilePart converges the part on the desired state. viam-server reconfigures when the part config
+// changes, so the write goes through the maintenance window, interlocks and hooks like the other
+// disruptive commands.
+func (b *RobotUpdateModule) reconcilePart(ctx context.Context, client app_proto.AppServiceClient, desired *DesiredState, result *reconcileResult, gated bool) {
+	b.publishStep("reconcile", "getting robot part")
+	resp, err := client.GetRobotPart(ctx, &app_proto.GetRobotPartRequest{Id: result.partId})
+	if result.err = stepError(ctx, "getting robot part", err); result.err != nil {
+		b.logger.Errorf("Error getting robot part: %v", result.err)
+		return
+	}
+	part := resp.GetPart()
+	conf := part.GetRobotConfig()
+	if conf == nil {
+		conf = &structpb.Struct{}
+	}
+	result.drift = applyDesiredState(conf, desired)
+	if len(result.drift) == 0 {
+		b.logger.Debug("Part config matches the desired state")
+		return
+	}
+	var changes []string
+	for _, d := range result.drift {
+		if d.err == nil {
+			changes = append(changes, fmt.Sprintf("%s %s %s", d.action, d.kind, d.name))
+		} else {
+			b.logger.Warnf("Can't converge %s %s: %v", d.kind, d.name, d.err)
+		}
+	}
+	if len(changes) == 0 || result.dryRun {
+		return
+	}
+	b.logger.Warnf("Part config drifted from the desired state: %s", strings.Join(changes, ", "))
+	if !gated && !b.gateReconcile(ctx, result) {
+		return
+	}
+
+	robotId, err := machineId()
+	if err != nil {
+		result.err = err
+		return
+	}
+	op := operation{Command: "reconcile", Params: map[string]string{"part_id": result.partId, "actions": strings.Join(changes, ", ")}}
+	b.publishStep("reconcile", "running pre hooks")
+	if result.err = stepError(ctx, "running pre hooks", b.runHooks(ctx, hookStagePre, op, nil)); result.err != nil {
+		return
+	}
+	b.publishStep("reconcile", "updating robot part")
+	// the part is converged as it is now, it may have changed since the drift was detected
+	err = responseError(b.updatePartConfig(ctx, client, robotId, func(part *app_proto.RobotPart) (*structpb.Struct, error) {
+		applyDesiredState(part.RobotConfig, desired)
+		return part.RobotConfig, nil
+	}))
+	b.publishStep("reconcile", "running post hooks")
+	if hookErr := stepError(ctx, "running post hooks", b.runHooks(ctx, hookStagePost, op, err)); hookErr != nil && err == nil {
+		b.logger.Warnf("Post hook failed after reconciling: %v", hookErr)
+	}
+	if result.err = err; err != nil {
+		b.logger.Errorf("Error updating robot part: %v", err)
+		return
+	}
+	result.applied = true
+	b.logger.Infof("Reconciled part config: %s", strings.Join(changes, ", "))
+	b.events.publish(eventReconciled, map[string]string{"part_id": result.partId, "actions": strings.Join(changes, ", ")}, nil)
+}
+
+// gateReconcile holds a background pass to the maintenance policy and interlocks of the reconcile
+// command. A pass outside of a window is deferred rather than queued, the next pass comes around on its own.
+func (b *RobotUpdateModule) gateReconcile(ctx context.Context, result *reconcileResult) bool {
+	b.mu.Lock()
+	policy := b.cfg.maintenancePolicy()
+	b.mu.Unlock()
+	cmd := map[string]interface{}{}
+	if policy == maintenancePolicyQueue {
+		cmd["maintenance_policy"] = maintenancePolicyRefuse
+	}
+	if resp, handled, err := b.gateMaintenance("reconcile", cmd); handled {
+		result.deferred = true
+		if next, ok := resp["next_window"].(string); ok {
+			result.deferredUntil, _ = time.Parse(time.RFC3339, next)
+		}
+		b.logger.Infof("Deferring reconciliation: %v", err)
+		return false
+	}
+	if _, err := b.gateInterlocks(ctx, "reconcile", cmd); err != nil {
+		result.deferred = true
+		result.err = err
+		return false
+	}
+	return true
+}
+
+func (b *RobotUpdateModule) recordReconcile(result *reconcileResult) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastReconcile = result
+}
@@ -0,0 +1,153 @@
+package update_module
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.viam.com/rdk/components/base"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+	"google.golang.org/grpc/connectivity"
+)
+
+// maintenanceWindowLater returns a window that starts in two hours, so now is outside of it
+func maintenanceWindowLater() MaintenanceWindow {
+	now := time.Now().UTC()
+	return MaintenanceWindow{Start: now.Add(2 * time.Hour).Format("15:04"), End: now.Add(3 * time.Hour).Format("15:04")}
+}
+
+// usePartClient makes robot-main the module's own part, reached through client with the credentials of
+// partTestConfig
+func usePartClient(t *testing.T, module *RobotUpdateModule, client *fakeFleetClient) {
+	origMachine, origPart := machineId, machinePartId
+	t.Cleanup(func() { machineId, machinePartId = origMachine, origPart })
+	machineId = func() (string, error) { return "robot", nil }
+	machinePartId = func() (string, error) { return "robot-main", nil }
+	module.clients.appClient = client
+	module.clients.appCreds = *apiKeyCredentials("key-name", "key", credentialSourceConfig)
+	module.clients.appConn = &fakeClientConn{state: connectivity.Ready}
+}
+
+func partTestConfig() *Config {
+	return &Config{ApiKeyName: "key-name", ApiKey: "key", CredentialSources: []string{credentialSourceConfig}}
+}
+
+func TestReconcilePart(t *testing.T) {
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	ctx := context.Background()
+	defer func(id func() (string, error)) { machineId = id }(machineId)
+	machineId = func() (string, error) { return "robot", nil }
+	desired := &DesiredState{Fragments: []DesiredFragment{{ID: "new"}}}
+
+	// a dry run reports the drift without changing the part
+	client := newFakeFleetClient()
+	client.addMachine(t, "loc", "robot", "old")
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: ctx}
+	result := &reconcileResult{partId: "robot-main", dryRun: true}
+	module.reconcilePart(ctx, client, desired, result, false)
+	require.NoError(t, result.err)
+	assert.Len(t, result.drift, 2)
+	assert.False(t, result.applied)
+	assert.Empty(t, client.updated)
+
+	// a background pass outside of a maintenance window is deferred, also with the queue policy
+	module.cfg = &Config{MaintenanceWindows: []MaintenanceWindow{maintenanceWindowLater()}, MaintenancePolicy: maintenancePolicyQueue}
+	result = &reconcileResult{partId: "robot-main"}
+	module.reconcilePart(ctx, client, desired, result, false)
+	require.NoError(t, result.err)
+	assert.True(t, result.deferred)
+	assert.False(t, result.deferredUntil.IsZero())
+	assert.Empty(t, client.updated)
+	assert.Empty(t, module.maintenanceStatus()["queued"])
+
+	// or while an interlocked resource is moving
+	actuator := &fakeActuator{Named: base.Named("base1").AsNamed(), moving: true}
+	module.cfg = &Config{}
+	module.interlocks, _ = interlocksFromDependencies(resource.Dependencies{base.Named("base1"): actuator}, []string{"base1"})
+	result = &reconcileResult{partId: "robot-main"}
+	module.reconcilePart(ctx, client, desired, result, false)
+	assert.ErrorIs(t, result.err, errInterlockMoving)
+	assert.True(t, result.deferred)
+	assert.Empty(t, client.updated)
+
+	// the write runs the hooks of the reconcile command
+	actuator.moving = false
+	out := filepath.Join(t.TempDir(), "hooks.log")
+	module.cfg = &Config{Hooks: []Hook{
+		{Stage: hookStagePre, Commands: []string{"reconcile"}, Shell: `echo "pre $VIAM_UPDATE_OPERATION" >> ` + out},
+		{Stage: hookStagePost, Shell: `echo "post $VIAM_UPDATE_RESULT" >> ` + out},
+	}}
+	result = &reconcileResult{partId: "robot-main"}
+	module.reconcilePart(ctx, client, desired, result, false)
+	require.NoError(t, result.err)
+	assert.True(t, result.applied)
+	assert.Equal(t, []string{"new"}, client.fragments("robot-main"))
+	log, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "pre reconcile\npost success\n", string(log))
+	events, _, _ := module.events.since(0)
+	require.NotEmpty(t, events)
+	assert.Equal(t, eventReconciled, events[len(events)-1].Type)
+	assert.Equal(t, "remove fragment old, add fragment new", events[len(events)-1].Params["actions"])
+
+	// a converged part isn't written
+	result = &reconcileResult{partId: "robot-main"}
+	module.reconcilePart(ctx, client, desired, result, true)
+	require.NoError(t, result.err)
+	assert.Empty(t, result.drift)
+	assert.Len(t, client.updated, 1)
+	assert.Equal(t, true, result.toMap()["in_sync"])
+}
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeFleetClient()
+	client.addMachine(t, "loc", "robot", "old")
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: ctx}
+	usePartClient(t, &module, client)
+	resp, err := module.doCommand(ctx, map[string]interface{}{"command": "reconcile"})
+	assert.ErrorIs(t, err, errNoDesiredState)
+	assert.Contains(t, resp["error"], errNoDesiredState.Error())
+
+	module.cfg = partTestConfig()
+	module.cfg.DesiredState = &DesiredState{Fragments: []DesiredFragment{{ID: "new", Version: "2"}}}
+
+	resp, err = module.doCommand(ctx, map[string]interface{}{"command": "reconcile", "dry_run": true})
+	require.NoError(t, err)
+	assert.Equal(t, 1, resp["ok"])
+	assert.Equal(t, false, resp["in_sync"])
+	assert.Equal(t, "robot-main", resp["part_id"])
+	assert.Len(t, resp["drift"], 2)
+	assert.Equal(t, []string{"old"}, client.fragments("robot-main"))
+
+	// the command is gated like the other disruptive commands, a dry run isn't
+	module.cfg.MaintenanceWindows = []MaintenanceWindow{maintenanceWindowLater()}
+	_, err = module.doCommand(ctx, map[string]interface{}{"command": "reconcile"})
+	assert.ErrorIs(t, err, errOutsideMaintenanceWindow)
+	_, err = module.doCommand(ctx, map[string]interface{}{"command": "reconcile", "dry_run": true})
+	require.NoError(t, err)
+	assert.Empty(t, client.updated)
+
+	resp, err = module.doCommand(ctx, map[string]interface{}{"command": "reconcile", "maintenance_policy": "force"})
+	require.NoError(t, err)
+	assert.Equal(t, true, resp["applied"])
+	assert.Equal(t, []string{"robot-main"}, client.updated)
+	assert.Equal(t, true, module.lastReconcile.applied)
+}
+
+func TestReconcileConfig(t *testing.T) {
+	_, err := (&Config{ReconcileIntervalSeconds: -1}).Validate("path")
+	assert.Error(t, err)
+	assert.Equal(t, defaultReconcileInterval, (*Config)(nil).reconcileInterval())
+	assert.Equal(t, time.Minute, (&Config{ReconcileIntervalSeconds: 60}).reconcileInterval())
+
+	_, err = (*Config)(nil).desiredState()
+	assert.ErrorIs(t, err, errNoDesiredState)
+	_, err = (&Config{DesiredStateFile: "/does/not/exist.json"}).desiredState()
+	assert.Error(t, err)
+}
@@ -0,0 +1,210 @@
+package update_module
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const defaultRestartDelay = 5 * time.Second
+
+var (
+	errInvalidRestartTime = errors.New("invalid restart time")
+	errNoPendingRestart   = errors.New("no pending restart")
+)
+
+// pendingRestart is a restart that has been scheduled but has not fired yet
+type pendingRestart struct {
+	at    time.Time
+	op    operation
+	timer *time.Timer
+	// checks run when the timer fires, any error refuses the restart
+	checks []func() error
+}
+
+// restartResult records the outcome of the most recent scheduled restart
+type restartResult struct {
+	at  time.Time
+	err error
+}
+
+// restart handles the restart command. The restart is deferred by delay_seconds (or until the RFC3339
+// time in at) so the response is delivered before viam-agent tears down the connection. A delay of 0
+// restarts synchronously and surfaces any error in the response, an at in the past is refused.
+func (b *RobotUpdateModule) restart(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	at, err := b.restartTimeFromRequest(cmd)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+
+	if !at.After(time.Now()) {
+		if err := b.restartViamServer(ctx, operation{Command: "restart"}); err != nil {
+			b.logger.Errorf("Error restarting viam-server: %v", err)
+			return map[string]interface{}{"error": err.Error()}, err
+		}
+		b.logger.Info("viam-server restarted")
+		return map[string]interface{}{"ok": 1}, nil
+	}
+
+	p := b.scheduleRestart(at, operation{Command: "restart"}, b.windowCheck(cmd))
+	return map[string]interface{}{"ok": 1, "restart_at": p.at.Format(time.RFC3339)}, nil
+}
+
+// restartTimeFromRequest reads at or delay_seconds from the command, falling back to the configured delay
+func (b *RobotUpdateModule) restartTimeFromRequest(cmd map[string]interface{}) (time.Time, error) {
+	if v, ok := cmd["at"]; ok {
+		s, ok := v.(string)
+		if !ok {
+			return time.Time{}, fmt.Errorf("%w: at must be an RFC3339 string", errInvalidRestartTime)
+		}
+		at, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%w: %v", errInvalidRestartTime, err)
+		}
+		if !at.After(time.Now()) {
+			return time.Time{}, fmt.Errorf("%w: at %s is in the past", errInvalidRestartTime, s)
+		}
+		return at, nil
+	}
+
+	b.mu.Lock()
+	delay := b.cfg.restartDelay()
+	b.mu.Unlock()
+	if _, ok := cmd["delay_seconds"]; ok {
+		d, err := secondsFromRequest(cmd, "delay_seconds")
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%w: %v", errInvalidRestartTime, err)
+		}
+		delay = d
+	}
+	return time.Now().Add(delay), nil
+}
+
+// scheduleRestart schedules a restart of viam-server at the given time, replacing any pending restart.
+// The checks run when it fires, nil checks are skipped.
+func (b *RobotUpdateModule) scheduleRestart(at time.Time, op operation, checks ...func() error) pendingRestart {
+	b.mu.Lock()
+	if b.pendingRestart != nil {
+		b.pendingRestart.timer.Stop()
+		b.logger.Infof("Replacing restart scheduled for %v", b.pendingRestart.at)
+	}
+
+	p := &pendingRestart{at: at, op: op}
+	for _, check := range checks {
+		if check != nil {
+			p.checks = append(p.checks, check)
+		}
+	}
+	p.timer = time.AfterFunc(time.Until(at), func() { b.runPendingRestart(p) })
+	b.pendingRestart = p
+	b.logger.Infof("Scheduled %s restart for %v", op.Command, at)
+	scheduled := *p
+	b.mu.Unlock()
+
+	params := op.eventParams()
+	params["restart_at"] = at.Format(time.RFC3339)
+	b.notify(eventRestartScheduled, params, nil)
+	return scheduled
+}
+
+func (b *RobotUpdateModule) runPendingRestart(p *pendingRestart) {
+	b.mu.Lock()
+	if b.pendingRestart != p {
+		// cancelled or superseded after the timer fired
+		b.mu.Unlock()
+		return
+	}
+	b.pendingRestart = nil
+	ctx := b.ctx
+	b.mu.Unlock()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	b.events.publish(eventJobStarted, p.op.eventParams(), nil)
+	err := p.check()
+	if err != nil {
+		b.notify(eventRestartFailed, p.op.eventParams(), err)
+	} else {
+		err = b.restartViamServer(ctx, p.op)
+	}
+	if err != nil {
+		b.logger.Errorf("Error running scheduled restart: %v", err)
+	} else {
+		b.logger.Info("Scheduled restart completed")
+	}
+
+	b.mu.Lock()
+	b.lastRestart = &restartResult{at: time.Now(), err: err}
+	b.mu.Unlock()
+}
+
+// check runs the checks of the restart, stopping at the first that refuses it
+func (p *pendingRestart) check() error {
+	for _, check := range p.checks {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cancelRestart cancels the pending restart, returning errNoPendingRestart if there is none
+func (b *RobotUpdateModule) cancelRestart() (pendingRestart, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.pendingRestart == nil {
+		return pendingRestart{}, errNoPendingRestart
+	}
+	p := *b.pendingRestart
+	b.pendingRestart.timer.Stop()
+	b.pendingRestart = nil
+	b.logger.Infof("Cancelled restart scheduled for %v", p.at)
+	params := p.op.eventParams()
+	params["restart_at"] = p.at.Format(time.RFC3339)
+	b.events.publish(eventJobCancelled, params, nil)
+	return p, nil
+}
+
+// restartStatus reports the pending restart, if any, and the result of the last scheduled restart
+func (b *RobotUpdateModule) restartStatus() map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	resp := map[string]interface{}{"pending": b.pendingRestart != nil}
+	if b.pendingRestart != nil {
+		resp["restart_at"] = b.pendingRestart.at.Format(time.RFC3339)
+		resp["operation"] = b.pendingRestart.op.Command
+	}
+	if b.lastRestart != nil {
+		resp["last_restart_at"] = b.lastRestart.at.Format(time.RFC3339)
+		if b.lastRestart.err != nil {
+			resp["last_restart_error"] = b.lastRestart.err.Error()
+		}
+	}
+	return resp
+}
+
+// secondsFromRequest reads a non-negative number of seconds, DoCommand numbers arrive as float64
+func secondsFromRequest(cmd map[string]interface{}, key string) (time.Duration, error) {
+	var seconds float64
+	switch v := cmd[key].(type) {
+	case float64:
+		seconds = v
+	case int:
+		seconds = float64(v)
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s must be a number", key)
+		}
+		seconds = f
+	default:
+		return 0, fmt.Errorf("%s must be a number", key)
+	}
+	if seconds < 0 {
+		return 0, fmt.Errorf("%s must not be negative", key)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
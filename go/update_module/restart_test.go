@@ -0,0 +1,65 @@
+package update_module
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.viam.com/rdk/logging"
+)
+
+func TestScheduledRestart(t *testing.T) {
+	logger := logging.NewTestLogger(t)
+	ctx := context.Background()
+	manager := &fakeServiceManager{}
+	module := RobotUpdateModule{logger: logger, ctx: ctx, serviceManager: manager}
+
+	resp, err := module.DoCommand(ctx, map[string]interface{}{"command": "restart", "delay_seconds": 0.1})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, resp["ok"])
+	assert.Contains(t, resp, "restart_at")
+	assert.Equal(t, 0, manager.restartCount())
+
+	status, err := module.DoCommand(ctx, map[string]interface{}{"command": "pending_restart"})
+	assert.NoError(t, err)
+	assert.Equal(t, true, status["pending"])
+	assert.Equal(t, "restart", status["operation"])
+
+	assert.Eventually(t, func() bool { return manager.restartCount() == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		status, _ := module.DoCommand(ctx, map[string]interface{}{"command": "pending_restart"})
+		return status["pending"] == false && status["last_restart_at"] != nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestCancelRestart(t *testing.T) {
+	logger := logging.NewTestLogger(t)
+	ctx := context.Background()
+	manager := &fakeServiceManager{}
+	module := RobotUpdateModule{logger: logger, ctx: ctx, serviceManager: manager}
+
+	_, err := module.DoCommand(ctx, map[string]interface{}{"command": "cancel_restart"})
+	testForExpectedError(t, err, errNoPendingRestart)
+
+	at := time.Now().Add(time.Hour).Truncate(time.Second)
+	resp, err := module.DoCommand(ctx, map[string]interface{}{"command": "restart", "at": at.Format(time.RFC3339)})
+	assert.NoError(t, err)
+	assert.Equal(t, at.Format(time.RFC3339), resp["restart_at"])
+
+	resp, err = module.DoCommand(ctx, map[string]interface{}{"command": "cancel_restart"})
+	assert.NoError(t, err)
+	assert.Equal(t, at.Format(time.RFC3339), resp["cancelled_restart_at"])
+
+	status := module.restartStatus()
+	assert.Equal(t, false, status["pending"])
+	assert.Equal(t, 0, manager.restartCount())
+
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "restart", "at": "tomorrow"})
+	assert.ErrorIs(t, err, errInvalidRestartTime)
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "restart", "at": time.Now().Add(-time.Minute).Format(time.RFC3339)})
+	assert.ErrorIs(t, err, errInvalidRestartTime)
+	assert.Equal(t, 0, manager.restartCount())
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "restart", "delay_seconds": -1})
+	assert.ErrorIs(t, err, errInvalidRestartTime)
+}
@@ -0,0 +1,460 @@
+package update_module
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	app_proto "go.viam.com/api/app/v1"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	defaultRolloutBatchSize = 10
+	// rolloutRollbackTimeout bounds rolling back a halted rollout, which outlives the command's context
+	rolloutRollbackTimeout = 5 * time.Minute
+
+	rolloutUpdated = "updated"
+	rolloutFailed  = "failed"
+	// rolloutSkipped machines stopped using the old fragment between listing and their batch
+	rolloutSkipped = "skipped"
+	// rolloutPlanned machines would be updated, reported by dry runs
+	rolloutPlanned = "planned"
+	// rolloutHalted machines were not updated as a health gate failed in an earlier stage
+	rolloutHalted         = "halted"
+	rolloutRolledBack     = "rolled_back"
+	rolloutRollbackFailed = "rollback_failed"
+)
+
+var (
+	errRolloutScopeMissing = errors.New("location_id or organization_id required")
+	errInvalidRollout      = errors.New("invalid rollout")
+	errMachinesFailed      = errors.New("machines failed")
+)
+
+// rolloutRequest swaps oldFragmentId for newFragmentId on every machine in the location or organization
+// that uses it
+type rolloutRequest struct {
+	oldFragmentId  string
+	newFragmentId  string
+	locationId     string
+	organizationId string
+	batchSize      int
+	batchDelay     time.Duration
+	dryRun         bool
+	stages         []rolloutStage
+	// health gates the stages, without it machines are updated regardless of how earlier ones fared
+	health *healthGate
+	creds  *credentials
+}
+
+// rolloutMachine is the outcome of a rollout on one machine
+type rolloutMachine struct {
+	robot     *app_proto.Robot
+	parts     []string
+	status    string
+	err       error
+	updatedAt time.Time
+	// address is the main part's FQDN, dialed to check resource status
+	address   string
+	healthErr error
+}
+
+func (m *rolloutMachine) toMap() map[string]interface{} {
+	parts := make([]interface{}, 0, len(m.parts))
+	for _, p := range m.parts {
+		parts = append(parts, p)
+	}
+	r := map[string]interface{}{
+		"robot_id":    m.robot.Id,
+		"robot_name":  m.robot.Name,
+		"location_id": m.robot.Location,
+		"parts":       parts,
+		"status":      m.status,
+	}
+	if m.robot.LastAccess != nil {
+		r["last_access"] = m.robot.LastAccess.AsTime().Format(time.RFC3339)
+	}
+	if m.err != nil {
+		r["error"] = m.err.Error()
+	}
+	if m.healthErr != nil {
+		r["health_error"] = m.healthErr.Error()
+	}
+	return r
+}
+
+func rolloutRequestFromCommand(cmd map[string]interface{}) (*rolloutRequest, error) {
+	r := &rolloutRequest{batchSize: defaultRolloutBatchSize}
+	r.oldFragmentId, _ = cmd["oldFragmentId"].(string)
+	if r.oldFragmentId == "" {
+		return nil, errOldFragmentIdMissing
+	}
+	r.newFragmentId, _ = cmd["newFragmentId"].(string)
+	if r.newFragmentId == "" {
+		return nil, errNewFragmentIdMissing
+	}
+	r.locationId, _ = cmd["location_id"].(string)
+	r.organizationId, _ = cmd["organization_id"].(string)
+	if r.locationId == "" && r.organizationId == "" {
+		return nil, errRolloutScopeMissing
+	}
+	if _, ok := cmd["batch_size"]; ok {
+		n, err := intFromRequest(cmd, "batch_size")
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("%w: batch_size must be a positive whole number", errInvalidRollout)
+		}
+		r.batchSize = n
+	}
+	if _, ok := cmd["batch_delay_seconds"]; ok {
+		d, err := secondsFromRequest(cmd, "batch_delay_seconds")
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidRollout, err)
+		}
+		r.batchDelay = d
+	}
+	r.dryRun, _ = cmd["dry_run"].(bool)
+	var err error
+	if r.stages, err = stagesFromRequest(cmd); err != nil {
+		return nil, err
+	}
+	if r.health, err = healthGateFromRequest(cmd); err != nil {
+		return nil, err
+	}
+	if len(r.stages) > 0 && r.health == nil {
+		r.health = &healthGate{maxLastAccess: defaultMaxLastAccess}
+	}
+	return r, nil
+}
+
+// rollout handles the rollout command, the fleet counterpart of update. Rather than the machine the
+// module runs on, it changes every machine in a location or organization using oldFragmentId.
+func (b *RobotUpdateModule) rollout(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	req, err := rolloutRequestFromCommand(cmd)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	creds, err := b.getCredentials(cmd)
+	if err != nil {
+		b.logger.Errorf("Error getting api credentials: %v", err)
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	auditCredentials(ctx, creds)
+	req.creds = creds
+	b.publishStep("rollout", "dialing app")
+	client, err := b.GetClient(ctx, creds)
+	if err = stepError(ctx, "dialing app", err); err != nil {
+		b.logger.Errorf("Error getting client: %v", err)
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	return b.runRollout(ctx, client, req)
+}
+
+// runRollout finds the machines using the old fragment, then updates them stage by stage, a batch at a
+// time. Machines in a batch are updated concurrently. With a health gate, each stage soaks and is checked
+// before the next starts, a failure or the command being cancelled halts the rollout and rolls back every
+// machine it updated.
+func (b *RobotUpdateModule) runRollout(ctx context.Context, client app_proto.AppServiceClient, req *rolloutRequest) (map[string]interface{}, error) {
+	b.publishStep("rollout", "listing machines")
+	robots, err := listFleetRobots(ctx, client, req.locationId, req.organizationId)
+	if err != nil {
+		b.logger.Errorf("Error listing machines: %v", err)
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	b.publishStep("rollout", "finding machines using the old fragment")
+	var machines []*rolloutMachine
+	for _, robot := range robots {
+		parts, err := client.GetRobotParts(ctx, &app_proto.GetRobotPartsRequest{RobotId: robot.Id})
+		if err = stepError(ctx, "getting robot parts", err); err != nil {
+			if ctx.Err() != nil {
+				return map[string]interface{}{"error": err.Error()}, err
+			}
+			b.logger.Warnf("Error getting parts of %s: %v", robot.Name, err)
+			machines = append(machines, &rolloutMachine{robot: robot, status: rolloutFailed, err: err})
+			continue
+		}
+		if ids := partsUsingFragment(parts.GetParts(), req.oldFragmentId); len(ids) > 0 {
+			machines = append(machines, &rolloutMachine{robot: robot, parts: ids, status: rolloutPlanned})
+		}
+	}
+	b.logger.Infof("Rollout of %s found %d of %d machines using %s", req.newFragmentId, len(machines), len(robots), req.oldFragmentId)
+
+	var pending []*rolloutMachine
+	for _, m := range machines {
+		if m.status == rolloutPlanned {
+			pending = append(pending, m)
+		}
+	}
+	run := &rolloutRun{req: req, total: len(robots), machines: machines, plans: planStages(req.stages, len(pending))}
+	for i, plan := range run.plans {
+		run.batches += (plan.end - run.stageStart(i) + req.batchSize - 1) / req.batchSize
+	}
+	if req.dryRun {
+		return run.report(), run.err()
+	}
+
+	for i, plan := range run.plans {
+		if ctx.Err() != nil {
+			break
+		}
+		b.publishStep("rollout", fmt.Sprintf("starting stage %d of %d", i+1, len(run.plans)))
+		b.updateBatches(ctx, client, req, pending[run.stageStart(i):plan.end])
+		run.stagesRun = i + 1
+		if req.health == nil {
+			continue
+		}
+		if err := b.checkHealth(ctx, client, req, pending[:plan.end], plan.soak); err != nil {
+			run.haltErr = err
+			break
+		}
+	}
+	// a staged rollout cancelled partway, during a soak most likely, is rolled back like one that failed a
+	// health gate, as the caller may never get the report to act on
+	if req.health != nil && run.haltErr == nil && run.stagesRun > 0 && ctx.Err() != nil {
+		run.haltErr = stepError(ctx, "rolling out", ctx.Err())
+	}
+	if run.haltErr != nil {
+		b.haltRollout(ctx, client, run, pending)
+	}
+	for _, m := range pending {
+		if m.status == rolloutPlanned {
+			m.status = rolloutFailed
+			m.err = stepError(ctx, "waiting for its batch", errors.New("not updated"))
+		}
+	}
+	return run.report(), run.err()
+}
+
+// haltRollout stops the rollout after the stage it is in and rolls back every machine it updated. The
+// rollback runs within rolloutRollbackTimeout even if ctx is done.
+func (b *RobotUpdateModule) haltRollout(ctx context.Context, client app_proto.AppServiceClient, run *rolloutRun, pending []*rolloutMachine) {
+	req, end := run.req, run.plans[run.stagesRun-1].end
+	b.logger.Errorf("Halting rollout of %s at stage %d: %v", req.newFragmentId, run.stagesRun, run.haltErr)
+	for _, m := range pending[end:] {
+		m.status = rolloutHalted
+	}
+	rollbackCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rolloutRollbackTimeout)
+	defer cancel()
+	run.rolledBack = b.rollbackRollout(rollbackCtx, client, req, pending[:end])
+	b.notify(eventUpdateRolledBack, map[string]string{
+		"old_fragment_id": req.oldFragmentId,
+		"new_fragment_id": req.newFragmentId,
+		"stage":           fmt.Sprint(run.stagesRun),
+		"machines":        fmt.Sprint(run.rolledBack),
+	}, run.haltErr)
+}
+
+// updateBatches updates the machines batch by batch, waiting batchDelay between batches
+func (b *RobotUpdateModule) updateBatches(ctx context.Context, client app_proto.AppServiceClient, req *rolloutRequest, machines []*rolloutMachine) {
+	for start := 0; start < len(machines); start += req.batchSize {
+		if start > 0 && req.batchDelay > 0 {
+			if err := sleepContext(ctx, req.batchDelay); err != nil {
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		batch := machines[start:min(start+req.batchSize, len(machines))]
+		b.publishStep("rollout", fmt.Sprintf("updating %d machines", len(batch)))
+		var wg sync.WaitGroup
+		for _, m := range batch {
+			wg.Add(1)
+			go func(m *rolloutMachine) {
+				defer wg.Done()
+				b.updateRolloutMachine(ctx, client, m, req.oldFragmentId, req.newFragmentId)
+			}(m)
+		}
+		wg.Wait()
+	}
+}
+
+// updateRolloutMachine swaps the fragment on the machine, recording the outcome
+func (b *RobotUpdateModule) updateRolloutMachine(ctx context.Context, client app_proto.AppServiceClient, m *rolloutMachine, oldFragmentId, newFragmentId string) {
+	parts, address, err := b.swapMachineFragment(ctx, client, m.robot, oldFragmentId, newFragmentId)
+	m.parts, m.address, m.updatedAt = parts, address, time.Now()
+	switch {
+	case err != nil:
+		b.logger.Errorf("Error updating %s: %v", m.robot.Name, err)
+		m.status, m.err = rolloutFailed, err
+	case len(parts) == 0:
+		m.status = rolloutSkipped
+	default:
+		m.status = rolloutUpdated
+	}
+}
+
+// swapMachineFragment swaps the fragment in each part of the machine that uses it, returning the parts
+// updated and the main part's FQDN. The parts are fetched again so changes made since the machine was
+// listed aren't overwritten.
+func (b *RobotUpdateModule) swapMachineFragment(ctx context.Context, client app_proto.AppServiceClient, robot *app_proto.Robot, oldFragmentId, newFragmentId string) ([]string, string, error) {
+	resp, err := client.GetRobotParts(ctx, &app_proto.GetRobotPartsRequest{RobotId: robot.Id})
+	if err = stepError(ctx, "getting robot parts", err); err != nil {
+		return nil, "", err
+	}
+	var updated []string
+	var address string
+	for _, part := range resp.GetParts() {
+		if part.MainPart {
+			address = part.Fqdn
+		}
+		if !usesFragment(part.RobotConfig, oldFragmentId) {
+			continue
+		}
+		if err := swapFragmentId(oldFragmentId, newFragmentId, part.RobotConfig, b.logger); err != nil {
+			return updated, address, err
+		}
+		start := time.Now()
+		_, err := client.UpdateRobotPart(ctx, &app_proto.UpdateRobotPartRequest{Id: part.Id, Name: part.Name, RobotConfig: part.RobotConfig})
+		b.metrics.observe(metricUpdateRobotPart, time.Since(start))
+		if err = stepError(ctx, "updating robot part", err); err != nil {
+			return updated, address, fmt.Errorf("part %s: %w", part.Name, err)
+		}
+		updated = append(updated, part.Id)
+	}
+	return updated, address, nil
+}
+
+// listFleetRobots returns the machines in the location, or in every location of the organization
+func listFleetRobots(ctx context.Context, client app_proto.AppServiceClient, locationId, organizationId string) ([]*app_proto.Robot, error) {
+	locations := []string{locationId}
+	if locationId == "" {
+		resp, err := client.ListLocations(ctx, &app_proto.ListLocationsRequest{OrganizationId: organizationId})
+		if err = stepError(ctx, "listing locations", err); err != nil {
+			return nil, err
+		}
+		locations = nil
+		for _, l := range resp.GetLocations() {
+			locations = append(locations, l.Id)
+		}
+	}
+	var robots []*app_proto.Robot
+	seen := map[string]bool{}
+	for _, l := range locations {
+		resp, err := client.ListRobots(ctx, &app_proto.ListRobotsRequest{LocationId: l})
+		if err = stepError(ctx, "listing robots", err); err != nil {
+			return nil, fmt.Errorf("location %s: %w", l, err)
+		}
+		// locations shared with the organization can list the same machine twice
+		for _, r := range resp.GetRobots() {
+			if !seen[r.Id] {
+				seen[r.Id] = true
+				robots = append(robots, r)
+			}
+		}
+	}
+	return robots, nil
+}
+
+func partsUsingFragment(parts []*app_proto.RobotPart, id string) []string {
+	var ids []string
+	for _, part := range parts {
+		if usesFragment(part.RobotConfig, id) {
+			ids = append(ids, part.Id)
+		}
+	}
+	return ids
+}
+
+func usesFragment(conf *structpb.Struct, id string) bool {
+	for _, v := range conf.GetFields()["fragments"].GetListValue().GetValues() {
+		if fragmentId(v) == id {
+			return true
+		}
+	}
+	return false
+}
+
+// rolloutRun is the state of a rollout, aggregated into its report
+type rolloutRun struct {
+	req        *rolloutRequest
+	total      int
+	machines   []*rolloutMachine
+	plans      []stagePlan
+	batches    int
+	stagesRun  int
+	haltErr    error
+	rolledBack int
+}
+
+// stageStart is the index of the first machine in stage i
+func (r *rolloutRun) stageStart(i int) int {
+	if i == 0 {
+		return 0
+	}
+	return r.plans[i-1].end
+}
+
+// report aggregates the machine results, the command reports an error if the rollout halted or any
+// machine failed
+func (r *rolloutRun) report() map[string]interface{} {
+	counts := map[string]int{}
+	results := make([]interface{}, 0, len(r.machines))
+	for _, m := range r.machines {
+		counts[m.status]++
+		results = append(results, m.toMap())
+	}
+	stages := make([]interface{}, 0, len(r.plans))
+	for i, plan := range r.plans {
+		status := "pending"
+		switch {
+		case r.req.dryRun:
+			status = rolloutPlanned
+		case i+1 < r.stagesRun || (i+1 == r.stagesRun && r.haltErr == nil):
+			status = "completed"
+		case i+1 == r.stagesRun:
+			status = rolloutHalted
+		}
+		stages = append(stages, map[string]interface{}{
+			"stage":        i + 1,
+			"machines":     plan.end - r.stageStart(i),
+			"soak_seconds": plan.soak.Seconds(),
+			"status":       status,
+		})
+	}
+	report := map[string]interface{}{
+		"old_fragment_id": r.req.oldFragmentId,
+		"new_fragment_id": r.req.newFragmentId,
+		"dry_run":         r.req.dryRun,
+		"machines_total":  r.total,
+		"matched":         len(r.machines),
+		"batches":         r.batches,
+		"stages":          stages,
+		"updated":         counts[rolloutUpdated],
+		"failed":          counts[rolloutFailed],
+		"skipped":         counts[rolloutSkipped],
+		"halted":          counts[rolloutHalted],
+		"rolled_back":     r.rolledBack,
+		"machines":        results,
+	}
+	if r.req.locationId != "" {
+		report["location_id"] = r.req.locationId
+	} else {
+		report["organization_id"] = r.req.organizationId
+	}
+	if err := r.err(); err != nil {
+		report["error"] = err.Error()
+	} else {
+		report["ok"] = 1
+	}
+	return report
+}
+
+// err is why the rollout failed, returned with its report so the failure is recorded
+func (r *rolloutRun) err() error {
+	if r.haltErr != nil {
+		return fmt.Errorf("rollout halted at stage %d: %w", r.stagesRun, r.haltErr)
+	}
+	failed := 0
+	for _, m := range r.machines {
+		if m.status == rolloutFailed {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d %w", failed, len(r.machines), errMachinesFailed)
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package update_module
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	app_proto "go.viam.com/api/app/v1"
+	common "go.viam.com/api/common/v1"
+	"go.viam.com/rdk/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// fakeFleetClient serves the machines of an organization from memory, methods it doesn't implement panic
+type fakeFleetClient struct {
+	app_proto.AppServiceClient
+
+	mu        sync.Mutex
+	locations map[string][]*app_proto.Robot
+	parts     map[string][]*app_proto.RobotPart
+	// updateErrs fail UpdateRobotPart for the part ids
+	updateErrs map[string]error
+	updated    []string
+	// lastAccess and errorLogs are reported for the robot and part ids, machines default to just seen
+	lastAccess map[string]time.Time
+	errorLogs  map[string]int
+	// fragmentConfigs are the configs of the fragments by id, every location belongs to org
+	fragmentConfigs map[string]*structpb.Struct
+	// history records the parts before each UpdateRobotPart by part id, newest first
+	history map[string][]*app_proto.RobotPartHistoryEntry
+}
+
+func newFakeFleetClient() *fakeFleetClient {
+	return &fakeFleetClient{
+		locations:  map[string][]*app_proto.Robot{},
+		parts:      map[string][]*app_proto.RobotPart{},
+		updateErrs: map[string]error{},
+		lastAccess: map[string]time.Time{},
+		errorLogs:  map[string]int{},
+
+		fragmentConfigs: map[string]*structpb.Struct{},
+		history:         map[string][]*app_proto.RobotPartHistoryEntry{},
+	}
+}
+
+// addMachine adds a single part machine using the fragments
+func (f *fakeFleetClient) addMachine(t *testing.T, location, id string, fragments ...interface{}) {
+	conf, err := structpb.NewStruct(map[string]interface{}{"fragments": fragments})
+	require.NoError(t, err)
+	f.locations[location] = append(f.locations[location], &app_proto.Robot{Id: id, Name: id, Location: location})
+	f.parts[id] = []*app_proto.RobotPart{{Id: id + "-main", Name: id + "-main", Robot: id, RobotConfig: conf, MainPart: true, Fqdn: id + ".viam.cloud"}}
+}
+
+func (f *fakeFleetClient) fragments(partId string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, parts := range f.parts {
+		for _, p := range parts {
+			if p.Id == partId {
+				var ids []string
+				for _, v := range p.RobotConfig.Fields["fragments"].GetListValue().GetValues() {
+					ids = append(ids, v.GetStringValue())
+				}
+				return ids
+			}
+		}
+	}
+	return nil
+}
+
+func (f *fakeFleetClient) ListLocations(ctx context.Context, in *app_proto.ListLocationsRequest, opts ...grpc.CallOption) (*app_proto.ListLocationsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &app_proto.ListLocationsResponse{}
+	for id := range f.locations {
+		resp.Locations = append(resp.Locations, &app_proto.Location{Id: id})
+	}
+	return resp, nil
+}
+
+func (f *fakeFleetClient) ListRobots(ctx context.Context, in *app_proto.ListRobotsRequest, opts ...grpc.CallOption) (*app_proto.ListRobotsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &app_proto.ListRobotsResponse{Robots: f.locations[in.LocationId]}, nil
+}
+
+func (f *fakeFleetClient) GetRobot(ctx context.Context, in *app_proto.GetRobotRequest, opts ...grpc.CallOption) (*app_proto.GetRobotResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	seen, ok := f.lastAccess[in.Id]
+	if !ok {
+		seen = time.Now()
+	}
+	return &app_proto.GetRobotResponse{Robot: &app_proto.Robot{Id: in.Id, LastAccess: timestamppb.New(seen)}}, nil
+}
+
+func (f *fakeFleetClient) GetRobotPartLogs(ctx context.Context, in *app_proto.GetRobotPartLogsRequest, opts ...grpc.CallOption) (*app_proto.GetRobotPartLogsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &app_proto.GetRobotPartLogsResponse{}
+	for i := 0; i < f.errorLogs[in.Id]; i++ {
+		resp.Logs = append(resp.Logs, &common.LogEntry{Level: "error", Message: "boom"})
+	}
+	return resp, nil
+}
+
+func (f *fakeFleetClient) GetRobotPart(ctx context.Context, in *app_proto.GetRobotPartRequest, opts ...grpc.CallOption) (*app_proto.GetRobotPartResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, parts := range f.parts {
+		for _, p := range parts {
+			if p.Id == in.Id {
+				return &app_proto.GetRobotPartResponse{Part: proto.Clone(p).(*app_proto.RobotPart)}, nil
+			}
+		}
+	}
+	return nil, errors.New("part not found")
+}
+
+func (f *fakeFleetClient) GetRobotParts(ctx context.Context, in *app_proto.GetRobotPartsRequest, opts ...grpc.CallOption) (*app_proto.GetRobotPartsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &app_proto.GetRobotPartsResponse{}
+	for _, p := range f.parts[in.RobotId] {
+		resp.Parts = append(resp.Parts, proto.Clone(p).(*app_proto.RobotPart))
+	}
+	return resp, nil
+}
+
+func (f *fakeFleetClient) UpdateRobotPart(ctx context.Context, in *app_proto.UpdateRobotPartRequest, opts ...grpc.CallOption) (*app_proto.UpdateRobotPartResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.updateErrs[in.Id]; err != nil {
+		return nil, err
+	}
+	for _, parts := range f.parts {
+		for _, p := range parts {
+			if p.Id == in.Id {
+				entry := &app_proto.RobotPartHistoryEntry{
+					Part:     p.Id,
+					Robot:    p.Robot,
+					When:     timestamppb.Now(),
+					Old:      proto.Clone(p).(*app_proto.RobotPart),
+					EditedBy: &app_proto.AuthenticatorInfo{Type: app_proto.AuthenticationType_AUTHENTICATION_TYPE_API_KEY, Value: "key-name"},
+				}
+				f.history[p.Id] = append([]*app_proto.RobotPartHistoryEntry{entry}, f.history[p.Id]...)
+				p.RobotConfig = in.RobotConfig
+				f.updated = append(f.updated, in.Id)
+				return &app_proto.UpdateRobotPartResponse{Part: p}, nil
+			}
+		}
+	}
+	return nil, errors.New("part not found")
+}
+
+func (f *fakeFleetClient) GetRobotPartHistory(ctx context.Context, in *app_proto.GetRobotPartHistoryRequest, opts ...grpc.CallOption) (*app_proto.GetRobotPartHistoryResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &app_proto.GetRobotPartHistoryResponse{History: f.history[in.Id]}, nil
+}
+
+func (f *fakeFleetClient) GetLocation(ctx context.Context, in *app_proto.GetLocationRequest, opts ...grpc.CallOption) (*app_proto.GetLocationResponse, error) {
+	return &app_proto.GetLocationResponse{Location: &app_proto.Location{
+		Id:            in.LocationId,
+		Organizations: []*app_proto.LocationOrganization{{OrganizationId: "org", Primary: true}},
+	}}, nil
+}
+
+func (f *fakeFleetClient) GetFragment(ctx context.Context, in *app_proto.GetFragmentRequest, opts ...grpc.CallOption) (*app_proto.GetFragmentResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	conf, ok := f.fragmentConfigs[in.Id]
+	if !ok {
+		return nil, errors.New("fragment not found")
+	}
+	return &app_proto.GetFragmentResponse{Fragment: &app_proto.Fragment{Id: in.Id, Name: in.Id + "-name", Fragment: conf}}, nil
+}
+
+func (f *fakeFleetClient) UpdateFragment(ctx context.Context, in *app_proto.UpdateFragmentRequest, opts ...grpc.CallOption) (*app_proto.UpdateFragmentResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.fragmentConfigs[in.Id]; !ok || in.Name != in.Id+"-name" {
+		return nil, errors.New("fragment not found")
+	}
+	f.fragmentConfigs[in.Id] = in.Config
+	return &app_proto.UpdateFragmentResponse{}, nil
+}
+
+func TestRollout(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeFleetClient()
+	client.addMachine(t, "loc-a", "robot-1", "old", "other")
+	client.addMachine(t, "loc-a", "robot-2", "other")
+	client.addMachine(t, "loc-b", "robot-3", "old")
+	client.addMachine(t, "loc-b", "robot-4", "old")
+	client.updateErrs["robot-4-main"] = errors.New("permission denied")
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: ctx}
+
+	// a dry run only reports the machines that would change
+	req := &rolloutRequest{oldFragmentId: "old", newFragmentId: "new", organizationId: "org", batchSize: 2, dryRun: true}
+	report, err := module.runRollout(ctx, client, req)
+	require.NoError(t, err)
+	assert.Equal(t, 4, report["machines_total"])
+	assert.Equal(t, 3, report["matched"])
+	assert.Equal(t, 2, report["batches"])
+	assert.Empty(t, client.updated)
+	_, err = structpb.NewStruct(report)
+	assert.NoError(t, err)
+
+	req.dryRun = false
+	report, err = module.runRollout(ctx, client, req)
+	assert.ErrorIs(t, err, errMachinesFailed)
+	assert.Equal(t, 2, report["updated"])
+	assert.Equal(t, 1, report["failed"])
+	assert.Equal(t, "1 of 3 machines failed", report["error"])
+	assert.ElementsMatch(t, []string{"robot-1-main", "robot-3-main"}, client.updated)
+	assert.Equal(t, []string{"other", "new"}, client.fragments("robot-1-main"))
+	assert.Equal(t, []string{"other"}, client.fragments("robot-2-main"))
+	assert.Equal(t, []string{"old"}, client.fragments("robot-4-main"))
+	for _, m := range report["machines"].([]interface{}) {
+		machine := m.(map[string]interface{})
+		if machine["robot_id"] == "robot-4" {
+			assert.Equal(t, rolloutFailed, machine["status"])
+			assert.Contains(t, machine["error"], "permission denied")
+		}
+	}
+
+	// a location limits the rollout to its machines, machines already moved aren't matched again
+	delete(client.updateErrs, "robot-4-main")
+	report, err = module.runRollout(ctx, client, &rolloutRequest{oldFragmentId: "old", newFragmentId: "new", locationId: "loc-b", batchSize: 10})
+	require.NoError(t, err)
+	assert.Equal(t, 2, report["machines_total"])
+	assert.Equal(t, 1, report["matched"])
+	assert.Equal(t, 1, report["ok"])
+	assert.Equal(t, []string{"new"}, client.fragments("robot-4-main"))
+}
+
+func TestRolloutCancelled(t *testing.T) {
+	client := newFakeFleetClient()
+	client.addMachine(t, "loc-a", "robot-1", "old")
+	client.addMachine(t, "loc-a", "robot-2", "old")
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: context.Background()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report, err := module.runRollout(ctx, client, &rolloutRequest{oldFragmentId: "old", newFragmentId: "new", locationId: "loc-a", batchSize: 1})
+	assert.ErrorIs(t, err, errMachinesFailed)
+	assert.Equal(t, 2, report["failed"])
+	machine := report["machines"].([]interface{})[0].(map[string]interface{})
+	assert.Contains(t, machine["error"], errCancelled.Error())
+	assert.Empty(t, client.updated)
+}
+
+func TestRolloutRequest(t *testing.T) {
+	req, err := rolloutRequestFromCommand(map[string]interface{}{"oldFragmentId": "old", "newFragmentId": "new", "location_id": "loc", "batch_size": 3.0, "dry_run": true})
+	require.NoError(t, err)
+	assert.Equal(t, &rolloutRequest{oldFragmentId: "old", newFragmentId: "new", locationId: "loc", batchSize: 3, dryRun: true}, req)
+
+	_, err = rolloutRequestFromCommand(map[string]interface{}{"oldFragmentId": "old", "newFragmentId": "new"})
+	assert.ErrorIs(t, err, errRolloutScopeMissing)
+	_, err = rolloutRequestFromCommand(map[string]interface{}{"newFragmentId": "new", "location_id": "loc"})
+	assert.ErrorIs(t, err, errOldFragmentIdMissing)
+	_, err = rolloutRequestFromCommand(map[string]interface{}{"oldFragmentId": "old", "newFragmentId": "new", "location_id": "loc", "batch_size": 0})
+	assert.ErrorIs(t, err, errInvalidRollout)
+
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: context.Background()}
+	resp, err := module.DoCommand(context.Background(), map[string]interface{}{"command": "rollout", "oldFragmentId": "old", "newFragmentId": "new"})
+	assert.ErrorIs(t, err, errRolloutScopeMissing)
+	assert.Equal(t, errRolloutScopeMissing.Error(), resp["error"])
+}
@@ -0,0 +1,602 @@
+package update_module
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	app_proto "go.viam.com/api/app/v1"
+	"go.viam.com/rdk/components/generic"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+	"go.viam.com/utils/rpc"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"viam-robot-update-module/utils"
+)
+
+const (
+	// SelfUpdateWatchdogArg runs the module binary as the watchdog of a self update instead of as a module
+	SelfUpdateWatchdogArg = "self-update-watchdog"
+
+	// the self update in progress is persisted here, it is shared by the old process, the watchdog and
+	// the new process as all of them run with the same module data directory
+	selfUpdateFile           = "self_update.json"
+	selfUpdateWatchdogLog    = "self_update_watchdog.log"
+	defaultSelfUpdateTimeout = 5 * time.Minute
+
+	selfUpdatePending      = "pending"
+	selfUpdateVerified     = "verified"
+	selfUpdateReverted     = "reverted"
+	selfUpdateRevertFailed = "revert_failed"
+	selfUpdateFailed       = "failed"
+
+	// viam-server sets the module id of registry modules in the module's environment
+	moduleIdEnv = "VIAM_MODULE_ID"
+	// the watchdog receives the app credentials of the old process in its environment, never on disk
+	watchdogEntityEnv   = "VIAM_UPDATE_WATCHDOG_ENTITY"
+	watchdogPayloadEnv  = "VIAM_UPDATE_WATCHDOG_PAYLOAD"
+	watchdogCredTypeEnv = "VIAM_UPDATE_WATCHDOG_CREDENTIALS_TYPE"
+)
+
+var (
+	processStarted = time.Now()
+
+	selfUpdateHealthInterval = 5 * time.Second
+
+	// startSelfUpdateWatchdog starts the watchdog for the self update in a new session, so it outlives this
+	// process when viam-server stops it. Tests replace it to run the watchdog in process.
+	startSelfUpdateWatchdog = func(id string, creds *credentials) error {
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		dir, err := dataDir()
+		if err != nil {
+			return err
+		}
+		// the watchdog logs to a file, the module's output pipe closes with this process
+		log, err := os.OpenFile(filepath.Join(dir, selfUpdateWatchdogLog), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+		defer log.Close()
+		cmd := exec.Command(exe, SelfUpdateWatchdogArg, id)
+		cmd.Env = append(os.Environ(),
+			watchdogEntityEnv+"="+creds.entity,
+			watchdogPayloadEnv+"="+creds.payload,
+			watchdogCredTypeEnv+"="+string(creds.credType),
+		)
+		cmd.Stdout = log
+		cmd.Stderr = log
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		go cmd.Wait() //nolint:errcheck
+		return nil
+	}
+
+	// checkModuleHealth sends the health command to the update component through viam-server
+	checkModuleHealth = func(ctx context.Context, logger logging.Logger, address, component string) (map[string]interface{}, error) {
+		robotClient, err := dialRobotClient(ctx, logger, address, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer robotClient.Close(ctx) //nolint:errcheck
+		res, err := generic.FromRobot(robotClient, component)
+		if err != nil {
+			return nil, err
+		}
+		return res.DoCommand(ctx, map[string]interface{}{"command": "health"})
+	}
+
+	errSelfUpdateTarget       = errors.New("exactly one of version or executable_path is required")
+	errSelfModuleNotFound     = errors.New("this module's entry was not found in the part's modules, set module_name")
+	errSelfModuleNotRegistry  = errors.New("this module has no module_id to update from the registry")
+	errSelfUpdateInProgress   = errors.New("a self update is already in progress")
+	errSelfUpdateUnchanged    = errors.New("the module entry already has the requested version")
+	errSelfUpdateNoParent     = errors.New("the new module can't be verified without the parent socket")
+	errSelfUpdateNotHealthy   = errors.New("the new module did not answer the health command in time")
+	errSelfUpdateEntryChanged = errors.New("the module entry changed since the self update, not reverting it")
+	errInvalidSelfUpdateId    = errors.New("invalid self update id")
+)
+
+// selfUpdate is a change of this module's own entry in the part's modules. The process that makes the
+// change records it before writing the part, the watchdog it starts verifies the new process and reverts
+// the entry if it doesn't answer.
+type selfUpdate struct {
+	ID            string    `json:"id"`
+	StartedAt     time.Time `json:"started_at"`
+	Deadline      time.Time `json:"deadline"`
+	State         string    `json:"state"`
+	Error         string    `json:"error,omitempty"`
+	FinishedAt    time.Time `json:"finished_at"`
+	RobotId       string    `json:"robot_id"`
+	Component     string    `json:"component"`
+	ParentAddress string    `json:"parent_address"`
+	// InitiatorPid is the old process, only an answer from another process verifies the update
+	InitiatorPid int    `json:"initiator_pid"`
+	NewPid       int    `json:"new_pid,omitempty"`
+	FromVersion  string `json:"from_version"`
+	ModuleName   string `json:"module_name"`
+	// Version or ExecutablePath is what the module was updated to
+	Version        string                 `json:"version,omitempty"`
+	ExecutablePath string                 `json:"executable_path,omitempty"`
+	Previous       map[string]interface{} `json:"previous"`
+	Entry          map[string]interface{} `json:"entry"`
+	// Hooks and Webhooks are the old process's, the watchdog runs the post hooks and sends the outcome
+	Hooks    []Hook    `json:"hooks,omitempty"`
+	Webhooks []Webhook `json:"webhooks,omitempty"`
+}
+
+func (s *selfUpdate) operation() operation {
+	params := map[string]string{"module": s.ModuleName, "self_update_id": s.ID}
+	if s.Version != "" {
+		params["version"] = s.Version
+	}
+	if s.ExecutablePath != "" {
+		params["executable_path"] = s.ExecutablePath
+	}
+	return operation{Command: "self_update", Params: params}
+}
+
+// checkTarget checks that a health answer comes from what the module was updated to, by the version it
+// reports or the executable it runs from. Releases in the registry report their version in utils.Version.
+func (s *selfUpdate) checkTarget(health map[string]interface{}) error {
+	if s.Version != "" {
+		version, _ := health["version"].(string)
+		if strings.TrimPrefix(version, "v") != strings.TrimPrefix(s.Version, "v") {
+			return fmt.Errorf("the module answered with version %q, not %s", version, s.Version)
+		}
+	}
+	if s.ExecutablePath != "" {
+		exe, _ := health["executable_path"].(string)
+		if resolvedPath(exe) != resolvedPath(s.ExecutablePath) {
+			return fmt.Errorf("the module answered from %q, not %s", exe, s.ExecutablePath)
+		}
+	}
+	return nil
+}
+
+// resolvedPath follows the symlinks in path, or returns it as is if that fails
+func resolvedPath(path string) string {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return path
+}
+
+func (s *selfUpdate) toMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"id":         s.ID,
+		"state":      s.State,
+		"module":     s.ModuleName,
+		"started_at": s.StartedAt.Format(time.RFC3339),
+		"verify_by":  s.Deadline.Format(time.RFC3339),
+		"from":       s.FromVersion,
+		"entry":      s.Entry,
+		"previous":   s.Previous,
+		"initiator":  s.InitiatorPid,
+	}
+	if !s.FinishedAt.IsZero() {
+		m["finished_at"] = s.FinishedAt.Format(time.RFC3339)
+	}
+	if s.NewPid != 0 {
+		m["new_pid"] = s.NewPid
+	}
+	if s.Error != "" {
+		m["error"] = s.Error
+	}
+	return m
+}
+
+func saveSelfUpdate(s *selfUpdate) error {
+	dir, err := dataDir()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, selfUpdateFile), data, 0o600)
+}
+
+// loadSelfUpdate returns the most recent self update, nil if there has been none
+func loadSelfUpdate() (*selfUpdate, error) {
+	dir, err := dataDir()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, selfUpdateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s selfUpdate
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// selfModuleName returns the name of this module in the part's modules, module_name if it is configured
+// or else the entry with the module id viam-server started this module with
+func selfModuleName(cfg *Config, conf *structpb.Struct) (string, error) {
+	if cfg != nil && cfg.ModuleName != "" {
+		return cfg.ModuleName, nil
+	}
+	if id := os.Getenv(moduleIdEnv); id != "" {
+		for _, v := range conf.GetFields()["modules"].GetListValue().GetValues() {
+			if m := v.GetStructValue(); m.GetFields()["module_id"].GetStringValue() == id {
+				return m.GetFields()["name"].GetStringValue(), nil
+			}
+		}
+	}
+	return "", errSelfModuleNotFound
+}
+
+// selfModuleEntry returns the index of the named module in the part's modules
+func selfModuleEntry(conf *structpb.Struct, name string) (int, *structpb.Struct, error) {
+	for i, v := range conf.GetFields()["modules"].GetListValue().GetValues() {
+		if m := v.GetStructValue(); m.GetFields()["name"].GetStringValue() == name {
+			return i, m, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("%w: %s", errSelfModuleNotFound, name)
+}
+
+// selfUpdateEntry returns the module entry that runs version from the registry, or the executable at
+// executablePath as a local module. Other settings of the entry, such as env, are kept.
+func selfUpdateEntry(previous map[string]interface{}, version, executablePath string) (map[string]interface{}, error) {
+	entry := map[string]interface{}{}
+	for k, v := range previous {
+		entry[k] = v
+	}
+	if version != "" {
+		if id, _ := entry["module_id"].(string); id == "" {
+			return nil, errSelfModuleNotRegistry
+		}
+		entry["type"] = "registry"
+		entry["version"] = version
+		delete(entry, "executable_path")
+		return entry, nil
+	}
+	entry["type"] = "local"
+	entry["executable_path"] = executablePath
+	delete(entry, "module_id")
+	delete(entry, "version")
+	return entry, nil
+}
+
+// checkExecutable makes sure a local module exists on this machine before the part is pointed at it
+func checkExecutable(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("executable_path must be absolute: %s", path)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() || fi.Mode()&0o111 == 0 {
+		return fmt.Errorf("%s is not an executable file", path)
+	}
+	return nil
+}
+
+// health handles the health command the watchdog of a self update checks the new process with
+func (b *RobotUpdateModule) health() (map[string]interface{}, error) {
+	resp := map[string]interface{}{
+		"ok":         1,
+		"version":    utils.Version,
+		"pid":        os.Getpid(),
+		"started_at": processStarted.Format(time.RFC3339),
+	}
+	if exe, err := os.Executable(); err == nil {
+		resp["executable_path"] = exe
+	}
+	if s, err := loadSelfUpdate(); err == nil && s != nil && s.State == selfUpdatePending && s.InitiatorPid != os.Getpid() {
+		resp["self_update_id"] = s.ID
+	}
+	return resp, nil
+}
+
+// selfUpdateCommand handles the self_update command. It points this module's entry in the part's modules
+// at version from the registry or at the local executable_path, which makes viam-server replace this
+// process. A watchdog started first waits up to timeout_seconds for the new process to answer the health
+// command and otherwise puts the entry back.
+func (b *RobotUpdateModule) selfUpdateCommand(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	version, _ := cmd["version"].(string)
+	executablePath, _ := cmd["executable_path"].(string)
+	if (version == "") == (executablePath == "") {
+		return map[string]interface{}{"error": errSelfUpdateTarget.Error()}, errSelfUpdateTarget
+	}
+	if executablePath != "" {
+		if err := checkExecutable(executablePath); err != nil {
+			return map[string]interface{}{"error": err.Error()}, err
+		}
+	}
+	timeout := defaultSelfUpdateTimeout
+	if _, ok := cmd["timeout_seconds"]; ok {
+		t, err := secondsFromRequest(cmd, "timeout_seconds")
+		if err != nil || t <= 0 {
+			err = errors.New("timeout_seconds must be a positive number")
+			return map[string]interface{}{"error": err.Error()}, err
+		}
+		timeout = t
+	}
+	// the new process runs with the same data directory, so this also stops it from starting another
+	// self update before it has been verified
+	if s, err := loadSelfUpdate(); err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	} else if s != nil && s.State == selfUpdatePending && time.Now().Before(s.Deadline) {
+		err := fmt.Errorf("%w: %s until %s", errSelfUpdateInProgress, s.ID, s.Deadline.Format(time.RFC3339))
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	address, err := parentAddress()
+	if err != nil {
+		err = fmt.Errorf("%w: %v", errSelfUpdateNoParent, err)
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+
+	b.publishStep("self_update", "getting credentials")
+	creds, err := b.getCredentials(cmd)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	auditCredentials(ctx, creds)
+	b.publishStep("self_update", "dialing app")
+	client, err := b.GetClient(ctx, creds)
+	if err = stepError(ctx, "dialing app", err); err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	partId, err := machinePartId()
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	part, err := client.GetRobotPart(ctx, &app_proto.GetRobotPartRequest{Id: partId})
+	if err = stepError(ctx, "getting robot part", err); err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+
+	b.mu.Lock()
+	cfg := b.cfg
+	b.mu.Unlock()
+	name, err := selfModuleName(cfg, part.GetPart().GetRobotConfig())
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	s := &selfUpdate{
+		ID:             newEventId(),
+		StartedAt:      time.Now().UTC(),
+		Deadline:       time.Now().UTC().Add(timeout),
+		State:          selfUpdatePending,
+		RobotId:        part.GetPart().GetRobot(),
+		Component:      b.componentName(),
+		ParentAddress:  address,
+		InitiatorPid:   os.Getpid(),
+		FromVersion:    utils.Version,
+		ModuleName:     name,
+		Version:        version,
+		ExecutablePath: executablePath,
+	}
+	if cfg != nil {
+		s.Hooks = cfg.Hooks
+		s.Webhooks = cfg.Webhooks
+	}
+	op := s.operation()
+
+	b.publishStep("self_update", "running pre hooks")
+	if err := stepError(ctx, "running pre hooks", b.runHooks(ctx, hookStagePre, op, nil)); err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	b.publishStep("self_update", "writing part config")
+	resp, err := b.updatePartConfig(ctx, client, s.RobotId, func(part *app_proto.RobotPart) (*structpb.Struct, error) {
+		i, entry, err := selfModuleEntry(part.RobotConfig, name)
+		if err != nil {
+			return nil, err
+		}
+		s.Previous = entry.AsMap()
+		if s.Entry, err = selfUpdateEntry(s.Previous, version, executablePath); err != nil {
+			return nil, err
+		}
+		if reflect.DeepEqual(s.Entry, s.Previous) {
+			return nil, errSelfUpdateUnchanged
+		}
+		updated, err := structpb.NewStruct(s.Entry)
+		if err != nil {
+			return nil, err
+		}
+		// the watchdog is running before the part is written, as writing it stops this process
+		if err := saveSelfUpdate(s); err != nil {
+			return nil, fmt.Errorf("saving the self update: %w", err)
+		}
+		if err := startSelfUpdateWatchdog(s.ID, creds); err != nil {
+			return nil, fmt.Errorf("starting the self update watchdog: %w", err)
+		}
+		part.RobotConfig.Fields["modules"].GetListValue().Values[i] = structpb.NewStructValue(updated)
+		return part.RobotConfig, nil
+	})
+	if errors.Is(err, errSelfUpdateUnchanged) {
+		return map[string]interface{}{"ok": 1, "msg": "module " + name + " is already on the requested version"}, nil
+	}
+	if err := responseError(resp, err); err != nil {
+		// the watchdog, if it was started, stops once the update is no longer pending
+		if s.Previous != nil {
+			s.State = selfUpdateFailed
+			s.Error = err.Error()
+			s.FinishedAt = time.Now().UTC()
+			if saveErr := saveSelfUpdate(s); saveErr != nil {
+				b.logger.Warnf("Error saving the failed self update: %v", saveErr)
+			}
+		}
+		b.publishStep("self_update", "running post hooks")
+		if hookErr := b.runHooks(ctx, hookStagePost, op, err); hookErr != nil {
+			b.logger.Errorf("Error running post hooks: %v", hookErr)
+		}
+		b.notify(eventUpdateFailed, op.Params, err)
+		return resp, err
+	}
+	b.logger.Infof("Self update %s written, viam-server will restart module %s", s.ID, name)
+	b.notify(eventUpdateStarted, op.Params, nil)
+	resp["self_update"] = s.toMap()
+	return resp, nil
+}
+
+func (b *RobotUpdateModule) componentName() string {
+	if b.Named == nil {
+		return ""
+	}
+	return b.Name().Name
+}
+
+// RunSelfUpdateWatchdog is the entry point of the watchdog process, args are the module binary's
+func RunSelfUpdateWatchdog(ctx context.Context, args []string, logger logging.Logger) error {
+	if len(args) < 3 || args[2] == "" {
+		return errInvalidSelfUpdateId
+	}
+	s, err := loadSelfUpdate()
+	if err != nil {
+		return err
+	}
+	if s == nil || s.ID != args[2] {
+		return fmt.Errorf("%w: %s", errInvalidSelfUpdateId, args[2])
+	}
+	creds := &credentials{
+		entity:   os.Getenv(watchdogEntityEnv),
+		payload:  os.Getenv(watchdogPayloadEnv),
+		credType: rpc.CredentialsType(os.Getenv(watchdogCredTypeEnv)),
+	}
+	b := &RobotUpdateModule{
+		logger:      logger,
+		ctx:         ctx,
+		cfg:         &Config{Hooks: s.Hooks, Webhooks: s.Webhooks},
+		webhookWake: make(chan struct{}, 1),
+	}
+	if s.Component != "" {
+		// the watchdog queues webhooks into the component's queue, which the new process delivers
+		b.Named = resource.NewName(generic.API, s.Component).AsNamed()
+	}
+	defer b.closeClients(ctx)
+	return b.superviseSelfUpdate(ctx, s.ID, creds)
+}
+
+// superviseSelfUpdate waits for a process other than the one that started the self update to answer the
+// health command, and reverts the module entry if none does before the deadline
+func (b *RobotUpdateModule) superviseSelfUpdate(ctx context.Context, id string, creds *credentials) error {
+	var lastErr error
+	for {
+		s, err := loadSelfUpdate()
+		if err != nil {
+			return err
+		}
+		// the old process gave up on the update, or a newer one replaced it
+		if s == nil || s.ID != id || s.State != selfUpdatePending {
+			return nil
+		}
+		if !time.Now().Before(s.Deadline) {
+			if lastErr == nil {
+				lastErr = errSelfUpdateNotHealthy
+			}
+			return b.revertSelfUpdate(ctx, s, creds, lastErr)
+		}
+		if err := sleepContext(ctx, min(selfUpdateHealthInterval, time.Until(s.Deadline))); err != nil {
+			return err
+		}
+
+		resp, err := checkModuleHealth(ctx, b.logger, s.ParentAddress, s.Component)
+		if err != nil {
+			b.logger.Debugf("Module not healthy yet: %v", err)
+			lastErr = fmt.Errorf("%w: %v", errSelfUpdateNotHealthy, err)
+			continue
+		}
+		pid, err := intFromRequest(resp, "pid")
+		if err != nil || pid == s.InitiatorPid {
+			// the old process may answer until viam-server has stopped it
+			lastErr = fmt.Errorf("%w: the old process is still answering", errSelfUpdateNotHealthy)
+			continue
+		}
+		if err := s.checkTarget(resp); err != nil {
+			// viam-server may have restarted the old module, after a failed download for one
+			lastErr = fmt.Errorf("%w: %v", errSelfUpdateNotHealthy, err)
+			continue
+		}
+		s.State = selfUpdateVerified
+		s.NewPid = pid
+		s.FinishedAt = time.Now().UTC()
+		b.logger.Infof("Self update %s verified, module answered from pid %d", s.ID, pid)
+		b.finishSelfUpdate(ctx, s, nil)
+		return nil
+	}
+}
+
+// revertSelfUpdate puts the module entry back as it was before the self update, unless it has been
+// changed since
+func (b *RobotUpdateModule) revertSelfUpdate(ctx context.Context, s *selfUpdate, creds *credentials, cause error) error {
+	b.logger.Errorf("Reverting self update %s: %v", s.ID, cause)
+	err := func() error {
+		client, err := b.GetClient(ctx, creds)
+		if err = stepError(ctx, "dialing app", err); err != nil {
+			return err
+		}
+		previous, err := structpb.NewStruct(s.Previous)
+		if err != nil {
+			return err
+		}
+		resp, err := b.updatePartConfig(ctx, client, s.RobotId, func(part *app_proto.RobotPart) (*structpb.Struct, error) {
+			i, entry, err := selfModuleEntry(part.RobotConfig, s.ModuleName)
+			if err != nil {
+				return nil, err
+			}
+			if !reflect.DeepEqual(entry.AsMap(), s.Entry) {
+				return nil, errSelfUpdateEntryChanged
+			}
+			part.RobotConfig.Fields["modules"].GetListValue().Values[i] = structpb.NewStructValue(previous)
+			return part.RobotConfig, nil
+		})
+		return responseError(resp, err)
+	}()
+	s.FinishedAt = time.Now().UTC()
+	if err != nil {
+		s.State = selfUpdateRevertFailed
+		s.Error = fmt.Sprintf("%v, reverting failed: %v", cause, err)
+		b.finishSelfUpdate(ctx, s, err)
+		return err
+	}
+	s.State = selfUpdateReverted
+	s.Error = cause.Error()
+	b.finishSelfUpdate(ctx, s, cause)
+	return nil
+}
+
+// finishSelfUpdate records the outcome and reports it through the old process's post hooks and webhooks
+func (b *RobotUpdateModule) finishSelfUpdate(ctx context.Context, s *selfUpdate, result error) {
+	if err := saveSelfUpdate(s); err != nil {
+		b.logger.Errorf("Error saving the self update: %v", err)
+	}
+	op := s.operation()
+	if err := b.runHooks(ctx, hookStagePost, op, result); err != nil {
+		b.logger.Errorf("Error running post hooks: %v", err)
+	}
+	switch s.State {
+	case selfUpdateVerified:
+		b.notify(eventUpdateSucceeded, op.Params, nil)
+	case selfUpdateReverted:
+		b.notify(eventUpdateRolledBack, op.Params, result)
+	default:
+		b.notify(eventUpdateFailed, op.Params, result)
+	}
+	// the module delivers what is left of the queue on its next pass
+	b.deliverWebhooks(ctx)
+}
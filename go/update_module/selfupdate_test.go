@@ -0,0 +1,241 @@
+package update_module
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.viam.com/rdk/components/generic"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// useSelfUpdate gives the module a parent socket and a part that runs it as update-module, and replaces
+// the watchdog so tests supervise the update themselves. It returns the ids and credentials the
+// watchdog was started with.
+func useSelfUpdate(t *testing.T, module *RobotUpdateModule, client *fakeFleetClient) (*[]string, **credentials) {
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	t.Setenv(moduleIdEnv, "pete:robot-update-module")
+	usePartClient(t, module, client)
+	origSocket, origStart, origHealth, origInterval := moduleSocketArg, startSelfUpdateWatchdog, checkModuleHealth, selfUpdateHealthInterval
+	t.Cleanup(func() {
+		moduleSocketArg, startSelfUpdateWatchdog, checkModuleHealth, selfUpdateHealthInterval = origSocket, origStart, origHealth, origInterval
+	})
+	socket := filepath.Join(t.TempDir(), "robot-update-abcde.sock")
+	moduleSocketArg = func() string { return socket }
+	selfUpdateHealthInterval = 10 * time.Millisecond
+
+	var ids []string
+	var creds *credentials
+	startSelfUpdateWatchdog = func(id string, c *credentials) error {
+		ids = append(ids, id)
+		creds = c
+		return nil
+	}
+	conf, err := structpb.NewStruct(map[string]interface{}{
+		"fragments": []interface{}{"base"},
+		"modules": []interface{}{
+			map[string]interface{}{"type": "registry", "name": "other", "module_id": "acme:other", "version": "1.0.0"},
+			map[string]interface{}{"type": "registry", "name": "update-module", "module_id": "pete:robot-update-module", "version": "0.0.1", "env": map[string]interface{}{"A": "b"}},
+		},
+	})
+	require.NoError(t, err)
+	client.parts["robot"][0].RobotConfig = conf
+	return &ids, &creds
+}
+
+func selfModule(t *testing.T, client *fakeFleetClient) map[string]interface{} {
+	_, entry, err := selfModuleEntry(client.parts["robot"][0].RobotConfig, "update-module")
+	require.NoError(t, err)
+	return entry.AsMap()
+}
+
+// healthFrom answers the health command with version from pids, the last one for all later checks
+func healthFrom(version string, pids ...int) func(context.Context, logging.Logger, string, string) (map[string]interface{}, error) {
+	return func(ctx context.Context, logger logging.Logger, address, component string) (map[string]interface{}, error) {
+		pid := pids[0]
+		if len(pids) > 1 {
+			pids = pids[1:]
+		}
+		return map[string]interface{}{"ok": 1.0, "pid": float64(pid), "version": version}, nil
+	}
+}
+
+func TestSelfUpdate(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeFleetClient()
+	client.addMachine(t, "loc", "robot", "base")
+	module := RobotUpdateModule{
+		Named:  resource.NewName(generic.API, "updater").AsNamed(),
+		logger: logging.NewTestLogger(t),
+		ctx:    ctx,
+		cfg:    partTestConfig(),
+	}
+	ids, creds := useSelfUpdate(t, &module, client)
+
+	resp, err := module.doCommand(ctx, map[string]interface{}{"command": "self_update", "version": "0.0.2", "timeout_seconds": 5.0})
+	require.NoError(t, err)
+	assert.Equal(t, 1, resp["ok"])
+	_, err = structpb.NewStruct(resp)
+	assert.NoError(t, err)
+	require.Len(t, *ids, 1)
+	assert.Equal(t, "0.0.2", selfModule(t, client)["version"])
+	assert.Equal(t, map[string]interface{}{"A": "b"}, selfModule(t, client)["env"])
+	s, err := loadSelfUpdate()
+	require.NoError(t, err)
+	assert.Equal(t, (*ids)[0], s.ID)
+	assert.Equal(t, selfUpdatePending, s.State)
+	assert.Equal(t, os.Getpid(), s.InitiatorPid)
+	assert.Equal(t, "updater", s.Component)
+
+	// the new process can't start another self update until this one is verified
+	_, err = module.doCommand(ctx, map[string]interface{}{"command": "self_update", "version": "0.0.3"})
+	assert.ErrorIs(t, err, errSelfUpdateInProgress)
+
+	// answers from the old process don't verify the update
+	checkModuleHealth = healthFrom("0.0.2", os.Getpid(), os.Getpid()+1)
+	require.NoError(t, module.superviseSelfUpdate(ctx, s.ID, *creds))
+	s, err = loadSelfUpdate()
+	require.NoError(t, err)
+	assert.Equal(t, selfUpdateVerified, s.State)
+	assert.Equal(t, os.Getpid()+1, s.NewPid)
+	assert.Equal(t, "0.0.2", selfModule(t, client)["version"])
+	events, _, _ := module.events.since(0)
+	assert.Equal(t, eventUpdateSucceeded, events[len(events)-1].Type)
+
+	// a new process still on the old version, viam-server restarted the old module, is reverted
+	_, err = module.doCommand(ctx, map[string]interface{}{"command": "self_update", "version": "0.0.3", "timeout_seconds": 0.1})
+	require.NoError(t, err)
+	checkModuleHealth = healthFrom("0.0.2", os.Getpid()+2)
+	require.NoError(t, module.superviseSelfUpdate(ctx, (*ids)[1], *creds))
+	s, err = loadSelfUpdate()
+	require.NoError(t, err)
+	assert.Equal(t, selfUpdateReverted, s.State)
+	assert.Contains(t, s.Error, `version "0.0.2"`)
+	assert.Equal(t, "0.0.2", selfModule(t, client)["version"])
+
+	// a module that never answers is reverted to the previous entry
+	exe := filepath.Join(t.TempDir(), "module")
+	require.NoError(t, os.WriteFile(exe, []byte("#!/bin/sh\n"), 0o700))
+	_, err = module.doCommand(ctx, map[string]interface{}{"command": "self_update", "executable_path": exe, "timeout_seconds": 0.1})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"type": "local", "name": "update-module", "executable_path": exe, "env": map[string]interface{}{"A": "b"}}, selfModule(t, client))
+	checkModuleHealth = healthFrom("0.0.2", os.Getpid())
+	require.NoError(t, module.superviseSelfUpdate(ctx, (*ids)[2], *creds))
+	s, err = loadSelfUpdate()
+	require.NoError(t, err)
+	assert.Equal(t, selfUpdateReverted, s.State)
+	assert.Contains(t, s.Error, errSelfUpdateNotHealthy.Error())
+	assert.Equal(t, "0.0.2", selfModule(t, client)["version"])
+	assert.Equal(t, "registry", selfModule(t, client)["type"])
+	events, _, _ = module.events.since(0)
+	assert.Equal(t, eventUpdateRolledBack, events[len(events)-1].Type)
+
+	// an entry changed since the update isn't reverted
+	_, err = module.doCommand(ctx, map[string]interface{}{"command": "self_update", "version": "0.0.4", "timeout_seconds": 0.1})
+	require.NoError(t, err)
+	_, entry, err := selfModuleEntry(client.parts["robot"][0].RobotConfig, "update-module")
+	require.NoError(t, err)
+	entry.Fields["version"] = structpb.NewStringValue("0.0.5")
+	assert.ErrorIs(t, module.superviseSelfUpdate(ctx, (*ids)[3], *creds), errSelfUpdateEntryChanged)
+	s, err = loadSelfUpdate()
+	require.NoError(t, err)
+	assert.Equal(t, selfUpdateRevertFailed, s.State)
+	assert.Equal(t, "0.0.5", selfModule(t, client)["version"])
+
+	// without the parent socket status doesn't wait on dialing viam-server
+	moduleSocketArg = func() string { return "" }
+	status := module.status(ctx)
+	assert.Equal(t, selfUpdateRevertFailed, status["self_update_state"])
+}
+
+func TestSelfUpdateTarget(t *testing.T) {
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "module")
+	require.NoError(t, os.WriteFile(exe, []byte("#!/bin/sh\n"), 0o700))
+	link := filepath.Join(dir, "current")
+	require.NoError(t, os.Symlink(exe, link))
+
+	versioned := &selfUpdate{Version: "0.0.2"}
+	assert.NoError(t, versioned.checkTarget(map[string]interface{}{"version": "v0.0.2"}))
+	assert.Error(t, versioned.checkTarget(map[string]interface{}{"version": "0.0.1"}))
+	assert.Error(t, versioned.checkTarget(map[string]interface{}{}))
+	// the new process reports where its executable resolves to
+	local := &selfUpdate{ExecutablePath: link}
+	assert.NoError(t, local.checkTarget(map[string]interface{}{"executable_path": exe}))
+	assert.Error(t, local.checkTarget(map[string]interface{}{"executable_path": "/usr/local/bin/old-module"}))
+}
+
+func TestSelfUpdateChecks(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeFleetClient()
+	client.addMachine(t, "loc", "robot", "base")
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: ctx, cfg: partTestConfig()}
+	ids, _ := useSelfUpdate(t, &module, client)
+
+	for _, cmd := range []map[string]interface{}{
+		{"command": "self_update"},
+		{"command": "self_update", "version": "1", "executable_path": "/bin/sh"},
+	} {
+		_, err := module.doCommand(ctx, cmd)
+		assert.ErrorIs(t, err, errSelfUpdateTarget)
+	}
+	_, err := module.doCommand(ctx, map[string]interface{}{"command": "self_update", "executable_path": "module"})
+	assert.Error(t, err)
+	_, err = module.doCommand(ctx, map[string]interface{}{"command": "self_update", "executable_path": t.TempDir()})
+	assert.Error(t, err)
+	_, err = module.doCommand(ctx, map[string]interface{}{"command": "self_update", "version": "1", "timeout_seconds": 0.0})
+	assert.Error(t, err)
+
+	resp, err := module.doCommand(ctx, map[string]interface{}{"command": "self_update", "version": "0.0.1"})
+	require.NoError(t, err)
+	assert.Contains(t, resp["msg"], "already on the requested version")
+
+	// the module is found by module_name when viam-server didn't pass its module id
+	t.Setenv(moduleIdEnv, "")
+	_, err = module.doCommand(ctx, map[string]interface{}{"command": "self_update", "version": "0.0.2"})
+	assert.ErrorIs(t, err, errSelfModuleNotFound)
+	module.cfg.ModuleName = "missing"
+	_, err = module.doCommand(ctx, map[string]interface{}{"command": "self_update", "version": "0.0.2"})
+	assert.ErrorIs(t, err, errSelfModuleNotFound)
+
+	moduleSocketArg = func() string { return "" }
+	_, err = module.doCommand(ctx, map[string]interface{}{"command": "self_update", "version": "0.0.2"})
+	assert.ErrorIs(t, err, errSelfUpdateNoParent)
+
+	module.cfg.MaintenanceWindows = []MaintenanceWindow{maintenanceWindowLater()}
+	_, err = module.doCommand(ctx, map[string]interface{}{"command": "self_update", "version": "0.0.2"})
+	assert.Error(t, err)
+	assert.Empty(t, *ids)
+	assert.Empty(t, client.updated)
+
+	_, err = selfUpdateEntry(map[string]interface{}{"type": "local", "name": "m", "executable_path": "/m"}, "1.0.0", "")
+	assert.ErrorIs(t, err, errSelfModuleNotRegistry)
+}
+
+func TestHealth(t *testing.T) {
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: context.Background()}
+	resp, err := module.doCommand(context.Background(), map[string]interface{}{"command": "health"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, resp["ok"])
+	assert.Equal(t, os.Getpid(), resp["pid"])
+	assert.Contains(t, resp, "executable_path")
+	assert.NotContains(t, resp, "self_update_id")
+
+	// the new process reports the self update it was started by
+	require.NoError(t, saveSelfUpdate(&selfUpdate{ID: "abc", State: selfUpdatePending, InitiatorPid: os.Getpid() + 1}))
+	resp, err = module.health()
+	require.NoError(t, err)
+	assert.Equal(t, "abc", resp["self_update_id"])
+	_, err = structpb.NewStruct(resp)
+	assert.NoError(t, err)
+
+	err = RunSelfUpdateWatchdog(context.Background(), []string{"module", SelfUpdateWatchdogArg, "other"}, module.logger)
+	assert.ErrorIs(t, err, errInvalidSelfUpdateId)
+}
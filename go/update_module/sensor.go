@@ -0,0 +1,86 @@
+package update_module
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.viam.com/rdk/components/sensor"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+
+	"viam-robot-update-module/utils"
+)
+
+// StatusModel is a sensor reporting the state of an update component, so data capture can record update
+// progress across a fleet
+var StatusModel = resource.NewModel(utils.Namespace, "robot", "update-status")
+
+func init() {
+	resource.RegisterComponent(
+		sensor.API,
+		StatusModel,
+		resource.Registration[sensor.Sensor, *StatusConfig]{
+			Constructor: newStatusSensor,
+		},
+	)
+}
+
+type StatusConfig struct {
+	// UpdateComponent is the name of the update component in this module to report on
+	UpdateComponent string `json:"update_component"`
+}
+
+func (cfg *StatusConfig) Validate(path string) ([]string, error) {
+	if cfg.UpdateComponent == "" {
+		return nil, fmt.Errorf("%s: update_component is required", path)
+	}
+	// depending on the update component makes viam-server build it first
+	return []string{cfg.UpdateComponent}, nil
+}
+
+type statusSensor struct {
+	resource.Named
+	resource.TriviallyCloseable
+	logger logging.Logger
+
+	mu              sync.Mutex
+	updateComponent string
+}
+
+func newStatusSensor(ctx context.Context, deps resource.Dependencies, conf resource.Config, logger logging.Logger) (sensor.Sensor, error) {
+	s := &statusSensor{Named: conf.ResourceName().AsNamed(), logger: logger}
+	if err := s.Reconfigure(ctx, deps, conf); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reconfigure implements resource.Resource.
+func (s *statusSensor) Reconfigure(ctx context.Context, deps resource.Dependencies, conf resource.Config) error {
+	cfg, err := resource.NativeConfig[*StatusConfig](conf)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updateComponent = cfg.UpdateComponent
+	return nil
+}
+
+// Readings implements sensor.Sensor.
+func (s *statusSensor) Readings(ctx context.Context, extra map[string]interface{}) (map[string]interface{}, error) {
+	s.mu.Lock()
+	name := s.updateComponent
+	s.mu.Unlock()
+	b, err := lookupUpdateModule(name)
+	if err != nil {
+		return nil, err
+	}
+	return b.status(ctx), nil
+}
+
+// DoCommand implements resource.Resource.
+func (s *statusSensor) DoCommand(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	return nil, resource.ErrDoUnimplemented
+}
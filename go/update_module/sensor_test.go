@@ -0,0 +1,91 @@
+package update_module
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.viam.com/rdk/components/generic"
+	"go.viam.com/rdk/components/sensor"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+	"go.viam.com/rdk/robot/client"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestStatusConfigValidate(t *testing.T) {
+	_, err := (&StatusConfig{}).Validate("path")
+	assert.Error(t, err)
+	deps, err := (&StatusConfig{UpdateComponent: "updater"}).Validate("path")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"updater"}, deps)
+}
+
+func TestStatusSensor(t *testing.T) {
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	logger := logging.NewTestLogger(t)
+	ctx := context.Background()
+	defer func(arg func() string) { moduleSocketArg = arg }(moduleSocketArg)
+	moduleSocketArg = func() string { return "" }
+
+	res, err := NewUpdateModule(ctx, nil, resource.Config{Name: "updater", API: generic.API, Model: Model, ConvertedAttributes: &Config{}}, logger)
+	require.NoError(t, err)
+	updater := res.(*RobotUpdateModule)
+
+	s, err := newStatusSensor(ctx, nil, resource.Config{Name: "status", API: sensor.API, Model: StatusModel, ConvertedAttributes: &StatusConfig{UpdateComponent: "updater"}}, logger)
+	require.NoError(t, err)
+
+	readings, err := s.Readings(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, false, readings["restart_pending"])
+	assert.Equal(t, 0, readings["queued_commands"])
+	assert.Contains(t, readings, "running_version_error")
+	assert.NotContains(t, readings, "last_update_at")
+
+	conf, err := structpb.NewStruct(map[string]interface{}{"fragments": []interface{}{"frag-a", "frag-b"}})
+	require.NoError(t, err)
+	updater.recordAppliedFragments(conf)
+	updater.recordUpdate("frag-old", "frag-b", errors.New("app unavailable"))
+	updater.setTargetVersion("0.50.0")
+	updater.scheduleRestart(time.Now().Add(time.Hour), operation{Command: "restart"})
+
+	readings, err = s.Readings(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"frag-a", "frag-b"}, readings["applied_fragments"])
+	assert.Equal(t, "error", readings["last_update_result"])
+	assert.Equal(t, "app unavailable", readings["last_update_error"])
+	assert.Equal(t, "0.50.0", readings["target_version"])
+	assert.Equal(t, true, readings["restart_pending"])
+	assert.Equal(t, 1, readings["pending_restarts"])
+	// readings must convert for data capture
+	_, err = structpb.NewStruct(readings)
+	assert.NoError(t, err)
+
+	require.NoError(t, updater.Close(ctx))
+	_, err = s.Readings(ctx, nil)
+	assert.ErrorIs(t, err, errUpdateComponentNotFound)
+}
+
+func TestStatusDialsOnce(t *testing.T) {
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	dir := t.TempDir()
+	defer func(arg func() string, dial func(context.Context, logging.Logger, string, *credentials) (*client.RobotClient, error)) {
+		moduleSocketArg, dialRobotClient = arg, dial
+	}(moduleSocketArg, dialRobotClient)
+	moduleSocketArg = func() string { return filepath.Join(dir, "robot-update.sock") }
+	dials := 0
+	dialRobotClient = func(ctx context.Context, logger logging.Logger, address string, creds *credentials) (*client.RobotClient, error) {
+		dials++
+		return nil, errors.New("connection refused")
+	}
+
+	// readings try viam-server once rather than with the retries of commands
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t)}
+	s := module.status(context.Background())
+	assert.Contains(t, s["running_version_error"], "connection refused")
+	assert.Equal(t, 1, dials)
+}
@@ -0,0 +1,146 @@
+package update_module
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	systemd "github.com/coreos/go-systemd/v22/dbus"
+)
+
+const (
+	serviceManagerSystemd   = "systemd"
+	serviceManagerSystemctl = "systemctl"
+
+	defaultServiceUnit          = "viam-agent"
+	defaultRestartVerifyTimeout = 60 * time.Second
+	unitActiveState             = "active"
+	unitFailedState             = "failed"
+)
+
+var (
+	errUnknownServiceManager = errors.New("unknown service manager")
+	errUnitRestartFailed     = errors.New("unit restart failed")
+	errUnitNotActive         = errors.New("unit did not return to active")
+)
+
+// ServiceManager abstracts the init system used to restart the unit that runs viam-server.
+type ServiceManager interface {
+	// Restart restarts the unit and returns once the init system has accepted the request.
+	Restart(ctx context.Context, unit string) error
+	// ActiveState returns the unit's ActiveState, e.g. "active", "activating" or "failed".
+	ActiveState(ctx context.Context, unit string) (string, error)
+}
+
+// newServiceManager returns the ServiceManager for the given name, defaulting to systemd over D-Bus.
+func newServiceManager(name string) (ServiceManager, error) {
+	switch name {
+	case "", serviceManagerSystemd:
+		return &systemdServiceManager{}, nil
+	case serviceManagerSystemctl:
+		return &systemctlServiceManager{}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", errUnknownServiceManager, name)
+}
+
+// unitName appends the .service suffix when the unit has no type suffix, D-Bus requires the full name.
+func unitName(unit string) string {
+	if strings.Contains(unit, ".") {
+		return unit
+	}
+	return unit + ".service"
+}
+
+// systemdServiceManager talks to systemd directly over the system D-Bus.
+type systemdServiceManager struct{}
+
+func (m *systemdServiceManager) Restart(ctx context.Context, unit string) error {
+	conn, err := systemd.NewSystemConnectionContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	result := make(chan string, 1)
+	if _, err := conn.RestartUnitContext(ctx, unitName(unit), "replace", result); err != nil {
+		return err
+	}
+	select {
+	case r := <-result:
+		if r != "done" {
+			return fmt.Errorf("%w: %s %s", errUnitRestartFailed, unit, r)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *systemdServiceManager) ActiveState(ctx context.Context, unit string) (string, error) {
+	conn, err := systemd.NewSystemConnectionContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	prop, err := conn.GetUnitPropertyContext(ctx, unitName(unit), "ActiveState")
+	if err != nil {
+		return "", err
+	}
+	state, ok := prop.Value.Value().(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected ActiveState value for %s: %v", unit, prop.Value)
+	}
+	return state, nil
+}
+
+// systemctlServiceManager shells out to systemctl, for hosts without access to the system bus.
+type systemctlServiceManager struct{}
+
+func (m *systemctlServiceManager) Restart(ctx context.Context, unit string) error {
+	out, err := exec.CommandContext(ctx, "systemctl", "restart", unit).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: systemctl restart %s: %v: %s", errUnitRestartFailed, unit, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (m *systemctlServiceManager) ActiveState(ctx context.Context, unit string) (string, error) {
+	// is-active exits non-zero for any state other than active but still prints the state
+	out, err := exec.CommandContext(ctx, "systemctl", "is-active", unit).Output()
+	state := strings.TrimSpace(string(out))
+	if state == "" && err != nil {
+		return "", err
+	}
+	return state, nil
+}
+
+// waitForActive polls the unit until it reports active, fails, or the timeout elapses.
+func waitForActive(ctx context.Context, manager ServiceManager, unit string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	state := ""
+	for {
+		s, err := manager.ActiveState(ctx, unit)
+		if err == nil {
+			state = s
+			switch state {
+			case unitActiveState:
+				return nil
+			case unitFailedState:
+				return fmt.Errorf("%w: %s is %s", errUnitNotActive, unit, state)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %s is %q after %v", errUnitNotActive, unit, state, timeout)
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package update_module
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.viam.com/rdk/logging"
+)
+
+// fakeServiceManager records restarts and replays a sequence of ActiveState results
+type fakeServiceManager struct {
+	mu         sync.Mutex
+	restartErr error
+	states     []string
+	restarts   []string
+}
+
+func (m *fakeServiceManager) Restart(ctx context.Context, unit string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.restarts = append(m.restarts, unit)
+	return m.restartErr
+}
+
+func (m *fakeServiceManager) ActiveState(ctx context.Context, unit string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.states) == 0 {
+		return unitActiveState, nil
+	}
+	state := m.states[0]
+	if len(m.states) > 1 {
+		m.states = m.states[1:]
+	}
+	return state, nil
+}
+
+func (m *fakeServiceManager) restartCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.restarts)
+}
+
+func TestRestartCommand(t *testing.T) {
+	logger := logging.NewTestLogger(t)
+	ctx := context.Background()
+
+	manager := &fakeServiceManager{states: []string{"activating", unitActiveState}}
+	module := RobotUpdateModule{logger: logger, ctx: ctx, cfg: &Config{ServiceUnit: "viam-server"}, serviceManager: manager}
+	resp, err := module.DoCommand(ctx, map[string]interface{}{"command": "restart", "delay_seconds": 0})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, resp["ok"])
+	assert.Equal(t, []string{"viam-server"}, manager.restarts)
+
+	restartErr := errors.New("access denied")
+	manager = &fakeServiceManager{restartErr: restartErr}
+	module = RobotUpdateModule{logger: logger, ctx: ctx, serviceManager: manager}
+	resp, err = module.DoCommand(ctx, map[string]interface{}{"command": "restart", "delay_seconds": 0})
+	assert.ErrorIs(t, err, restartErr)
+	assert.NotContains(t, resp, "ok")
+	assert.Equal(t, []string{defaultServiceUnit}, manager.restarts)
+
+	manager = &fakeServiceManager{states: []string{unitFailedState}}
+	module = RobotUpdateModule{logger: logger, ctx: ctx, serviceManager: manager}
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "restart", "delay_seconds": 0})
+	assert.ErrorIs(t, err, errUnitNotActive)
+}
+
+func TestNewServiceManager(t *testing.T) {
+	m, err := newServiceManager("")
+	assert.NoError(t, err)
+	assert.IsType(t, &systemdServiceManager{}, m)
+
+	m, err = newServiceManager(serviceManagerSystemctl)
+	assert.NoError(t, err)
+	assert.IsType(t, &systemctlServiceManager{}, m)
+
+	_, err = newServiceManager("upstart")
+	assert.ErrorIs(t, err, errUnknownServiceManager)
+
+	assert.Equal(t, "viam-agent.service", unitName("viam-agent"))
+	assert.Equal(t, "viam-agent.service", unitName("viam-agent.service"))
+}
@@ -0,0 +1,355 @@
+package update_module
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// minisign keys and signatures start with their algorithm, "Ed", signatures over a BLAKE2b-512 hash of
+	// the file use "ED"
+	minisignAlg        = "Ed"
+	minisignPrehashAlg = "ED"
+	minisignKeyIdLen   = 8
+	minisignKeyLen     = 2 + minisignKeyIdLen + ed25519.PublicKeySize
+	minisignSigLen     = 2 + minisignKeyIdLen + ed25519.SignatureSize
+
+	// maxUnhashedSignedSize caps the files raw ed25519 and legacy minisign signatures are checked against,
+	// as those sign the whole file and it is read into memory. Binaries need prehashed signatures.
+	maxUnhashedSignedSize = 16 << 20
+
+	untrustedCommentPrefix = "untrusted comment:"
+	trustedCommentPrefix   = "trusted comment: "
+)
+
+var (
+	// signatureSuffixes are the detached signature files looked for next to an artifact
+	signatureSuffixes = []string{".minisig", ".sig"}
+
+	errInvalidSignature    = errors.New("invalid signature")
+	errArtifactUnsigned    = errors.New("artifact is not signed and signing_keys are configured")
+	errArtifactSignature   = errors.New("artifact signature does not match any of the signing keys")
+	errArtifactChecksum    = errors.New("artifact checksum mismatch")
+	errInvalidChecksumSpec = errors.New("sha256 must be 64 hex characters")
+	errViamServerChanged   = errors.New("viam-server changed since it was verified")
+)
+
+// signingKey is a trusted ed25519 public key, a minisign key also has the id signatures name it by
+type signingKey struct {
+	id  []byte
+	key ed25519.PublicKey
+}
+
+func (k *signingKey) String() string {
+	if k.id == nil {
+		return "ed25519 key " + base64.StdEncoding.EncodeToString(k.key)[:8]
+	}
+	return fmt.Sprintf("minisign key %X", reverse(k.id))
+}
+
+// reverse returns the minisign key id in the byte order minisign prints it
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+// lastLine returns the last line of a minisign file that isn't a comment, or s itself
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		if l := strings.TrimSpace(lines[i]); l != "" && !strings.HasPrefix(l, untrustedCommentPrefix) {
+			return l
+		}
+	}
+	return ""
+}
+
+// parseSigningKey reads a base64 ed25519 public key or a minisign public key, with or without its
+// untrusted comment line
+func parseSigningKey(key string) (*signingKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(lastLine(key))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidSigningKey, err)
+	}
+	switch {
+	case len(raw) == ed25519.PublicKeySize:
+		return &signingKey{key: ed25519.PublicKey(raw)}, nil
+	case len(raw) == minisignKeyLen && string(raw[:2]) == minisignAlg:
+		return &signingKey{id: raw[2 : 2+minisignKeyIdLen], key: ed25519.PublicKey(raw[2+minisignKeyIdLen:])}, nil
+	}
+	return nil, fmt.Errorf("%w: not an ed25519 or minisign public key", errInvalidSigningKey)
+}
+
+func parseSigningKeys(keys []string) ([]*signingKey, error) {
+	parsed := make([]*signingKey, 0, len(keys))
+	for _, k := range keys {
+		key, err := parseSigningKey(k)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, key)
+	}
+	return parsed, nil
+}
+
+// detachedSignature is a raw ed25519 signature, base64 or not, or a minisign signature file
+type detachedSignature struct {
+	alg            string
+	keyId          []byte
+	sig            []byte
+	trustedComment string
+	globalSig      []byte
+}
+
+func parseSignature(data []byte) (*detachedSignature, error) {
+	if len(data) == ed25519.SignatureSize {
+		return &detachedSignature{sig: data}, nil
+	}
+	text := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(text, untrustedCommentPrefix) {
+		raw, err := base64.StdEncoding.DecodeString(text)
+		if err != nil || len(raw) != ed25519.SignatureSize {
+			return nil, fmt.Errorf("%w: not an ed25519 or minisign signature", errInvalidSignature)
+		}
+		return &detachedSignature{sig: raw}, nil
+	}
+
+	lines := strings.Split(text, "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[2], trustedCommentPrefix) {
+		return nil, fmt.Errorf("%w: malformed minisign signature", errInvalidSignature)
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(raw) != minisignSigLen {
+		return nil, fmt.Errorf("%w: malformed minisign signature", errInvalidSignature)
+	}
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("%w: malformed minisign global signature", errInvalidSignature)
+	}
+	s := &detachedSignature{
+		alg:            string(raw[:2]),
+		keyId:          raw[2 : 2+minisignKeyIdLen],
+		sig:            raw[2+minisignKeyIdLen:],
+		trustedComment: strings.TrimSuffix(strings.TrimPrefix(lines[2], trustedCommentPrefix), "\r"),
+		globalSig:      global,
+	}
+	if s.alg != minisignAlg && s.alg != minisignPrehashAlg {
+		return nil, fmt.Errorf("%w: unknown minisign algorithm %q", errInvalidSignature, s.alg)
+	}
+	return s, nil
+}
+
+// verify checks the signature of the contents of r against the keys, returning the key that made it
+func (s *detachedSignature) verify(r io.Reader, keys []*signingKey) (*signingKey, error) {
+	var message []byte
+	var err error
+	if s.alg == minisignPrehashAlg {
+		h, _ := blake2b.New512(nil)
+		if _, err = io.Copy(h, r); err == nil {
+			message = h.Sum(nil)
+		}
+	} else {
+		message, err = io.ReadAll(io.LimitReader(r, maxUnhashedSignedSize+1))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(message) > maxUnhashedSignedSize {
+		return nil, fmt.Errorf("%w: files over %d bytes need a prehashed minisign signature (minisign -H)", errInvalidSignature, maxUnhashedSignedSize)
+	}
+	for _, k := range keys {
+		// minisign signatures name their key, raw ed25519 signatures are tried with every key
+		if s.keyId != nil && !bytes.Equal(s.keyId, k.id) {
+			continue
+		}
+		if !ed25519.Verify(k.key, message, s.sig) {
+			continue
+		}
+		if s.keyId != nil && !ed25519.Verify(k.key, append(append([]byte{}, s.sig...), s.trustedComment...), s.globalSig) {
+			return nil, fmt.Errorf("%w: the trusted comment was altered", errInvalidSignature)
+		}
+		return k, nil
+	}
+	return nil, errArtifactSignature
+}
+
+// verifySignature checks a detached signature of the contents of r
+func verifySignature(r io.Reader, sigData []byte, keys []string) (*signingKey, error) {
+	parsed, err := parseSigningKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+	if len(parsed) == 0 {
+		return nil, errNoSigningKeys
+	}
+	sig, err := parseSignature(sigData)
+	if err != nil {
+		return nil, err
+	}
+	return sig.verify(r, parsed)
+}
+
+// artifactCheck is what an artifact is checked against before the module activates it. Without keys
+// and a checksum there is nothing to check.
+type artifactCheck struct {
+	// Sha256 is the expected hex digest, empty skips the checksum
+	Sha256 string
+	// Signature is a detached signature, by default read from a .minisig or .sig file next to the artifact
+	Signature []byte
+	Keys      []string
+}
+
+// verifyArtifact checks the checksum and signature of the file at path. With signing keys configured an
+// artifact without a valid signature is refused.
+func verifyArtifact(path string, check artifactCheck) (map[string]interface{}, error) {
+	result := map[string]interface{}{"path": path}
+	if check.Sha256 != "" {
+		if _, err := hex.DecodeString(check.Sha256); err != nil || len(check.Sha256) != 2*sha256.Size {
+			return nil, errInvalidChecksumSpec
+		}
+		sum, err := fileSha256(path)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.EqualFold(sum, check.Sha256) {
+			return nil, fmt.Errorf("%w: %s has sha256 %s, expected %s", errArtifactChecksum, filepath.Base(path), sum, strings.ToLower(check.Sha256))
+		}
+		result["sha256"] = sum
+	}
+	if len(check.Keys) == 0 {
+		return result, nil
+	}
+
+	sig := check.Signature
+	if len(sig) == 0 {
+		for _, suffix := range signatureSuffixes {
+			data, err := os.ReadFile(path + suffix)
+			if err == nil {
+				sig = data
+				break
+			}
+			if !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+		}
+	}
+	if len(sig) == 0 {
+		return nil, fmt.Errorf("%w: no signature given or found next to %s", errArtifactUnsigned, path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	key, err := verifySignature(f, sig, check.Keys)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	result["signed_by"] = key.String()
+	return result, nil
+}
+
+// artifactCheckFromRequest reads the optional sha256 and signature of the command
+func (b *RobotUpdateModule) artifactCheckFromRequest(cmd map[string]interface{}) artifactCheck {
+	check := artifactCheck{Keys: b.signingKeys()}
+	check.Sha256, _ = cmd["sha256"].(string)
+	if sig, ok := cmd["signature"].(string); ok {
+		check.Signature = []byte(sig)
+	}
+	return check
+}
+
+// verifyViamServer checks the binary viamServerBinary points at before viam-agent is restarted into it
+func (b *RobotUpdateModule) verifyViamServer(cmd map[string]interface{}) (map[string]interface{}, error) {
+	target, err := filepath.EvalSymlinks(viamServerBinary)
+	if err != nil {
+		return nil, err
+	}
+	result, err := verifyArtifact(target, b.artifactCheckFromRequest(cmd))
+	b.mu.Lock()
+	b.viamServerVerifyErr = err
+	b.mu.Unlock()
+	return result, err
+}
+
+// viamServerCheck returns the check a restart into the viam-server verified at target makes when it
+// fires. viam-agent can move the link while the restart waits, so the link must still point at target
+// and target must still verify.
+func (b *RobotUpdateModule) viamServerCheck(cmd map[string]interface{}, target string) func() error {
+	check := b.artifactCheckFromRequest(cmd)
+	return func() error {
+		current, err := filepath.EvalSymlinks(viamServerBinary)
+		if err != nil {
+			return err
+		}
+		if current != target {
+			return fmt.Errorf("%w: %s points at %s, not %s", errViamServerChanged, viamServerBinary, current, target)
+		}
+		_, err = verifyArtifact(target, check)
+		if err != nil {
+			b.mu.Lock()
+			b.viamServerVerifyErr = err
+			b.mu.Unlock()
+		}
+		return err
+	}
+}
+
+// refuseViamServer handles a viam-server that failed verification. viam-agent has already pointed
+// viamServerBinary at it, so the link goes back to previous when that is another binary that is still
+// there. viam-agent can point it at the new version again on its next update check, and a restart by
+// anything else runs it, so the failure stays in the status until a viam-server verifies and is sent as
+// an update_failed event.
+func (b *RobotUpdateModule) refuseViamServer(version, previous string, err error) map[string]interface{} {
+	resp := map[string]interface{}{"error": err.Error()}
+	params := map[string]string{"viam_server_version": version}
+	if _, statErr := os.Stat(previous); statErr == nil && !strings.Contains(previous, version) {
+		if rollbackErr := replaceSymlink(previous, viamServerBinary); rollbackErr != nil {
+			b.logger.Errorf("Error pointing %s back at %s: %v", viamServerBinary, previous, rollbackErr)
+			resp["rollback_error"] = rollbackErr.Error()
+		} else {
+			b.logger.Warnf("Pointed %s back at %s", viamServerBinary, previous)
+			resp["rolled_back_to"] = previous
+			params["rolled_back_to"] = previous
+		}
+	} else {
+		b.logger.Warnf("%s still points at the unverified viam-server %s", viamServerBinary, version)
+	}
+	b.notify(eventUpdateFailed, params, err)
+	return resp
+}
+
+// verifyArtifactCommand handles the verify_artifact command, checking the file at path against sha256
+// and signature or the signature file next to it
+func (b *RobotUpdateModule) verifyArtifactCommand(cmd map[string]interface{}) (map[string]interface{}, error) {
+	path, _ := cmd["path"].(string)
+	if path == "" {
+		err := errors.New("no artifact path provided")
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	check := b.artifactCheckFromRequest(cmd)
+	if check.Sha256 == "" && len(check.Keys) == 0 {
+		err := fmt.Errorf("%w, give a sha256 to check", errNoSigningKeys)
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	result, err := verifyArtifact(path, check)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	result["ok"] = 1
+	return result, nil
+}
@@ -0,0 +1,182 @@
+package update_module
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.viam.com/rdk/logging"
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisignKey is a minisign key pair, publicKey is in the format of a minisign .pub file
+type minisignKey struct {
+	id        []byte
+	priv      ed25519.PrivateKey
+	publicKey string
+}
+
+func newMinisignKey(t *testing.T) *minisignKey {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	id := make([]byte, minisignKeyIdLen)
+	_, err = rand.Read(id)
+	require.NoError(t, err)
+	raw := append(append([]byte(minisignAlg), id...), pub...)
+	return &minisignKey{id: id, priv: priv, publicKey: "untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(raw) + "\n"}
+}
+
+// sign returns a prehashed minisign signature of data, as minisign -S writes it
+func (k *minisignKey) sign(data []byte, trustedComment string) []byte {
+	hash := blake2b.Sum512(data)
+	sig := ed25519.Sign(k.priv, hash[:])
+	global := ed25519.Sign(k.priv, append(append([]byte{}, sig...), trustedComment...))
+	raw := append(append([]byte(minisignPrehashAlg), k.id...), sig...)
+	return []byte("untrusted comment: signature from minisign secret key\n" +
+		base64.StdEncoding.EncodeToString(raw) + "\n" +
+		trustedCommentPrefix + trustedComment + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n")
+}
+
+func TestVerifySignature(t *testing.T) {
+	data := []byte("viam-server")
+	key := newMinisignKey(t)
+	other := newMinisignKey(t)
+	rawPub, rawPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	keys := []string{base64.StdEncoding.EncodeToString(rawPub), key.publicKey}
+
+	signer, err := verifySignature(bytes.NewReader(data), key.sign(data, "timestamp:1"), keys)
+	require.NoError(t, err)
+	assert.Contains(t, signer.String(), "minisign key")
+	signer, err = verifySignature(bytes.NewReader(data), []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(rawPriv, data))), keys)
+	require.NoError(t, err)
+	assert.Contains(t, signer.String(), "ed25519 key")
+	_, err = verifySignature(bytes.NewReader(data), ed25519.Sign(rawPriv, data), keys)
+	assert.NoError(t, err)
+	// files signed whole are only read up to a size
+	large := make([]byte, maxUnhashedSignedSize+1)
+	_, err = verifySignature(bytes.NewReader(large), ed25519.Sign(rawPriv, large), keys)
+	assert.ErrorIs(t, err, errInvalidSignature)
+	_, err = verifySignature(bytes.NewReader(large), key.sign(large, "timestamp:1"), keys)
+	assert.NoError(t, err)
+
+	_, err = verifySignature(bytes.NewReader([]byte("something else")), key.sign(data, "timestamp:1"), keys)
+	assert.ErrorIs(t, err, errArtifactSignature)
+	_, err = verifySignature(bytes.NewReader(data), other.sign(data, "timestamp:1"), keys)
+	assert.ErrorIs(t, err, errArtifactSignature)
+	altered := bytes.Replace(key.sign(data, "timestamp:1"), []byte("timestamp:1"), []byte("timestamp:2"), 1)
+	_, err = verifySignature(bytes.NewReader(data), altered, keys)
+	assert.ErrorIs(t, err, errInvalidSignature)
+	_, err = verifySignature(bytes.NewReader(data), []byte("not a signature"), keys)
+	assert.ErrorIs(t, err, errInvalidSignature)
+	_, err = verifySignature(bytes.NewReader(data), key.sign(data, ""), nil)
+	assert.ErrorIs(t, err, errNoSigningKeys)
+
+	_, err = (&Config{SigningKeys: []string{key.publicKey}}).Validate("path")
+	assert.NoError(t, err)
+}
+
+func TestVerifyArtifact(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "viam-server-v0.50.0-x86_64")
+	data := []byte("viam-server 0.50.0")
+	require.NoError(t, os.WriteFile(path, data, 0o755))
+	key := newMinisignKey(t)
+	sum := sha256Hex(data)
+
+	// without keys only the checksum is checked
+	result, err := verifyArtifact(path, artifactCheck{Sha256: sum})
+	require.NoError(t, err)
+	assert.Equal(t, sum, result["sha256"])
+	_, err = verifyArtifact(path, artifactCheck{Sha256: sha256Hex([]byte("other"))})
+	assert.ErrorIs(t, err, errArtifactChecksum)
+	_, err = verifyArtifact(path, artifactCheck{Sha256: "abc"})
+	assert.ErrorIs(t, err, errInvalidChecksumSpec)
+
+	// with keys an unsigned artifact is refused
+	_, err = verifyArtifact(path, artifactCheck{Keys: []string{key.publicKey}})
+	assert.ErrorIs(t, err, errArtifactUnsigned)
+	result, err = verifyArtifact(path, artifactCheck{Keys: []string{key.publicKey}, Signature: key.sign(data, "c")})
+	require.NoError(t, err)
+	assert.Contains(t, result["signed_by"], "minisign key")
+
+	// the signature file next to the artifact is used by default
+	require.NoError(t, os.WriteFile(path+".minisig", key.sign(data, "c"), 0o644))
+	_, err = verifyArtifact(path, artifactCheck{Keys: []string{key.publicKey}, Sha256: sum})
+	require.NoError(t, err)
+
+	// viam-server is checked where the symlink points
+	defer func(binary string) { viamServerBinary = binary }(viamServerBinary)
+	viamServerBinary = filepath.Join(dir, "viam-server")
+	require.NoError(t, os.Symlink(path, viamServerBinary))
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), cfg: &Config{SigningKeys: []string{key.publicKey}}}
+	result, err = module.verifyViamServer(map[string]interface{}{})
+	require.NoError(t, err)
+	assert.Equal(t, path, result["path"])
+	require.NoError(t, os.WriteFile(path, []byte("tampered"), 0o755))
+	_, err = module.verifyViamServer(map[string]interface{}{})
+	assert.ErrorIs(t, err, errArtifactSignature)
+	assert.ErrorIs(t, module.viamServerVerifyErr, errArtifactSignature)
+
+	// a viam-server that fails verification is replaced by the binary the link pointed at before
+	previous := filepath.Join(dir, "viam-server-v0.49.0-x86_64")
+	require.NoError(t, os.WriteFile(previous, []byte("viam-server 0.49.0"), 0o755))
+	resp := module.refuseViamServer("0.50.0", previous, err)
+	assert.Equal(t, previous, resp["rolled_back_to"])
+	link, err := os.Readlink(viamServerBinary)
+	require.NoError(t, err)
+	assert.Equal(t, previous, link)
+	events, _, _ := module.events.since(0)
+	assert.Equal(t, []string{eventUpdateFailed}, busEventTypes(events))
+	// without another binary to go back to the link is left alone
+	require.NoError(t, replaceSymlink(path, viamServerBinary))
+	resp = module.refuseViamServer("0.50.0", filepath.Join(dir, "missing"), errArtifactSignature)
+	assert.NotContains(t, resp, "rolled_back_to")
+	link, err = os.Readlink(viamServerBinary)
+	require.NoError(t, err)
+	assert.Equal(t, path, link)
+
+	resp, err = module.doCommand(context.Background(), map[string]interface{}{"command": "verify_artifact", "path": path, "signature": string(key.sign([]byte("tampered"), "c"))})
+	require.NoError(t, err)
+	assert.Equal(t, 1, resp["ok"])
+	module.cfg.SigningKeys = nil
+	_, err = module.doCommand(context.Background(), map[string]interface{}{"command": "verify_artifact", "path": path})
+	assert.ErrorIs(t, err, errNoSigningKeys)
+}
+
+func TestViamServerCheck(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "viam-server-v0.50.0-x86_64")
+	data := []byte("viam-server 0.50.0")
+	require.NoError(t, os.WriteFile(path, data, 0o755))
+	other := filepath.Join(dir, "viam-server-v0.51.0-x86_64")
+	require.NoError(t, os.WriteFile(other, []byte("viam-server 0.51.0"), 0o755))
+	defer func(binary string) { viamServerBinary = binary }(viamServerBinary)
+	viamServerBinary = filepath.Join(dir, "viam-server")
+	require.NoError(t, os.Symlink(path, viamServerBinary))
+
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), cfg: &Config{}}
+	cmd := map[string]interface{}{"sha256": sha256Hex(data)}
+	result, err := module.verifyViamServer(cmd)
+	require.NoError(t, err)
+	check := module.viamServerCheck(cmd, result["path"].(string))
+	require.NoError(t, check())
+
+	// viam-agent moved the link to another version after it was verified
+	require.NoError(t, replaceSymlink(other, viamServerBinary))
+	assert.ErrorIs(t, check(), errViamServerChanged)
+
+	// the verified binary was replaced in place
+	require.NoError(t, replaceSymlink(path, viamServerBinary))
+	require.NoError(t, os.WriteFile(path, []byte("viam-server 0.50.1"), 0o755))
+	assert.ErrorIs(t, check(), errArtifactChecksum)
+	assert.ErrorIs(t, module.viamServerVerifyErr, errArtifactChecksum)
+}
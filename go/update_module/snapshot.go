@@ -0,0 +1,488 @@
+package update_module
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	data_proto "go.viam.com/api/app/data/v1"
+	datasync_proto "go.viam.com/api/app/datasync/v1"
+	app_proto "go.viam.com/api/app/v1"
+	"go.viam.com/utils/rpc"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	snapshotsDir             = "snapshots"
+	defaultSnapshotRetention = 20
+	// snapshotTag tags snapshots uploaded to a dataset so they can be found in the data tab
+	snapshotTag = "config-snapshot"
+
+	snapshotReasonManual     = "manual"
+	snapshotReasonPreRestore = "pre_restore"
+)
+
+var (
+	// newDataClients creates the data clients on the app connection, tests replace it
+	newDataClients = func(conn rpc.ClientConn) (datasync_proto.DataSyncServiceClient, data_proto.DataServiceClient) {
+		return datasync_proto.NewDataSyncServiceClient(conn), data_proto.NewDataServiceClient(conn)
+	}
+
+	snapshotIdPattern = regexp.MustCompile(`^[0-9A-Za-z-]+$`)
+
+	errSnapshotIdMissing     = errors.New("no snapshot id provided")
+	errSnapshotNotFound      = errors.New("snapshot not found")
+	errSnapshotExists        = errors.New("snapshot already exists")
+	errSnapshotPartMismatch  = errors.New("snapshot was taken from another part")
+	errNoAppConnForSnapshots = errors.New("no app connection to upload the snapshot with")
+)
+
+// configSnapshot is a part config saved by snapshot_config, stored as JSON in the snapshots directory
+type configSnapshot struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	PartId    string    `json:"part_id"`
+	PartName  string    `json:"part_name"`
+	Label     string    `json:"label,omitempty"`
+	// Reason is manual for snapshot_config, pre_restore for the snapshot taken before a restore
+	Reason string `json:"reason"`
+	Hash   string `json:"hash"`
+	// FragmentId, DatasetId and DatasetFileId are set when the snapshot was also stored in app
+	FragmentId    string                 `json:"fragment_id,omitempty"`
+	DatasetId     string                 `json:"dataset_id,omitempty"`
+	DatasetFileId string                 `json:"dataset_file_id,omitempty"`
+	Config        map[string]interface{} `json:"config"`
+}
+
+func (s *configSnapshot) metadata() map[string]interface{} {
+	m := map[string]interface{}{
+		"id":         s.ID,
+		"created_at": s.CreatedAt.Format(time.RFC3339),
+		"part_id":    s.PartId,
+		"part_name":  s.PartName,
+		"reason":     s.Reason,
+		"hash":       s.Hash,
+	}
+	for k, v := range map[string]string{"label": s.Label, "fragment_id": s.FragmentId, "dataset_id": s.DatasetId, "dataset_file_id": s.DatasetFileId} {
+		if v != "" {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+func (s *configSnapshot) robotConfig() (*structpb.Struct, error) {
+	return structpb.NewStruct(s.Config)
+}
+
+func snapshotBaseline(id string) string {
+	return "snapshot:" + id
+}
+
+func (cfg *Config) snapshotRetention() int {
+	if cfg == nil || cfg.SnapshotRetention == 0 {
+		return defaultSnapshotRetention
+	}
+	return cfg.SnapshotRetention
+}
+
+func (cfg *Config) snapshotMaxAge() time.Duration {
+	if cfg == nil {
+		return 0
+	}
+	return time.Duration(cfg.SnapshotMaxAgeDays) * 24 * time.Hour
+}
+
+func snapshotPath(id string) (string, error) {
+	if !snapshotIdPattern.MatchString(id) {
+		return "", fmt.Errorf("%w: %q", errSnapshotNotFound, id)
+	}
+	dir, err := dataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, snapshotsDir, id+".json"), nil
+}
+
+// newSnapshot snapshots the part's config, ids sort in the order the snapshots were taken. The random
+// suffix keeps snapshots of the same config taken in the same second apart.
+func newSnapshot(part *app_proto.RobotPart, label, reason string) *configSnapshot {
+	conf := part.GetRobotConfig()
+	if conf == nil {
+		conf = &structpb.Struct{}
+	}
+	hash := configHash(conf)
+	at := time.Now().UTC()
+	return &configSnapshot{
+		ID:        fmt.Sprintf("%s-%s-%s", at.Format("20060102T150405Z"), hash[:8], newEventId()[:8]),
+		CreatedAt: at,
+		PartId:    part.GetId(),
+		PartName:  part.GetName(),
+		Label:     label,
+		Reason:    reason,
+		Hash:      hash,
+		Config:    conf.AsMap(),
+	}
+}
+
+// saveSnapshot writes the snapshot, only replacing a stored snapshot with the same id if replace is set
+func saveSnapshot(s *configSnapshot, replace bool) error {
+	path, err := snapshotPath(s.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if !replace {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_EXCL
+	}
+	f, err := os.OpenFile(path, flags, 0o600)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%w: %s", errSnapshotExists, s.ID)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func loadSnapshot(id string) (*configSnapshot, error) {
+	path, err := snapshotPath(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", errSnapshotNotFound, id)
+	} else if err != nil {
+		return nil, err
+	}
+	var s configSnapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &s, nil
+}
+
+// listSnapshots returns the stored snapshots, newest first. Snapshots that can't be read are skipped.
+func listSnapshots() ([]*configSnapshot, error) {
+	dir, err := dataDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, snapshotsDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var snapshots []*configSnapshot
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || e.IsDir() {
+			continue
+		}
+		if s, err := loadSnapshot(id); err == nil {
+			snapshots = append(snapshots, s)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].CreatedAt.After(snapshots[j].CreatedAt) })
+	return snapshots, nil
+}
+
+// pruneSnapshots removes the snapshots beyond the retention count or older than the max age. The newest
+// snapshot and keep are always kept.
+func (b *RobotUpdateModule) pruneSnapshots(keep string) int {
+	b.mu.Lock()
+	retention, maxAge := b.cfg.snapshotRetention(), b.cfg.snapshotMaxAge()
+	b.mu.Unlock()
+	snapshots, err := listSnapshots()
+	if err != nil {
+		b.logger.Warnf("Error listing snapshots to prune: %v", err)
+		return 0
+	}
+	pruned := 0
+	for i, s := range snapshots {
+		if i == 0 || s.ID == keep || (i < retention && (maxAge == 0 || time.Since(s.CreatedAt) <= maxAge)) {
+			continue
+		}
+		path, err := snapshotPath(s.ID)
+		if err == nil {
+			err = os.Remove(path)
+		}
+		if err != nil {
+			b.logger.Warnf("Error pruning snapshot %s: %v", s.ID, err)
+			continue
+		}
+		pruned++
+	}
+	return pruned
+}
+
+// snapshotConfig handles the snapshot_config command, saving the part config locally and, with
+// fragment_id or dataset_id, in app
+func (b *RobotUpdateModule) snapshotConfig(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	label, _ := cmd["label"].(string)
+	targetFragmentId, _ := cmd["fragment_id"].(string)
+	targetDatasetId, _ := cmd["dataset_id"].(string)
+	client, partId, err := b.partClient(ctx, "snapshot_config", cmd)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	b.publishStep("snapshot_config", "getting robot part")
+	resp, err := client.GetRobotPart(ctx, &app_proto.GetRobotPartRequest{Id: partId})
+	if err = stepError(ctx, "getting robot part", err); err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	s := newSnapshot(resp.GetPart(), label, snapshotReasonManual)
+	if err := saveSnapshot(s, false); err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	b.logger.Infof("Saved part config snapshot %s", s.ID)
+
+	result := map[string]interface{}{}
+	if targetFragmentId != "" {
+		b.publishStep("snapshot_config", "storing in fragment")
+		if err := storeSnapshotInFragment(ctx, client, targetFragmentId, resp.GetPart().GetRobotConfig()); err != nil {
+			b.logger.Errorf("Error storing snapshot %s in fragment %s: %v", s.ID, targetFragmentId, err)
+			result["fragment_error"] = err.Error()
+		} else {
+			s.FragmentId = targetFragmentId
+		}
+	}
+	if targetDatasetId != "" {
+		b.publishStep("snapshot_config", "uploading to dataset")
+		if fileId, err := b.uploadSnapshotToDataset(ctx, client, resp.GetPart(), s, targetDatasetId); err != nil {
+			b.logger.Errorf("Error uploading snapshot %s to dataset %s: %v", s.ID, targetDatasetId, err)
+			result["dataset_error"] = err.Error()
+		} else {
+			s.DatasetId, s.DatasetFileId = targetDatasetId, fileId
+		}
+	}
+	if s.FragmentId != "" || s.DatasetFileId != "" {
+		if err := saveSnapshot(s, true); err != nil {
+			return map[string]interface{}{"error": err.Error()}, err
+		}
+	}
+	result["ok"] = 1
+	result["snapshot"] = s.metadata()
+	result["pruned"] = b.pruneSnapshots(s.ID)
+	return result, nil
+}
+
+// storeSnapshotInFragment replaces the config of an existing fragment with the snapshot
+func storeSnapshotInFragment(ctx context.Context, client app_proto.AppServiceClient, id string, conf *structpb.Struct) error {
+	resp, err := client.GetFragment(ctx, &app_proto.GetFragmentRequest{Id: id})
+	if err != nil {
+		return err
+	}
+	_, err = client.UpdateFragment(ctx, &app_proto.UpdateFragmentRequest{Id: id, Name: resp.GetFragment().GetName(), Config: conf})
+	return err
+}
+
+// uploadSnapshotToDataset uploads the snapshot as a binary file of the part and adds it to the dataset
+func (b *RobotUpdateModule) uploadSnapshotToDataset(ctx context.Context, client app_proto.AppServiceClient, part *app_proto.RobotPart, s *configSnapshot, datasetId string) (string, error) {
+	b.clientsMu.Lock()
+	conn := b.clients.appConn
+	b.clientsMu.Unlock()
+	if conn == nil {
+		return "", errNoAppConnForSnapshots
+	}
+	robot, err := client.GetRobot(ctx, &app_proto.GetRobotRequest{Id: part.GetRobot()})
+	if err != nil {
+		return "", fmt.Errorf("getting robot: %w", err)
+	}
+	locationId := robot.GetRobot().GetLocation()
+	location, err := client.GetLocation(ctx, &app_proto.GetLocationRequest{LocationId: locationId})
+	if err != nil {
+		return "", fmt.Errorf("getting location: %w", err)
+	}
+	var orgId string
+	for _, o := range location.GetLocation().GetOrganizations() {
+		if orgId == "" || o.GetPrimary() {
+			orgId = o.GetOrganizationId()
+		}
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	syncClient, dataClient := newDataClients(conn)
+	now := timestamppb.Now()
+	upload, err := syncClient.DataCaptureUpload(ctx, &datasync_proto.DataCaptureUploadRequest{
+		Metadata: &datasync_proto.UploadMetadata{
+			PartId:        part.GetId(),
+			Type:          datasync_proto.DataType_DATA_TYPE_BINARY_SENSOR,
+			FileName:      s.ID,
+			FileExtension: ".json",
+			Tags:          []string{snapshotTag},
+		},
+		SensorContents: []*datasync_proto.SensorData{{
+			Metadata: &datasync_proto.SensorMetadata{TimeRequested: now, TimeReceived: now},
+			Data:     &datasync_proto.SensorData_Binary{Binary: data},
+		}},
+	})
+	if err != nil {
+		return "", fmt.Errorf("uploading: %w", err)
+	}
+	_, err = dataClient.AddBinaryDataToDatasetByIDs(ctx, &data_proto.AddBinaryDataToDatasetByIDsRequest{
+		BinaryIds: []*data_proto.BinaryID{{FileId: upload.GetFileId(), OrganizationId: orgId, LocationId: locationId}},
+		DatasetId: datasetId,
+	})
+	if err != nil {
+		return "", fmt.Errorf("adding to dataset: %w", err)
+	}
+	return upload.GetFileId(), nil
+}
+
+// listSnapshotsCommand handles the list_snapshots command, the snapshots are listed without their configs
+func (b *RobotUpdateModule) listSnapshotsCommand() (map[string]interface{}, error) {
+	snapshots, err := listSnapshots()
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	list := make([]interface{}, 0, len(snapshots))
+	for _, s := range snapshots {
+		list = append(list, s.metadata())
+	}
+	return map[string]interface{}{"ok": 1, "snapshots": list}, nil
+}
+
+// diffSnapshot handles the diff_snapshot command, comparing the part config, or the snapshot against, to
+// the snapshot id
+func (b *RobotUpdateModule) diffSnapshot(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	id, _ := cmd["id"].(string)
+	if id == "" {
+		return map[string]interface{}{"error": errSnapshotIdMissing.Error()}, errSnapshotIdMissing
+	}
+	snapshot, err := loadSnapshot(id)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	baseline, err := snapshot.robotConfig()
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+
+	report := &driftReport{at: time.Now(), baseline: snapshotBaseline(id)}
+	var current *structpb.Struct
+	against, _ := cmd["against"].(string)
+	if against != "" {
+		other, err := loadSnapshot(against)
+		if err != nil {
+			return map[string]interface{}{"error": err.Error()}, err
+		}
+		report.partId = other.PartId
+		if current, err = other.robotConfig(); err != nil {
+			return map[string]interface{}{"error": err.Error()}, err
+		}
+	} else {
+		client, partId, err := b.partClient(ctx, "diff_snapshot", cmd)
+		if err != nil {
+			return map[string]interface{}{"error": err.Error()}, err
+		}
+		report.partId = partId
+		resp, err := client.GetRobotPart(ctx, &app_proto.GetRobotPartRequest{Id: partId})
+		if err = stepError(ctx, "getting robot part", err); err != nil {
+			return map[string]interface{}{"error": err.Error()}, err
+		}
+		if current = resp.GetPart().GetRobotConfig(); current == nil {
+			current = &structpb.Struct{}
+		}
+		against = "current"
+	}
+	report.drift = compareConfigs(baseline, current)
+	resp := report.toMap()
+	resp["against"] = against
+	return resp, nil
+}
+
+// restoreSnapshot handles the restore_snapshot command. The part's config is snapshotted first, then the
+// snapshot is written with the same checks and hooks as update.
+func (b *RobotUpdateModule) restoreSnapshot(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	id, _ := cmd["id"].(string)
+	if id == "" {
+		return map[string]interface{}{"error": errSnapshotIdMissing.Error()}, errSnapshotIdMissing
+	}
+	snapshot, err := loadSnapshot(id)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	conf, err := snapshot.robotConfig()
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	params := map[string]string{"snapshot_id": id}
+	resp, err := b.restoreSnapshotToPart(ctx, cmd, snapshot, conf)
+	if err := responseError(resp, err); err != nil {
+		b.notify(eventUpdateFailed, params, err)
+	} else {
+		b.notify(eventSnapshotRestored, params, nil)
+	}
+	return resp, err
+}
+
+func (b *RobotUpdateModule) restoreSnapshotToPart(ctx context.Context, cmd map[string]interface{}, snapshot *configSnapshot, conf *structpb.Struct) (map[string]interface{}, error) {
+	client, partId, err := b.partClient(ctx, "restore_snapshot", cmd)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	if snapshot.PartId != partId {
+		err := fmt.Errorf("%w: %s, not %s", errSnapshotPartMismatch, snapshot.PartId, partId)
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	part, err := client.GetRobotPart(ctx, &app_proto.GetRobotPartRequest{Id: partId})
+	if err = stepError(ctx, "getting robot part", err); err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	op := operation{Command: "restore_snapshot", Params: map[string]string{"snapshot_id": snapshot.ID}}
+	resp, err := b.restorePartConfig(ctx, client, part.GetPart().GetRobot(), op, conf, "before restoring "+snapshot.ID, snapshot.ID)
+	resp["snapshot_id"] = snapshot.ID
+	return resp, err
+}
+
+// restorePartConfig writes conf to the part with updatePartConfig, running the operation's hooks around
+// it. The config it replaces is snapshotted first, keep is a snapshot that must survive the pruning after.
+func (b *RobotUpdateModule) restorePartConfig(ctx context.Context, client app_proto.AppServiceClient, robotId string, op operation, conf *structpb.Struct, label, keep string) (map[string]interface{}, error) {
+	b.publishStep(op.Command, "running pre hooks")
+	if err := stepError(ctx, "running pre hooks", b.runHooks(ctx, hookStagePre, op, nil)); err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	var before *configSnapshot
+	b.publishStep(op.Command, "writing part config")
+	resp, err := b.updatePartConfig(ctx, client, robotId, func(part *app_proto.RobotPart) (*structpb.Struct, error) {
+		before = newSnapshot(part, label, snapshotReasonPreRestore)
+		if err := saveSnapshot(before, false); err != nil {
+			return nil, fmt.Errorf("saving the current config: %w", err)
+		}
+		return conf, nil
+	})
+	b.publishStep(op.Command, "running post hooks")
+	if hookErr := stepError(ctx, "running post hooks", b.runHooks(ctx, hookStagePost, op, err)); hookErr != nil && err == nil {
+		resp["post_hook_error"] = hookErr.Error()
+	}
+	if before != nil {
+		resp["pre_restore_snapshot_id"] = before.ID
+		b.pruneSnapshots(keep)
+	}
+	return resp, err
+}
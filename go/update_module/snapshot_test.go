@@ -0,0 +1,188 @@
+package update_module
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	data_proto "go.viam.com/api/app/data/v1"
+	datasync_proto "go.viam.com/api/app/datasync/v1"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/utils/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// fakeDataClients record the snapshots uploaded to datasets, methods they don't implement panic
+type fakeDataClients struct {
+	datasync_proto.DataSyncServiceClient
+	data_proto.DataServiceClient
+
+	uploads  []*datasync_proto.DataCaptureUploadRequest
+	datasets map[string][]*data_proto.BinaryID
+}
+
+func (f *fakeDataClients) DataCaptureUpload(ctx context.Context, in *datasync_proto.DataCaptureUploadRequest, opts ...grpc.CallOption) (*datasync_proto.DataCaptureUploadResponse, error) {
+	f.uploads = append(f.uploads, in)
+	return &datasync_proto.DataCaptureUploadResponse{FileId: "file-1"}, nil
+}
+
+func (f *fakeDataClients) AddBinaryDataToDatasetByIDs(ctx context.Context, in *data_proto.AddBinaryDataToDatasetByIDsRequest, opts ...grpc.CallOption) (*data_proto.AddBinaryDataToDatasetByIDsResponse, error) {
+	f.datasets[in.DatasetId] = append(f.datasets[in.DatasetId], in.BinaryIds...)
+	return &data_proto.AddBinaryDataToDatasetByIDsResponse{}, nil
+}
+
+func snapshotIds(t *testing.T) []string {
+	snapshots, err := listSnapshots()
+	require.NoError(t, err)
+	var ids []string
+	for _, s := range snapshots {
+		ids = append(ids, s.ID)
+	}
+	return ids
+}
+
+func TestSnapshots(t *testing.T) {
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	ctx := context.Background()
+	client := newFakeFleetClient()
+	client.addMachine(t, "loc", "robot", "base")
+	client.fragmentConfigs["backup"] = &structpb.Struct{}
+	data := &fakeDataClients{datasets: map[string][]*data_proto.BinaryID{}}
+	defer func(f func(rpc.ClientConn) (datasync_proto.DataSyncServiceClient, data_proto.DataServiceClient)) {
+		newDataClients = f
+	}(newDataClients)
+	newDataClients = func(rpc.ClientConn) (datasync_proto.DataSyncServiceClient, data_proto.DataServiceClient) {
+		return data, data
+	}
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: ctx, cfg: partTestConfig()}
+	usePartClient(t, &module, client)
+
+	resp, err := module.doCommand(ctx, map[string]interface{}{"command": "snapshot_config", "label": "before upgrade", "fragment_id": "backup", "dataset_id": "configs"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, resp["ok"])
+	first := resp["snapshot"].(map[string]interface{})
+	id := first["id"].(string)
+	assert.Equal(t, "before upgrade", first["label"])
+	assert.Equal(t, "robot-main", first["part_id"])
+	assert.Equal(t, "backup", first["fragment_id"])
+	assert.Equal(t, "file-1", first["dataset_file_id"])
+	assert.Equal(t, []interface{}{"base"}, client.fragmentConfigs["backup"].AsMap()["fragments"])
+	require.Len(t, data.uploads, 1)
+	assert.Equal(t, []string{snapshotTag}, data.uploads[0].Metadata.Tags)
+	assert.Equal(t, "org", data.datasets["configs"][0].OrganizationId)
+	_, err = structpb.NewStruct(resp)
+	assert.NoError(t, err)
+
+	// the part drifts, diff reports it against the snapshot
+	conf, err := structpb.NewStruct(map[string]interface{}{"fragments": []interface{}{"base", "extra"}})
+	require.NoError(t, err)
+	client.parts["robot"][0].RobotConfig = conf
+	resp, err = module.doCommand(ctx, map[string]interface{}{"command": "diff_snapshot", "id": id})
+	require.NoError(t, err)
+	assert.Equal(t, "current", resp["against"])
+	assert.Equal(t, map[string]interface{}{driftExtraFragment: 1}, resp["counts"])
+	report := module.detectDrift(ctx, id, "", map[string]interface{}{})
+	require.NoError(t, report.err)
+	assert.Equal(t, snapshotBaseline(id), report.baseline)
+	assert.Len(t, report.drift, 1)
+
+	// restoring snapshots the drifted config first
+	resp, err = module.doCommand(ctx, map[string]interface{}{"command": "restore_snapshot", "id": id})
+	require.NoError(t, err)
+	assert.Equal(t, 1, resp["ok"])
+	assert.Equal(t, []string{"base"}, client.fragments("robot-main"))
+	before := resp["pre_restore_snapshot_id"].(string)
+	assert.NotEqual(t, id, before)
+	resp, err = module.doCommand(ctx, map[string]interface{}{"command": "diff_snapshot", "id": id, "against": before})
+	require.NoError(t, err)
+	assert.Equal(t, before, resp["against"])
+	assert.Len(t, resp["drift"], 1)
+
+	resp, err = module.doCommand(ctx, map[string]interface{}{"command": "list_snapshots"})
+	require.NoError(t, err)
+	list := resp["snapshots"].([]interface{})
+	require.Len(t, list, 2)
+	assert.Equal(t, before, list[0].(map[string]interface{})["id"])
+	assert.Equal(t, snapshotReasonPreRestore, list[0].(map[string]interface{})["reason"])
+	assert.NotContains(t, list[0], "config")
+
+	events, _, _ := module.events.since(0)
+	assert.Equal(t, eventSnapshotRestored, events[len(events)-1].Type)
+
+	for _, cmd := range []map[string]interface{}{
+		{"command": "restore_snapshot"},
+		{"command": "restore_snapshot", "id": "missing"},
+		{"command": "diff_snapshot", "id": "../credentials"},
+	} {
+		_, err = module.doCommand(ctx, cmd)
+		assert.Error(t, err, cmd)
+	}
+}
+
+func TestRestoreSnapshotChecks(t *testing.T) {
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	ctx := context.Background()
+	client := newFakeFleetClient()
+	client.addMachine(t, "loc", "robot", "base")
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: ctx, cfg: partTestConfig()}
+	usePartClient(t, &module, client)
+
+	// a snapshot of another part is refused
+	other := newSnapshot(client.parts["robot"][0], "", snapshotReasonManual)
+	other.PartId = "other-main"
+	require.NoError(t, saveSnapshot(other, false))
+	_, err := module.doCommand(ctx, map[string]interface{}{"command": "restore_snapshot", "id": other.ID})
+	assert.ErrorIs(t, err, errSnapshotPartMismatch)
+
+	// snapshots of the same config taken together get their own ids, a stored snapshot isn't overwritten
+	again := newSnapshot(client.parts["robot"][0], "", snapshotReasonManual)
+	assert.NotEqual(t, other.ID, again.ID)
+	again.ID = other.ID
+	assert.ErrorIs(t, saveSnapshot(again, false), errSnapshotExists)
+
+	// as is a restore to a machine that isn't online, without touching the part
+	s := newSnapshot(client.parts["robot"][0], "", snapshotReasonManual)
+	s.ID = "offline"
+	require.NoError(t, saveSnapshot(s, false))
+	client.lastAccess["robot"] = time.Now().Add(-time.Hour)
+	_, err = module.doCommand(ctx, map[string]interface{}{"command": "restore_snapshot", "id": "offline"})
+	assert.ErrorIs(t, err, errRobotNotOnline)
+	assert.Empty(t, client.updated)
+	assert.ElementsMatch(t, []string{other.ID, "offline"}, snapshotIds(t))
+
+	// and a restore outside of a maintenance window
+	module.cfg.MaintenanceWindows = []MaintenanceWindow{maintenanceWindowLater()}
+	_, err = module.doCommand(ctx, map[string]interface{}{"command": "restore_snapshot", "id": "offline"})
+	assert.Error(t, err)
+	assert.Empty(t, client.updated)
+}
+
+func TestPruneSnapshots(t *testing.T) {
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	client := newFakeFleetClient()
+	client.addMachine(t, "loc", "robot", "base")
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), cfg: &Config{SnapshotRetention: 2, SnapshotMaxAgeDays: 1}}
+	for i, age := range []time.Duration{0, time.Hour, 2 * time.Hour, 48 * time.Hour} {
+		s := newSnapshot(client.parts["robot"][0], "", snapshotReasonManual)
+		s.ID = []string{"new", "hour", "two-hours", "old"}[i]
+		s.CreatedAt = s.CreatedAt.Add(-age)
+		require.NoError(t, saveSnapshot(s, false))
+	}
+	// two-hours is kept though it is beyond the retention count
+	assert.Equal(t, 1, module.pruneSnapshots("two-hours"))
+	assert.Equal(t, []string{"new", "hour", "two-hours"}, snapshotIds(t))
+
+	// the newest snapshot is kept even when it is too old
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	s := newSnapshot(client.parts["robot"][0], "", snapshotReasonManual)
+	s.CreatedAt = s.CreatedAt.Add(-1000 * time.Hour)
+	require.NoError(t, saveSnapshot(s, false))
+	assert.Equal(t, 0, module.pruneSnapshots(""))
+	assert.Equal(t, []string{s.ID}, snapshotIds(t))
+
+	_, err := (&Config{SnapshotRetention: -1}).Validate("path")
+	assert.Error(t, err)
+}
@@ -0,0 +1,291 @@
+package update_module
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	app_proto "go.viam.com/api/app/v1"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+	"go.viam.com/rdk/robot"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	defaultSoakTime      = 5 * time.Minute
+	defaultMaxLastAccess = 2 * time.Minute
+	// maxLogPages bounds how many pages of error logs a health check reads per part
+	maxLogPages = 10
+)
+
+var (
+	// machineStatus dials the machine and returns the status of its resources, tests replace it
+	machineStatus = func(ctx context.Context, logger logging.Logger, address string, creds *credentials) (robot.MachineStatus, error) {
+		rc, err := dialRobotClient(ctx, logger, address, creds)
+		if err != nil {
+			return robot.MachineStatus{}, err
+		}
+		defer rc.Close(ctx)
+		return rc.MachineStatus(ctx)
+	}
+
+	errInvalidStage      = errors.New("invalid rollout stage")
+	errInvalidHealthGate = errors.New("invalid rollout health gate")
+	errHealthGateFailed  = errors.New("health gate failed")
+)
+
+// rolloutStage ends once machines, or percent of the matched machines, use the new fragment. The
+// machines are then left to soak before the health gates are checked.
+type rolloutStage struct {
+	machines int
+	percent  float64
+	soak     time.Duration
+}
+
+// healthGate is checked on every machine updated so far at the end of each stage
+type healthGate struct {
+	// maxLastAccess is how long ago the machine may have last been seen by app
+	maxLastAccess time.Duration
+	// maxErrorsPerMinute is the error log rate allowed since the machine was updated, when checkErrors
+	maxErrorsPerMinute float64
+	checkErrors        bool
+	// checkResources dials the machine and fails if any resource is unhealthy
+	checkResources bool
+}
+
+// stagePlan is a stage resolved against the number of machines to update, end is exclusive
+type stagePlan struct {
+	end  int
+	soak time.Duration
+}
+
+func stagesFromRequest(cmd map[string]interface{}) ([]rolloutStage, error) {
+	list, ok := cmd["stages"].([]interface{})
+	if !ok {
+		if _, present := cmd["stages"]; present {
+			return nil, fmt.Errorf("%w: stages must be a list", errInvalidStage)
+		}
+		return nil, nil
+	}
+	stages := make([]rolloutStage, 0, len(list))
+	for i, s := range list {
+		m, ok := s.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%w: stage %d must be an object", errInvalidStage, i+1)
+		}
+		stage := rolloutStage{soak: defaultSoakTime}
+		_, hasMachines := m["machines"]
+		_, hasPercent := m["percent"]
+		switch {
+		case hasMachines == hasPercent:
+			return nil, fmt.Errorf("%w: stage %d needs one of machines or percent", errInvalidStage, i+1)
+		case hasMachines:
+			n, err := intFromRequest(m, "machines")
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("%w: stage %d machines must be a positive whole number", errInvalidStage, i+1)
+			}
+			stage.machines = n
+		default:
+			p, err := floatFromRequest(m, "percent")
+			if err != nil || p <= 0 || p > 100 {
+				return nil, fmt.Errorf("%w: stage %d percent must be between 0 and 100", errInvalidStage, i+1)
+			}
+			stage.percent = p
+		}
+		if _, ok := m["soak_seconds"]; ok {
+			d, err := secondsFromRequest(m, "soak_seconds")
+			if err != nil {
+				return nil, fmt.Errorf("%w: stage %d: %w", errInvalidStage, i+1, err)
+			}
+			stage.soak = d
+		}
+		stages = append(stages, stage)
+	}
+	return stages, nil
+}
+
+func healthGateFromRequest(cmd map[string]interface{}) (*healthGate, error) {
+	m, ok := cmd["health"].(map[string]interface{})
+	if !ok {
+		if _, present := cmd["health"]; present {
+			return nil, fmt.Errorf("%w: health must be an object", errInvalidHealthGate)
+		}
+		return nil, nil
+	}
+	gate := &healthGate{maxLastAccess: defaultMaxLastAccess}
+	if _, ok := m["max_last_access_seconds"]; ok {
+		d, err := secondsFromRequest(m, "max_last_access_seconds")
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidHealthGate, err)
+		}
+		gate.maxLastAccess = d
+	}
+	if _, ok := m["max_errors_per_minute"]; ok {
+		rate, err := floatFromRequest(m, "max_errors_per_minute")
+		if err != nil || rate < 0 {
+			return nil, fmt.Errorf("%w: max_errors_per_minute must be a non-negative number", errInvalidHealthGate)
+		}
+		gate.maxErrorsPerMinute = rate
+		gate.checkErrors = true
+	}
+	gate.checkResources, _ = m["check_resources"].(bool)
+	return gate, nil
+}
+
+func floatFromRequest(cmd map[string]interface{}, key string) (float64, error) {
+	switch v := cmd[key].(type) {
+	case float64:
+		return v, nil
+	case int:
+		return float64(v), nil
+	}
+	return 0, fmt.Errorf("%s must be a number", key)
+}
+
+// planStages resolves the stages against n machines. Machines the stages don't reach are updated in a
+// final stage, a rollout without stages is that stage alone.
+func planStages(stages []rolloutStage, n int) []stagePlan {
+	if n == 0 {
+		return nil
+	}
+	var plans []stagePlan
+	done := 0
+	for _, s := range stages {
+		end := s.machines
+		if s.percent > 0 {
+			end = int(math.Ceil(float64(n) * s.percent / 100))
+		}
+		end = min(end, n)
+		if end <= done {
+			continue
+		}
+		plans = append(plans, stagePlan{end: end, soak: s.soak})
+		done = end
+	}
+	if done < n {
+		soak := time.Duration(0)
+		if len(stages) > 0 {
+			soak = defaultSoakTime
+		}
+		plans = append(plans, stagePlan{end: n, soak: soak})
+	}
+	return plans
+}
+
+// checkHealth soaks, then checks the gate on each updated machine, returning the first failure
+func (b *RobotUpdateModule) checkHealth(ctx context.Context, client app_proto.AppServiceClient, req *rolloutRequest, machines []*rolloutMachine, soak time.Duration) error {
+	if soak > 0 {
+		b.publishStep("rollout", fmt.Sprintf("soaking for %v", soak))
+		if err := sleepContext(ctx, soak); err != nil {
+			return stepError(ctx, "soaking", err)
+		}
+	}
+	b.publishStep("rollout", "checking health gates")
+	for _, m := range machines {
+		if m.status == rolloutFailed {
+			return fmt.Errorf("%w: %s: update failed: %w", errHealthGateFailed, m.robot.Name, m.err)
+		}
+		if m.status != rolloutUpdated {
+			continue
+		}
+		if err := b.machineHealth(ctx, client, req, m); err != nil {
+			if ctx.Err() != nil {
+				return stepError(ctx, "checking health gates", err)
+			}
+			m.healthErr = err
+			return fmt.Errorf("%w: %s: %w", errHealthGateFailed, m.robot.Name, err)
+		}
+	}
+	return nil
+}
+
+func (b *RobotUpdateModule) machineHealth(ctx context.Context, client app_proto.AppServiceClient, req *rolloutRequest, m *rolloutMachine) error {
+	gate := req.health
+	if gate.maxLastAccess > 0 {
+		resp, err := client.GetRobot(ctx, &app_proto.GetRobotRequest{Id: m.robot.Id})
+		if err != nil {
+			return err
+		}
+		lastAccess := resp.GetRobot().GetLastAccess()
+		if lastAccess == nil {
+			return errors.New("never seen online")
+		}
+		if since := time.Since(lastAccess.AsTime()); since > gate.maxLastAccess {
+			return fmt.Errorf("last seen %v ago", since.Round(time.Second))
+		}
+	}
+	if gate.checkErrors {
+		minutes := max(time.Since(m.updatedAt).Minutes(), 1)
+		for _, part := range m.parts {
+			count, err := countErrorLogs(ctx, client, part, m.updatedAt)
+			if err != nil {
+				return err
+			}
+			if rate := float64(count) / minutes; rate > gate.maxErrorsPerMinute {
+				return fmt.Errorf("%.1f error logs per minute since the update", rate)
+			}
+		}
+	}
+	if gate.checkResources {
+		if m.address == "" {
+			return errors.New("no address to check resources")
+		}
+		status, err := machineStatus(ctx, b.logger, m.address, req.creds)
+		if err != nil {
+			return fmt.Errorf("getting machine status: %w", err)
+		}
+		var unhealthy []string
+		for _, r := range status.Resources {
+			if r.State == resource.NodeStateUnhealthy {
+				unhealthy = append(unhealthy, r.Name.String())
+			}
+		}
+		if len(unhealthy) > 0 {
+			return fmt.Errorf("unhealthy resources: %s", strings.Join(unhealthy, ", "))
+		}
+	}
+	return nil
+}
+
+// countErrorLogs counts the part's error logs since the time, reading at most maxLogPages pages
+func countErrorLogs(ctx context.Context, client app_proto.AppServiceClient, partId string, since time.Time) (int, error) {
+	count := 0
+	req := &app_proto.GetRobotPartLogsRequest{Id: partId, Levels: []string{"error"}, Start: timestamppb.New(since)}
+	for page := 0; page < maxLogPages; page++ {
+		resp, err := client.GetRobotPartLogs(ctx, req)
+		if err != nil {
+			return 0, err
+		}
+		count += len(resp.GetLogs())
+		if resp.GetNextPageToken() == "" {
+			break
+		}
+		token := resp.GetNextPageToken()
+		req.PageToken = &token
+	}
+	return count, nil
+}
+
+// rollbackRollout swaps the old fragment back on every machine the rollout updated, including machines
+// that failed after some of their parts were updated
+func (b *RobotUpdateModule) rollbackRollout(ctx context.Context, client app_proto.AppServiceClient, req *rolloutRequest, machines []*rolloutMachine) int {
+	b.publishStep("rollout", "rolling back")
+	rolledBack := 0
+	for _, m := range machines {
+		if len(m.parts) == 0 || (m.status != rolloutUpdated && m.status != rolloutFailed) {
+			continue
+		}
+		if _, _, err := b.swapMachineFragment(ctx, client, m.robot, req.newFragmentId, req.oldFragmentId); err != nil {
+			b.logger.Errorf("Error rolling back %s: %v", m.robot.Name, err)
+			m.status, m.err = rolloutRollbackFailed, err
+			continue
+		}
+		m.status = rolloutRolledBack
+		rolledBack++
+	}
+	return rolledBack
+}
@@ -0,0 +1,186 @@
+package update_module
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.viam.com/rdk/components/generic"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+	"go.viam.com/rdk/robot"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func newStagedFleet(t *testing.T) *fakeFleetClient {
+	client := newFakeFleetClient()
+	for _, id := range []string{"robot-1", "robot-2", "robot-3", "robot-4"} {
+		client.addMachine(t, "loc", id, "old")
+	}
+	return client
+}
+
+func stagedRequest(health *healthGate) *rolloutRequest {
+	return &rolloutRequest{
+		oldFragmentId: "old",
+		newFragmentId: "new",
+		locationId:    "loc",
+		batchSize:     10,
+		stages:        []rolloutStage{{machines: 1}, {percent: 50}, {percent: 100}},
+		health:        health,
+	}
+}
+
+func TestPlanStages(t *testing.T) {
+	assert.Equal(t, []stagePlan{{end: 3}}, planStages(nil, 3))
+	stages := []rolloutStage{{machines: 1, soak: time.Minute}, {percent: 50, soak: 2 * time.Minute}}
+	assert.Equal(t, []stagePlan{{end: 1, soak: time.Minute}, {end: 5, soak: 2 * time.Minute}, {end: 10, soak: defaultSoakTime}}, planStages(stages, 10))
+	// stages that add no machines are dropped
+	assert.Equal(t, []stagePlan{{end: 1, soak: time.Minute}}, planStages(stages, 1))
+	assert.Empty(t, planStages(stages, 0))
+}
+
+func TestStagedRollout(t *testing.T) {
+	ctx := context.Background()
+	client := newStagedFleet(t)
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: ctx}
+
+	report, err := module.runRollout(ctx, client, stagedRequest(&healthGate{maxLastAccess: time.Minute, checkErrors: true, maxErrorsPerMinute: 5}))
+	require.NoError(t, err)
+	assert.Equal(t, 1, report["ok"])
+	assert.Equal(t, 4, report["updated"])
+	assert.Equal(t, 3, report["batches"])
+	stages := report["stages"].([]interface{})
+	require.Len(t, stages, 3)
+	assert.Equal(t, 1, stages[0].(map[string]interface{})["machines"])
+	assert.Equal(t, 2, stages[2].(map[string]interface{})["machines"])
+	for _, s := range stages {
+		assert.Equal(t, "completed", s.(map[string]interface{})["status"])
+	}
+	_, err = structpb.NewStruct(report)
+	assert.NoError(t, err)
+}
+
+func TestStagedRolloutCancelled(t *testing.T) {
+	client := newStagedFleet(t)
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: context.Background()}
+	req := stagedRequest(&healthGate{maxLastAccess: time.Minute})
+	req.stages[0].soak = time.Hour
+
+	// the command times out while the first stage soaks, the canary goes back to the old fragment
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	report, err := module.runRollout(ctx, client, req)
+	assert.ErrorIs(t, err, errTimedOut)
+	assert.Equal(t, 1, report["rolled_back"])
+	assert.Equal(t, 3, report["halted"])
+	assert.Equal(t, []string{"robot-1-main", "robot-1-main"}, client.updated)
+	assert.Equal(t, []string{"old"}, client.fragments("robot-1-main"))
+	events, _, _ := module.events.since(0)
+	assert.Contains(t, busEventTypes(events), eventUpdateRolledBack)
+}
+
+func TestStagedRolloutRollback(t *testing.T) {
+	ctx := context.Background()
+	client := newStagedFleet(t)
+	// the second stage's machine logs errors after the update
+	client.errorLogs["robot-2-main"] = 20
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: ctx}
+
+	report, err := module.runRollout(ctx, client, stagedRequest(&healthGate{checkErrors: true, maxErrorsPerMinute: 5}))
+	assert.ErrorIs(t, err, errHealthGateFailed)
+	assert.Contains(t, report["error"], "rollout halted at stage 2")
+	assert.Contains(t, report["error"], "robot-2")
+	assert.Equal(t, 2, report["rolled_back"])
+	assert.Equal(t, 2, report["halted"])
+	for _, id := range []string{"robot-1-main", "robot-2-main", "robot-3-main", "robot-4-main"} {
+		assert.Equal(t, []string{"old"}, client.fragments(id), id)
+	}
+	machines := report["machines"].([]interface{})
+	assert.Equal(t, rolloutRolledBack, machines[1].(map[string]interface{})["status"])
+	assert.Contains(t, machines[1].(map[string]interface{})["health_error"], "error logs per minute")
+	assert.Equal(t, rolloutHalted, machines[3].(map[string]interface{})["status"])
+	stages := report["stages"].([]interface{})
+	assert.Equal(t, "completed", stages[0].(map[string]interface{})["status"])
+	assert.Equal(t, rolloutHalted, stages[1].(map[string]interface{})["status"])
+	assert.Equal(t, "pending", stages[2].(map[string]interface{})["status"])
+
+	events, _, _ := module.events.since(0)
+	var rolledBack []busEvent
+	for _, e := range events {
+		if e.Type == eventUpdateRolledBack {
+			rolledBack = append(rolledBack, e)
+		}
+	}
+	require.Len(t, rolledBack, 1)
+	assert.Equal(t, "2", rolledBack[0].Params["stage"])
+	assert.Contains(t, rolledBack[0].Error, errHealthGateFailed.Error())
+}
+
+func TestStagedRolloutGates(t *testing.T) {
+	ctx := context.Background()
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: ctx}
+
+	// the canary stopped checking in
+	client := newStagedFleet(t)
+	client.lastAccess["robot-1"] = time.Now().Add(-time.Hour)
+	report, err := module.runRollout(ctx, client, stagedRequest(&healthGate{maxLastAccess: time.Minute}))
+	assert.ErrorIs(t, err, errHealthGateFailed)
+	assert.Contains(t, report["error"], "rollout halted at stage 1")
+	assert.Contains(t, report["error"], "last seen")
+	assert.Equal(t, 1, report["rolled_back"])
+	assert.Equal(t, []string{"robot-1-main"}, client.updated[:1])
+
+	// a resource on the canary is unhealthy
+	defer func(f func(context.Context, logging.Logger, string, *credentials) (robot.MachineStatus, error)) {
+		machineStatus = f
+	}(machineStatus)
+	machineStatus = func(ctx context.Context, logger logging.Logger, address string, creds *credentials) (robot.MachineStatus, error) {
+		status := robot.MachineStatus{Resources: []resource.Status{{Name: generic.Named("arm"), State: resource.NodeStateReady}}}
+		if address == "robot-1.viam.cloud" {
+			status.Resources = append(status.Resources, resource.Status{Name: generic.Named("camera"), State: resource.NodeStateUnhealthy})
+		}
+		return status, nil
+	}
+	client = newStagedFleet(t)
+	report, err = module.runRollout(ctx, client, stagedRequest(&healthGate{checkResources: true}))
+	assert.ErrorIs(t, err, errHealthGateFailed)
+	assert.Contains(t, report["error"], "unhealthy resources: rdk:component:generic/camera")
+	assert.Equal(t, []string{"old"}, client.fragments("robot-1-main"))
+}
+
+func TestRolloutStagesFromCommand(t *testing.T) {
+	req, err := rolloutRequestFromCommand(map[string]interface{}{
+		"oldFragmentId": "old",
+		"newFragmentId": "new",
+		"location_id":   "loc",
+		"stages": []interface{}{
+			map[string]interface{}{"machines": 2.0, "soak_seconds": 60.0},
+			map[string]interface{}{"percent": 25.0},
+		},
+		"health": map[string]interface{}{"max_errors_per_minute": 2.0, "check_resources": true},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []rolloutStage{{machines: 2, soak: time.Minute}, {percent: 25, soak: defaultSoakTime}}, req.stages)
+	assert.Equal(t, &healthGate{maxLastAccess: defaultMaxLastAccess, maxErrorsPerMinute: 2, checkErrors: true, checkResources: true}, req.health)
+
+	// stages are gated on last access when no health gate is given
+	req, err = rolloutRequestFromCommand(map[string]interface{}{"oldFragmentId": "old", "newFragmentId": "new", "location_id": "loc", "stages": []interface{}{map[string]interface{}{"machines": 1.0}}})
+	require.NoError(t, err)
+	assert.Equal(t, &healthGate{maxLastAccess: defaultMaxLastAccess}, req.health)
+
+	for _, stage := range []interface{}{
+		map[string]interface{}{},
+		map[string]interface{}{"machines": 1.0, "percent": 10.0},
+		map[string]interface{}{"percent": 150.0},
+		map[string]interface{}{"machines": 0.0},
+		"canary",
+	} {
+		_, err = rolloutRequestFromCommand(map[string]interface{}{"oldFragmentId": "old", "newFragmentId": "new", "location_id": "loc", "stages": []interface{}{stage}})
+		assert.ErrorIs(t, err, errInvalidStage, stage)
+	}
+	_, err = rolloutRequestFromCommand(map[string]interface{}{"oldFragmentId": "old", "newFragmentId": "new", "location_id": "loc", "health": map[string]interface{}{"max_errors_per_minute": -1.0}})
+	assert.ErrorIs(t, err, errInvalidHealthGate)
+}
@@ -0,0 +1,184 @@
+package update_module
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"viam-robot-update-module/utils"
+)
+
+// statusVersionTimeout bounds how long a status reading waits for the running viam-server version
+const statusVersionTimeout = 2 * time.Second
+
+var (
+	// updateModules are the update components running in this process by name. Dependencies reach other
+	// resources through viam-server, so resources in this module that share state look each other up here.
+	updateModules   = map[string]*RobotUpdateModule{}
+	updateModulesMu sync.Mutex
+
+	errUpdateComponentNotFound = errors.New("update component not found")
+)
+
+// updateResult records the outcome of the most recent update command
+type updateResult struct {
+	at            time.Time
+	oldFragmentId string
+	newFragmentId string
+	err           error
+}
+
+func registerUpdateModule(name string, b *RobotUpdateModule) {
+	updateModulesMu.Lock()
+	defer updateModulesMu.Unlock()
+	updateModules[name] = b
+}
+
+// unregisterUpdateModule removes the component, unless it was already replaced by a newer one
+func unregisterUpdateModule(name string, b *RobotUpdateModule) {
+	updateModulesMu.Lock()
+	defer updateModulesMu.Unlock()
+	if updateModules[name] == b {
+		delete(updateModules, name)
+	}
+}
+
+func lookupUpdateModule(name string) (*RobotUpdateModule, error) {
+	updateModulesMu.Lock()
+	defer updateModulesMu.Unlock()
+	b, ok := updateModules[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errUpdateComponentNotFound, name)
+	}
+	return b, nil
+}
+
+func (b *RobotUpdateModule) recordUpdate(oldFragmentId, newFragmentId string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastUpdate = &updateResult{at: time.Now(), oldFragmentId: oldFragmentId, newFragmentId: newFragmentId, err: err}
+}
+
+// recordAppliedFragments remembers the fragments of the part config the last update wrote
+func (b *RobotUpdateModule) recordAppliedFragments(conf *structpb.Struct) {
+	var fragments []string
+	for _, v := range conf.Fields["fragments"].GetListValue().GetValues() {
+		if s := fragmentId(v); s != "" {
+			fragments = append(fragments, s)
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.appliedFragments = fragments
+}
+
+func (b *RobotUpdateModule) setTargetVersion(version string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.targetVersion = version
+}
+
+// jobCounts reports the work waiting to run in the background
+func (b *RobotUpdateModule) jobCounts() map[string]interface{} {
+	offline, err := b.readOfflineQueue()
+	if err != nil {
+		b.logger.Warnf("Error reading offline queue: %v", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	pendingRestarts := 0
+	if b.pendingRestart != nil {
+		pendingRestarts = 1
+	}
+	return map[string]interface{}{
+		"pending_restarts": pendingRestarts,
+		"queued_commands":  len(b.queuedCommands),
+		"offline_queued":   len(offline),
+	}
+}
+
+// runningVersion asks viam-server for its version once, within statusVersionTimeout, so readings aren't
+// held up by the retries commands dial with
+func (b *RobotUpdateModule) runningVersion(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, statusVersionTimeout)
+	defer cancel()
+	robotClient, err := b.getRobotClient(ctx, map[string]interface{}{}, 1)
+	if err != nil {
+		return "", err
+	}
+	v, err := robotClient.Version(ctx)
+	if err != nil {
+		return "", err
+	}
+	return v.Version, nil
+}
+
+// status reports the update state of the machine. It only holds values a sensor reading can carry, the
+// running viam-server version is left out with an error if viam-server can't be reached.
+func (b *RobotUpdateModule) status(ctx context.Context) map[string]interface{} {
+	s := map[string]interface{}{"module_version": utils.Version}
+	if v, err := b.runningVersion(ctx); err != nil {
+		s["running_version_error"] = err.Error()
+	} else {
+		s["running_version"] = v
+	}
+
+	for k, v := range b.restartStatus() {
+		if k == "pending" {
+			k = "restart_pending"
+		}
+		s[k] = v
+	}
+	for k, v := range b.jobCounts() {
+		s[k] = v
+	}
+	if u, err := loadSelfUpdate(); err != nil {
+		s["self_update_error"] = err.Error()
+	} else if u != nil {
+		s["self_update_id"] = u.ID
+		s["self_update_state"] = u.State
+		if u.Error != "" {
+			s["self_update_error"] = u.Error
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.targetVersion != "" {
+		s["target_version"] = b.targetVersion
+	}
+	if b.viamServerVerifyErr != nil {
+		s["viam_server_verify_error"] = b.viamServerVerifyErr.Error()
+	}
+	fragments := make([]interface{}, 0, len(b.appliedFragments))
+	for _, f := range b.appliedFragments {
+		fragments = append(fragments, f)
+	}
+	s["applied_fragments"] = fragments
+	if b.lastDrift != nil {
+		s["drift_checked_at"] = b.lastDrift.at.Format(time.RFC3339)
+		s["drift_baseline"] = b.lastDrift.baseline
+		if b.lastDrift.err != nil {
+			s["drift_error"] = b.lastDrift.err.Error()
+		} else {
+			s["drift_in_sync"] = len(b.lastDrift.drift) == 0
+			s["drift_count"] = len(b.lastDrift.drift)
+			s["drift_counts"] = b.lastDrift.counts()
+		}
+	}
+	if b.lastUpdate != nil {
+		s["last_update_at"] = b.lastUpdate.at.Format(time.RFC3339)
+		s["last_update_fragment_id"] = b.lastUpdate.newFragmentId
+		s["last_update_result"] = "ok"
+		if b.lastUpdate.err != nil {
+			s["last_update_result"] = "error"
+			s["last_update_error"] = b.lastUpdate.err.Error()
+		}
+	}
+	return s
+}
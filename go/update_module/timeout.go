@@ -0,0 +1,74 @@
+package update_module
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// rdkUpdateWait is how long restart_on_rdk_update waits for viam-agent to swap the viam-server symlink
+	rdkUpdateWait         = 30 * time.Second
+	rdkUpdatePollInterval = 5 * time.Second
+)
+
+var (
+	errTimedOut     = errors.New("timed out")
+	errCancelled    = errors.New("cancelled")
+	errModuleClosed = errors.New("module closed")
+)
+
+// commandContext returns the context a command runs under. It is done when the caller's ctx is, when the
+// module is closed, or after timeout_seconds if the command sets it.
+func (b *RobotUpdateModule) commandContext(ctx context.Context, cmd map[string]interface{}) (context.Context, context.CancelFunc, error) {
+	var timeout time.Duration
+	if _, ok := cmd["timeout_seconds"]; ok {
+		t, err := secondsFromRequest(cmd, "timeout_seconds")
+		if err != nil {
+			return nil, nil, err
+		}
+		timeout = t
+	}
+
+	ctx, cancelCause := context.WithCancelCause(ctx)
+	stopAfter := func() bool { return false }
+	if b.ctx != nil {
+		stopAfter = context.AfterFunc(b.ctx, func() { cancelCause(errModuleClosed) })
+	}
+	cancelTimeout := func() {}
+	if timeout > 0 {
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+	}
+	return ctx, func() {
+		cancelTimeout()
+		stopAfter()
+		cancelCause(nil)
+	}, nil
+}
+
+// stepError names the step a command was in when its context ended, other errors are returned unchanged
+func stepError(ctx context.Context, step string, err error) error {
+	if err == nil {
+		return nil
+	}
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("%w during step %s: %v", errTimedOut, step, err)
+	case ctx.Err() != nil:
+		return fmt.Errorf("%w during step %s (%v): %v", errCancelled, step, context.Cause(ctx), err)
+	}
+	return err
+}
+
+// sleepContext waits for d, returning early with the context's error if it ends first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,70 @@
+package update_module
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.viam.com/rdk/logging"
+)
+
+func TestCommandContext(t *testing.T) {
+	moduleCtx, closeModule := context.WithCancel(context.Background())
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: moduleCtx}
+
+	_, _, err := module.commandContext(context.Background(), map[string]interface{}{"timeout_seconds": "soon"})
+	assert.Error(t, err)
+
+	ctx, cancel, err := module.commandContext(context.Background(), map[string]interface{}{"timeout_seconds": 30.0})
+	require.NoError(t, err)
+	deadline, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(30*time.Second), deadline, time.Second)
+	cancel()
+	assert.Error(t, ctx.Err())
+
+	ctx, cancel, err = module.commandContext(context.Background(), map[string]interface{}{})
+	require.NoError(t, err)
+	defer cancel()
+	_, ok = ctx.Deadline()
+	assert.False(t, ok)
+	closeModule()
+	<-ctx.Done()
+	assert.ErrorIs(t, context.Cause(ctx), errModuleClosed)
+	assert.ErrorIs(t, stepError(ctx, "dialing app", errors.New("boom")), errCancelled)
+}
+
+func TestStepError(t *testing.T) {
+	assert.NoError(t, stepError(context.Background(), "dialing app", nil))
+	err := errors.New("boom")
+	assert.Equal(t, err, stepError(context.Background(), "dialing app", err))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	<-ctx.Done()
+	err = stepError(ctx, "dialing app", err)
+	assert.ErrorIs(t, err, errTimedOut)
+	assert.Contains(t, err.Error(), "timed out during step dialing app")
+}
+
+func TestRestartTimeout(t *testing.T) {
+	ctx := context.Background()
+	manager := &fakeServiceManager{states: []string{"activating"}}
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: ctx, serviceManager: manager}
+
+	start := time.Now()
+	resp, err := module.DoCommand(ctx, map[string]interface{}{"command": "restart", "delay_seconds": 0, "timeout_seconds": 0.2})
+	assert.ErrorIs(t, err, errTimedOut)
+	assert.Contains(t, resp["error"], "timed out during step waiting for viam-agent to become active")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestSleepContext(t *testing.T) {
+	assert.NoError(t, sleepContext(context.Background(), time.Millisecond))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, sleepContext(ctx, time.Hour), context.Canceled)
+}
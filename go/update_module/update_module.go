@@ -3,25 +3,23 @@ package update_module
 import (
 	"context"
 	"errors"
+	"fmt"
 	"os"
-	"os/exec"
 	"strings"
+	"sync"
 	"time"
 
 	app_proto "go.viam.com/api/app/v1"
 	"go.viam.com/rdk/components/generic"
 	"go.viam.com/rdk/logging"
 	"go.viam.com/rdk/resource"
-	"go.viam.com/rdk/robot/client"
-	"go.viam.com/utils/rpc"
 	"google.golang.org/protobuf/types/known/structpb"
 
 	"viam-robot-update-module/utils"
-
-	api "github.com/thegreatco/viamutils/api"
-	configutils "github.com/thegreatco/viamutils/config"
 )
 
+const appAddress = "app.viam.com:443"
+
 var (
 	Model                   = resource.NewModel(utils.Namespace, "robot", "update")
 	errOldFragmentIdMissing = errors.New("oldFragmentId missing")
@@ -46,15 +44,24 @@ func NewUpdateModule(ctx context.Context, deps resource.Dependencies, conf resou
 	logger.Infof("Starting Robot Update Module %v", utils.Version)
 	c, cancelFunc := context.WithCancel(context.Background())
 	b := RobotUpdateModule{
-		Named:      conf.ResourceName().AsNamed(),
-		logger:     logger,
-		cancelFunc: cancelFunc,
-		ctx:        c,
+		Named:       conf.ResourceName().AsNamed(),
+		logger:      logger,
+		cancelFunc:  cancelFunc,
+		ctx:         c,
+		webhookWake: make(chan struct{}, 1),
+		offlineWake: make(chan struct{}, 1),
 	}
 
 	if err := b.Reconfigure(ctx, deps, conf); err != nil {
 		return nil, err
 	}
+	registerUpdateModule(b.Name().Name, &b)
+	go b.runPendingPostHooks(c)
+	go b.runWebhooks(c)
+	go b.runOfflineQueue(c)
+	go b.watchInstalledVersion(c, viamServerBinary, versionPollInterval)
+	go b.runReconcile(c)
+	go b.runDriftCheck(c)
 	return &b, nil
 }
 
@@ -63,20 +70,189 @@ type RobotUpdateModule struct {
 	logger     logging.Logger
 	cancelFunc context.CancelFunc
 	ctx        context.Context
+
+	mu             sync.Mutex
+	cfg            *Config
+	serviceManager ServiceManager
+	interlocks     []interlock
+	pendingRestart *pendingRestart
+	lastRestart    *restartResult
+	queuedCommands map[int]*queuedCommand
+	lastQueueId    int
+	// targetVersion, lastUpdate, appliedFragments, lastDrift and viamServerVerifyErr are reported by the
+	// status sensor
+	targetVersion       string
+	viamServerVerifyErr error
+	lastUpdate          *updateResult
+	appliedFragments    []string
+	lastReconcile       *reconcileResult
+	lastDrift           *driftReport
+
+	// reconcileMu keeps reconciliation passes from overlapping
+	reconcileMu sync.Mutex
+
+	// clientsMu is separate from mu as it is held while dialing
+	clientsMu sync.Mutex
+	clients   clients
+
+	// auditMu serializes writes and rotation of the audit log
+	auditMu sync.Mutex
+
+	events          eventBus
+	metrics         metrics
+	metricsServerMu sync.Mutex
+	metricsServer   *metricsServer
+
+	// webhookMu, with a file lock, guards the component's persisted webhook queue, webhookWake starts a
+	// delivery pass
+	webhookMu   sync.Mutex
+	webhookWake chan struct{}
+
+	// offlineMu, with a file lock, guards the component's persisted offline queue, offlineWake starts a
+	// retry pass
+	offlineMu   sync.Mutex
+	offlineWake chan struct{}
+
+	// pendingHooksMu, with a file lock, guards the component's saved post hooks
+	pendingHooksMu sync.Mutex
 }
 
 // Close implements resource.Resource.
-func (*RobotUpdateModule) Close(ctx context.Context) error {
+func (b *RobotUpdateModule) Close(ctx context.Context) error {
+	if b.Named != nil {
+		unregisterUpdateModule(b.Name().Name, b)
+	}
+	if _, err := b.cancelRestart(); err == nil {
+		b.logger.Warn("Pending restart cancelled by Close")
+	}
+	b.cancelQueuedCommands()
+	b.closeClients(ctx)
+	if err := b.reconfigureMetricsServer(ctx, ""); err != nil {
+		b.logger.Warnf("Error stopping metrics server: %v", err)
+	}
+	if b.cancelFunc != nil {
+		b.cancelFunc()
+	}
 	return nil
 }
 
 // Reconfigure implements resource.Resource.
-func (r *RobotUpdateModule) Reconfigure(ctx context.Context, deps resource.Dependencies, conf resource.Config) error {
-	return nil
+func (b *RobotUpdateModule) Reconfigure(ctx context.Context, deps resource.Dependencies, conf resource.Config) error {
+	cfg, err := resource.NativeConfig[*Config](conf)
+	if err != nil {
+		return err
+	}
+	serviceManager, err := newServiceManager(cfg.ServiceManager)
+	if err != nil {
+		return err
+	}
+	interlocks, err := interlocksFromDependencies(deps, cfg.InterlockResources)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	rebuildClients := credentialsChanged(b.cfg, cfg)
+	b.cfg = cfg
+	b.serviceManager = serviceManager
+	b.interlocks = interlocks
+	b.mu.Unlock()
+
+	if rebuildClients {
+		b.closeClients(ctx)
+	}
+	b.events.publish(eventConfigApplied, map[string]string{"digest": configDigest(cfg)}, nil)
+	return b.reconfigureMetricsServer(ctx, cfg.MetricsAddress)
+}
+
+// commandInfo describes how DoCommand treats a command
+type commandInfo struct {
+	// audited commands change the machine or the module's stored state, they are recorded in the audit log
+	audited bool
+	// disruptive commands only run inside maintenance windows and with the interlocks clear, and can have
+	// hooks
+	disruptive bool
+	// restarting commands restart viam-server at the time in at or delay_seconds, the window is checked for
+	// that time rather than now
+	restarting bool
+}
+
+// commands are the commands DoCommand handles, the only values of the command metrics label
+var commands = map[string]commandInfo{
+	"update":                {audited: true, disruptive: true},
+	"rollout":               {audited: true},
+	"reconcile":             {audited: true, disruptive: true},
+	"detect_drift":          {},
+	"snapshot_config":       {audited: true},
+	"list_snapshots":        {},
+	"diff_snapshot":         {},
+	"restore_snapshot":      {audited: true, disruptive: true},
+	"part_history":          {},
+	"diff_revisions":        {},
+	"rollback_revision":     {audited: true, disruptive: true},
+	"self_update":           {audited: true, disruptive: true},
+	"health":                {},
+	"verify_artifact":       {},
+	"verify_bundle":         {},
+	"apply_bundle":          {audited: true, disruptive: true, restarting: true},
+	"offline_queue":         {},
+	"cancel_offline":        {audited: true},
+	"restart":               {audited: true, disruptive: true, restarting: true},
+	"cancel_restart":        {audited: true},
+	"pending_restart":       {},
+	"maintenance_window":    {},
+	"watch_events":          {},
+	"metrics":               {},
+	"audit_log":             {},
+	"set_credentials":       {audited: true},
+	"restart_on_rdk_update": {audited: true, disruptive: true, restarting: true},
 }
 
 func (b *RobotUpdateModule) DoCommand(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	command, _ := cmd["command"].(string)
+	var entry *auditEntry
+	if commands[command].audited {
+		entry = newAuditEntry(ctx, command, cmd)
+		ctx = withAuditEntry(ctx, entry)
+	}
+	resp, err := b.doCommand(ctx, cmd)
+	if entry != nil {
+		b.writeAudit(entry, responseError(resp, err))
+	}
+	b.metrics.countCommand(command, resp, err)
+	return resp, err
+}
+
+func (b *RobotUpdateModule) doCommand(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	if hasInlineSecrets(cmd) {
+		b.mu.Lock()
+		disallowed := b.cfg != nil && b.cfg.DisallowInlineCredentials
+		b.mu.Unlock()
+		if disallowed {
+			b.logger.Warnf("Rejecting command with inline credentials: %v", redactCommand(cmd))
+			return map[string]interface{}{"error": errInlineCredentialsNotPermitted.Error()}, errInlineCredentialsNotPermitted
+		}
+		if cmd["command"] != "set_credentials" {
+			b.logger.Warn("Received apiKey in a DoCommand payload, use set_credentials or the component config instead")
+		}
+	}
+	b.logger.Debugf("Received command: %v", redactCommand(cmd))
+	ctx, cancel, err := b.commandContext(ctx, cmd)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	defer cancel()
 	if command, ok := cmd["command"]; ok {
+		// a reconcile dry run only reports, it changes nothing to gate. Other commands don't read dry_run.
+		dryRun, _ := cmd["dry_run"].(bool)
+		if c, ok := command.(string); ok && commands[c].disruptive && !(c == "reconcile" && dryRun) {
+			if resp, handled, err := b.gateMaintenance(c, cmd); handled {
+				return resp, err
+			}
+			if resp, err := b.gateInterlocks(ctx, c, cmd); err != nil {
+				return resp, err
+			}
+		}
 		switch command {
 		case "update":
 			b.logger.Infof("Received update command")
@@ -89,49 +265,110 @@ func (b *RobotUpdateModule) DoCommand(ctx context.Context, cmd map[string]interf
 				if !ok || oldFragmentId == "" {
 					return map[string]interface{}{"error": "No oldFragmentId provided"}, errOldFragmentIdMissing
 				}
-				apiKeyName, apiKey, err := getApiCredentialsFromRequest(cmd)
-				if err != nil {
-					b.logger.Errorf("Error getting api credentials: %v", err)
-					return map[string]interface{}{"error": err}, err
-				}
-				client, err := b.GetClient(ctx, apiKeyName, apiKey)
-				if err != nil {
-					b.logger.Errorf("Error getting client: %v", err)
-					return map[string]interface{}{"error": err}, err
+				params := map[string]string{"old_fragment_id": oldFragmentId, "new_fragment_id": newFragmentId}
+				b.notify(eventUpdateStarted, params, nil)
+				resp, err := b.update(ctx, cmd, oldFragmentId, newFragmentId)
+				if queued, ok := b.queueOffline("update", cmd, err); ok {
+					return queued, nil
 				}
-				machineId, err := configutils.GetMachineId()
-				if err != nil {
-					return map[string]interface{}{"error": err}, err
+				if err := responseError(resp, err); err != nil {
+					b.notify(eventUpdateFailed, params, err)
+				} else {
+					b.notify(eventUpdateSucceeded, params, nil)
 				}
-				return b.updateFragment(ctx, client, machineId, oldFragmentId, newFragmentId)
+				return resp, err
 			} else {
 				return map[string]interface{}{"error": "No fragmentId provided"}, errNewFragmentIdMissing
 			}
+		case "rollout":
+			b.logger.Info("received rollout request")
+			return b.rollout(ctx, cmd)
+		case "reconcile":
+			b.logger.Info("received reconcile request")
+			return b.reconcileCommand(ctx, cmd)
+		case "detect_drift":
+			b.logger.Info("received detect_drift request")
+			return b.detectDriftCommand(ctx, cmd)
+		case "snapshot_config":
+			b.logger.Info("received snapshot_config request")
+			return b.snapshotConfig(ctx, cmd)
+		case "list_snapshots":
+			return b.listSnapshotsCommand()
+		case "diff_snapshot":
+			return b.diffSnapshot(ctx, cmd)
+		case "restore_snapshot":
+			b.logger.Info("received restore_snapshot request")
+			return b.restoreSnapshot(ctx, cmd)
+		case "part_history":
+			return b.partHistory(ctx, cmd)
+		case "diff_revisions":
+			return b.diffRevisions(ctx, cmd)
+		case "rollback_revision":
+			b.logger.Info("received rollback_revision request")
+			return b.rollbackRevision(ctx, cmd)
+		case "self_update":
+			b.logger.Info("received self_update request")
+			return b.selfUpdateCommand(ctx, cmd)
+		case "health":
+			return b.health()
+		case "verify_artifact":
+			return b.verifyArtifactCommand(cmd)
+		case "verify_bundle":
+			return b.verifyBundle(cmd)
+		case "apply_bundle":
+			b.logger.Info("received apply_bundle request")
+			return b.applyBundle(ctx, cmd)
+		case "offline_queue":
+			return b.offlineQueueCommand()
+		case "cancel_offline":
+			b.logger.Info("received cancel_offline request")
+			return b.cancelOffline(cmd)
 		case "restart":
 			b.logger.Info("received restart request")
-			restartViamServer()
-			b.logger.Info("sent restart request")
-			return map[string]interface{}{"ok": 1}, nil
+			return b.restart(ctx, cmd)
+		case "cancel_restart":
+			b.logger.Info("received cancel_restart request")
+			p, err := b.cancelRestart()
+			if err != nil {
+				return map[string]interface{}{"error": err.Error()}, err
+			}
+			return map[string]interface{}{"ok": 1, "cancelled_restart_at": p.at.Format(time.RFC3339)}, nil
+		case "pending_restart":
+			return b.restartStatus(), nil
+		case "maintenance_window":
+			return b.maintenanceStatus(), nil
+		case "watch_events":
+			return b.watchEvents(ctx, cmd)
+		case "metrics":
+			return b.metricsResponse()
+		case "audit_log":
+			return b.auditLog(cmd)
+		case "set_credentials":
+			b.logger.Info("received set_credentials request")
+			return b.setCredentials(cmd)
 		case "restart_on_rdk_update":
 			b.logger.Info("received restart_on_rdk_update request")
 			desiredVersion := cmd["version"].(string)
 			if desiredVersion == "" {
 				return map[string]interface{}{"error": "no version provided"}, nil
 			}
-			apiKeyName, apiKey, err := getApiCredentialsFromRequest(cmd)
-			if err != nil {
-				b.logger.Errorf("Error getting api credentials: %v", err)
-				return map[string]interface{}{"error": err}, err
-			}
-			robotClient, err := b.getRobotClient(ctx, apiKeyName, apiKey)
+			b.setTargetVersion(desiredVersion)
+			robotClient, err := b.getRobotClient(ctx, cmd, dialAttempts)
 			if err != nil {
 				b.logger.Errorf("Error getting robot client: %v", err)
+				if ctx.Err() != nil {
+					err = stepError(ctx, "dialing viam-server", err)
+					return map[string]interface{}{"error": err.Error()}, err
+				}
 				return map[string]interface{}{"error": "no robot client"}, nil
 			}
-			defer robotClient.Close(ctx)
 			runningVersion, err := robotClient.Version(ctx)
 			if err != nil {
 				b.logger.Errorf("Error getting robot version: %v", err)
+				if ctx.Err() != nil {
+					err = stepError(ctx, "getting viam-server version", err)
+					return map[string]interface{}{"error": err.Error()}, err
+				}
 				return map[string]interface{}{"error": "no robot version"}, nil
 			}
 			if strings.Contains(runningVersion.Version, desiredVersion) {
@@ -139,22 +376,36 @@ func (b *RobotUpdateModule) DoCommand(ctx context.Context, cmd map[string]interf
 				return map[string]interface{}{"ok": 1, "msg": "viam-server is already on desired version"}, nil
 			}
 
-			if v, err := isSymLink("/opt/viam/bin/viam-server"); err == nil && v {
-				retryCount := 0
-				for {
-					if retryCount > 6 {
-						b.logger.Errorf("viam-server not updated after 30 seconds")
-						return map[string]interface{}{"error": "viam-server not updated after 30 seconds"}, err
-					}
-					if y, err := isVersion(desiredVersion); err == nil && y {
-						break
-					}
-					time.Sleep(5 * time.Second)
-					retryCount++
+			// refuse a bad restart time before waiting for the update
+			if _, err := b.restartTimeFromRequest(cmd); err != nil {
+				return map[string]interface{}{"error": err.Error()}, err
+			}
+			if v, err := isSymLink(viamServerBinary); err == nil && v {
+				// the binary to go back to if the new one fails verification, the running version's if
+				// viam-agent already switched
+				previous, _ := os.Readlink(viamServerBinary)
+				if previous == "" || strings.Contains(previous, desiredVersion) {
+					previous = cachedViamServer(runningVersion.Version)
+				}
+				if err := b.waitForRdkVersion(ctx, desiredVersion); err != nil {
+					b.logger.Errorf("Error waiting for viam-server update: %v", err)
+					return map[string]interface{}{"error": err.Error()}, err
+				}
+				verified, err := b.verifyViamServer(cmd)
+				if err != nil {
+					b.logger.Errorf("Refusing to restart into viam-server %s: %v", desiredVersion, err)
+					return b.refuseViamServer(desiredVersion, previous, err), err
+				}
+				at, err := b.restartTimeFromRequest(cmd)
+				if err != nil {
+					// at passed while waiting for the update, fall back to the configured delay
+					b.mu.Lock()
+					at = time.Now().Add(b.cfg.restartDelay())
+					b.mu.Unlock()
 				}
-				restartViamServer()
-				b.logger.Infof("viam-server updated and restarted")
-				return map[string]interface{}{"ok": 1, "msg": "viam-server updated and restarted"}, nil
+				p := b.scheduleRestart(at, operation{Command: "restart_on_rdk_update", Params: map[string]string{"version": desiredVersion}}, b.windowCheck(cmd), b.viamServerCheck(cmd, verified["path"].(string)))
+				b.logger.Infof("viam-server updated, restart scheduled")
+				return map[string]interface{}{"ok": 1, "msg": "viam-server updated, restart scheduled", "restart_at": p.at.Format(time.RFC3339), "verified": verified}, nil
 			} else if err != nil {
 				b.logger.Errorf("Error checking if /opt/viam/bin/viam-server is a symlink: %v", err)
 				return map[string]interface{}{"error": "Error checking if /opt/viam/bin/viam-server is a symlink"}, err
@@ -167,51 +418,57 @@ func (b *RobotUpdateModule) DoCommand(ctx context.Context, cmd map[string]interf
 	return map[string]interface{}{"error": "No command provided"}, errNoCommandProvided
 }
 
-func (b *RobotUpdateModule) GetClient(ctx context.Context, apiKeyName, apiKey string) (app_proto.AppServiceClient, error) {
-	akn, ak, err := configutils.GetCredentialsFromConfig()
+// update swaps the fragment in the machine's part config, running the update hooks around it
+func (b *RobotUpdateModule) update(ctx context.Context, cmd map[string]interface{}, oldFragmentId, newFragmentId string) (map[string]interface{}, error) {
+	b.publishStep("update", "getting credentials")
+	creds, err := b.getCredentials(cmd)
 	if err != nil {
-		return nil, err
+		b.logger.Errorf("Error getting api credentials: %v", err)
+		return map[string]interface{}{"error": err}, err
 	}
-	if apiKeyName != "" && apiKey != "" {
-		akn = apiKeyName
-		ak = apiKey
+	auditCredentials(ctx, creds)
+	b.publishStep("update", "dialing app")
+	client, err := b.GetClient(ctx, creds)
+	if err = stepError(ctx, "dialing app", err); err != nil {
+		b.logger.Errorf("Error getting client: %v", err)
+		return map[string]interface{}{"error": err}, err
 	}
-	client, err := api.NewAppClientFromApiCredentials(ctx, b.logger, akn, ak)
-	return client, err
-}
-
-func (b *RobotUpdateModule) getRobotClient(ctx context.Context, apiKeyName, apiKey string) (*client.RobotClient, error) {
-	akn, ak, err := configutils.GetCredentialsFromConfig()
+	robotId, err := machineId()
 	if err != nil {
-		return nil, err
+		return map[string]interface{}{"error": err}, err
 	}
-	if apiKeyName != "" && apiKey != "" {
-		akn = apiKeyName
-		ak = apiKey
+	op := operation{Command: "update", Params: map[string]string{"old_fragment_id": oldFragmentId, "new_fragment_id": newFragmentId}}
+	b.publishStep("update", "running pre hooks")
+	if err := stepError(ctx, "running pre hooks", b.runHooks(ctx, hookStagePre, op, nil)); err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
 	}
-	config, err := configutils.GetMachineConfig()
-	if err != nil {
-		return nil, err
+	b.publishStep("update", "updating fragment")
+	resp, err := b.updateFragment(ctx, client, robotId, oldFragmentId, newFragmentId)
+	b.recordUpdate(oldFragmentId, newFragmentId, err)
+	b.publishStep("update", "running post hooks")
+	if hookErr := stepError(ctx, "running post hooks", b.runHooks(ctx, hookStagePost, op, err)); hookErr != nil && err == nil {
+		resp["post_hook_error"] = hookErr.Error()
 	}
-
-	return client.New(
-		context.Background(),
-		config.Cloud.FQDN,
-		b.logger,
-		client.WithDialOptions(rpc.WithEntityCredentials(
-			akn,
-			rpc.Credentials{
-				Type:    rpc.CredentialsTypeAPIKey,
-				Payload: ak,
-			})),
-	)
+	return resp, err
 }
 
 func (b *RobotUpdateModule) updateFragment(ctx context.Context, client app_proto.AppServiceClient, robotId, oldFragmentId, newFragmentId string) (map[string]interface{}, error) {
 	b.logger.Infof("Received update fragmentId")
+	return b.updatePartConfig(ctx, client, robotId, func(part *app_proto.RobotPart) (*structpb.Struct, error) {
+		// Swap the fragmentId
+		if err := swapFragmentId(oldFragmentId, newFragmentId, part.RobotConfig, b.logger); err != nil {
+			b.logger.Errorf("Error swapping fragment: %v", err)
+			return nil, err
+		}
+		return part.RobotConfig, nil
+	})
+}
 
+// updatePartConfig writes the config returned by change to the machine's only part, once the machine has
+// been seen recently. change may modify the part's config in place.
+func (b *RobotUpdateModule) updatePartConfig(ctx context.Context, client app_proto.AppServiceClient, robotId string, change func(part *app_proto.RobotPart) (*structpb.Struct, error)) (map[string]interface{}, error) {
 	robot, err := client.GetRobot(ctx, &app_proto.GetRobotRequest{Id: robotId})
-	if err != nil {
+	if err = stepError(ctx, "getting robot", err); err != nil {
 		b.logger.Errorf("Error getting robot: %v", err)
 		return map[string]interface{}{"error": err}, err
 	}
@@ -222,7 +479,7 @@ func (b *RobotUpdateModule) updateFragment(ctx context.Context, client app_proto
 	}
 
 	parts, err := client.GetRobotParts(ctx, &app_proto.GetRobotPartsRequest{RobotId: robotId})
-	if err != nil {
+	if err = stepError(ctx, "getting robot parts", err); err != nil {
 		b.logger.Errorf("Error getting robot parts: %v", err)
 		return map[string]interface{}{"error": err}, err
 	}
@@ -247,15 +504,23 @@ func (b *RobotUpdateModule) updateFragment(ctx context.Context, client app_proto
 		return map[string]interface{}{"error": "No robot configuration found"}, nil
 	}
 
-	// Swap the fragmentId
-	swapFragmentId(oldFragmentId, newFragmentId, conf, b.logger)
+	hashBefore := configHash(conf)
+	conf, err = change(part)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, err
+	}
+	auditConfigHashes(ctx, hashBefore, conf)
 
 	// Update the robot part with the new configuration
+	start := time.Now()
 	_, err = client.UpdateRobotPart(ctx, &app_proto.UpdateRobotPartRequest{Id: part.Id, Name: part.Name, RobotConfig: conf})
-	if err != nil {
+	b.metrics.observe(metricUpdateRobotPart, time.Since(start))
+	if err = stepError(ctx, "updating robot part", err); err != nil {
 		b.logger.Errorf("Error updating robot part: %v", err)
+		err = &partWriteError{err: err}
 		return map[string]interface{}{"error": err}, err
 	}
+	b.recordAppliedFragments(conf)
 	return map[string]interface{}{"ok": 1}, nil
 }
 
@@ -277,11 +542,12 @@ func swapFragmentId(oldFragmentId, newFragmentId string, conf *structpb.Struct,
 	if f, ok := conf.Fields["fragments"]; ok {
 		fragments := f.GetListValue().Values
 		for _, fragment := range fragments {
-			logger.Debugf("Found fragment: %v", fragment.GetStringValue())
+			id := fragmentId(fragment)
+			logger.Debugf("Found fragment: %v", id)
 			// Filter out the old fragmentId, we also do the new fragmentId to prevent duplicates, just in case
-			if fragment.GetStringValue() != oldFragmentId && fragment.GetStringValue() != newFragmentId {
-				logger.Debugf("Copying fragment to new fragment list: %v", fragment.GetStringValue())
-				newFragments = append(newFragments, fragment)
+			if id != oldFragmentId && id != newFragmentId {
+				logger.Debugf("Copying fragment to new fragment list: %v", id)
+				newFragments = append(newFragments, fragment.AsInterface())
 			}
 		}
 	}
@@ -311,20 +577,96 @@ func swapFragmentId(oldFragmentId, newFragmentId string, conf *structpb.Struct,
 	return nil
 }
 
-func restartViamServer() error {
-	cmd := exec.Command("systemctl", "restart", "viam-agent")
-	err := cmd.Run()
+// restartViamServer restarts the configured unit and waits for it to report active again, running the
+// pre and post hooks for the operation around it
+func (b *RobotUpdateModule) restartViamServer(ctx context.Context, op operation) (err error) {
+	defer func() {
+		if err != nil {
+			b.notify(eventRestartFailed, op.eventParams(), err)
+		} else {
+			b.notify(eventRestartCompleted, op.eventParams(), nil)
+		}
+	}()
+	b.mu.Lock()
+	cfg := b.cfg
+	serviceManager := b.serviceManager
+	b.mu.Unlock()
+	if serviceManager == nil {
+		serviceManager = &systemdServiceManager{}
+	}
+
+	// the interlocks are checked again as resources may have started moving since a restart was scheduled
+	b.publishStep(op.Command, "checking interlocks")
+	if err := b.checkInterlocks(ctx, cfg != nil && cfg.StopInterlockResources); err != nil {
+		return stepError(ctx, "checking interlocks", err)
+	}
+
+	b.publishStep(op.Command, "running pre hooks")
+	if err := b.runHooks(ctx, hookStagePre, op, nil); err != nil {
+		return stepError(ctx, "running pre hooks", err)
+	}
+	// restarting viam-agent may restart this module too, so the operation is saved for the post hooks and
+	// the restart_completed webhook to pick up on the next start
+	pending := b.hasHooks(hookStagePost, op.Command) || b.hasWebhooks()
+	if pending {
+		if err := b.savePendingPostHooks(op); err != nil {
+			b.logger.Warnf("Error saving post hooks, they will not run if this module is restarted: %v", err)
+		}
+	}
+
+	unit := cfg.serviceUnit()
+	b.logger.Infof("Restarting %s", unit)
+	start := time.Now()
+	b.publishStep(op.Command, "restarting "+unit)
+	err = stepError(ctx, "restarting "+unit, serviceManager.Restart(ctx, unit))
+	if err == nil {
+		b.publishStep(op.Command, "waiting for "+unit+" to become active")
+		err = stepError(ctx, "waiting for "+unit+" to become active", waitForActive(ctx, serviceManager, unit, cfg.restartVerifyTimeout()))
+	}
+	if err == nil {
+		b.metrics.observe(metricRestartToHealthy, time.Since(start))
+	}
+
+	// this module survived the restart, so run the post hooks now instead of on the next start
+	if pending {
+		if _, takeErr := b.takePendingPostHooks(); takeErr != nil {
+			b.logger.Warnf("Error clearing pending post hooks: %v", takeErr)
+		}
+	}
+	b.publishStep(op.Command, "running post hooks")
+	if hookErr := b.runHooks(ctx, hookStagePost, op, err); hookErr != nil && err == nil {
+		return stepError(ctx, "running post hooks", hookErr)
+	}
 	return err
 }
 
+// waitForRdkVersion waits for viam-agent to point the viam-server symlink at the desired version
+func (b *RobotUpdateModule) waitForRdkVersion(ctx context.Context, version string) error {
+	b.publishStep("restart_on_rdk_update", "waiting for viam-server "+version)
+	start := time.Now()
+	defer func() { b.metrics.observe(metricVersionWait, time.Since(start)) }()
+	deadline := start.Add(rdkUpdateWait)
+	for {
+		if y, err := isVersion(version); err == nil && y {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("viam-server not updated after %v", rdkUpdateWait)
+		}
+		if err := sleepContext(ctx, min(rdkUpdatePollInterval, time.Until(deadline))); err != nil {
+			return stepError(ctx, "waiting for viam-server update", err)
+		}
+	}
+}
+
 func isVersion(version string) (bool, error) {
-	fi, err := os.Lstat("/opt/viam/bin/viam-server")
+	fi, err := os.Lstat(viamServerBinary)
 	if err != nil {
 		return false, err
 	}
 
 	if fi.Mode()&os.ModeSymlink != 0 {
-		link, err := os.Readlink("/opt/viam/bin/viam-server")
+		link, err := os.Readlink(viamServerBinary)
 		if err != nil {
 			return false, err
 		}
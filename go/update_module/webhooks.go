@@ -0,0 +1,391 @@
+package update_module
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const (
+	eventUpdateStarted     = "update_started"
+	eventUpdateSucceeded   = "update_succeeded"
+	eventUpdateFailed      = "update_failed"
+	eventUpdateRolledBack  = "update_rolled_back"
+	eventRestartScheduled  = "restart_scheduled"
+	eventRestartCompleted  = "restart_completed"
+	eventRestartFailed     = "restart_failed"
+	eventSnapshotRestored  = "snapshot_restored"
+	eventRevisionRestored  = "revision_restored"
+	webhookQueueFile       = "webhook_queue.json"
+	webhookSignatureHeader = "X-Viam-Update-Signature"
+	webhookEventHeader     = "X-Viam-Update-Event"
+	webhookIdHeader        = "X-Viam-Update-Delivery"
+	defaultWebhookTimeout  = 10 * time.Second
+	maxWebhookBackoff      = 5 * time.Minute
+	// deliveries that could not be made for this long, e.g. while the machine is offline, are dropped
+	maxWebhookAge = 24 * time.Hour
+)
+
+var (
+	webhookEvents = map[string]bool{
+		eventUpdateStarted:    true,
+		eventUpdateSucceeded:  true,
+		eventUpdateFailed:     true,
+		eventUpdateRolledBack: true,
+		eventRestartScheduled: true,
+		eventRestartCompleted: true,
+		eventRestartFailed:    true,
+		eventSnapshotRestored: true,
+		eventRevisionRestored: true,
+	}
+	initialWebhookBackoff = time.Second
+
+	errInvalidWebhook = errors.New("invalid webhook")
+)
+
+// Webhook receives a JSON POST for update lifecycle events
+type Webhook struct {
+	URL string `json:"url"`
+	// Secret signs the body with HMAC-SHA256, sent as X-Viam-Update-Signature: sha256=<hex>
+	Secret string `json:"secret,omitempty"`
+	// Events limits the webhook to some events, empty means all of them
+	Events         []string          `json:"events,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"`
+}
+
+func (w *Webhook) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: url must be an http or https URL", errInvalidWebhook)
+	}
+	for _, e := range w.Events {
+		if !webhookEvents[e] {
+			return fmt.Errorf("%w: unknown event %q", errInvalidWebhook, e)
+		}
+	}
+	if w.TimeoutSeconds < 0 {
+		return fmt.Errorf("%w: timeout_seconds must not be negative", errInvalidWebhook)
+	}
+	return nil
+}
+
+func (w *Webhook) wants(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookEvent is the JSON body posted to webhooks
+type webhookEvent struct {
+	ID        string            `json:"id"`
+	Event     string            `json:"event"`
+	Time      time.Time         `json:"time"`
+	Component string            `json:"component,omitempty"`
+	Params    map[string]string `json:"params,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// webhookDelivery is a queued event for one webhook. Deliveries are persisted so events raised while
+// offline, or just before viam-agent restarts this module, are still sent.
+type webhookDelivery struct {
+	URL         string       `json:"url"`
+	Event       webhookEvent `json:"event"`
+	Attempts    int          `json:"attempts"`
+	NextAttempt time.Time    `json:"next_attempt"`
+	LastError   string       `json:"last_error,omitempty"`
+}
+
+// eventParams are the operation's params and command for an event payload
+func (op operation) eventParams() map[string]string {
+	params := map[string]string{"command": op.Command}
+	for k, v := range op.Params {
+		params[k] = v
+	}
+	return params
+}
+
+// responseError returns err, or the error a command reported in its response without returning one
+func responseError(resp map[string]interface{}, err error) error {
+	if err != nil {
+		return err
+	}
+	if msg, ok := resp["error"]; ok {
+		return fmt.Errorf("%v", msg)
+	}
+	return nil
+}
+
+func newEventId() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprint(time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
+
+func (b *RobotUpdateModule) webhooks() []Webhook {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cfg == nil {
+		return nil
+	}
+	return b.cfg.Webhooks
+}
+
+func (b *RobotUpdateModule) hasWebhooks() bool {
+	return len(b.webhooks()) > 0
+}
+
+// notify publishes the event on the event bus, then queues it for every webhook that wants it and wakes
+// the delivery loop
+func (b *RobotUpdateModule) notify(event string, params map[string]string, eventErr error) {
+	b.events.publish(event, params, eventErr)
+	var deliveries []webhookDelivery
+	e := webhookEvent{ID: newEventId(), Event: event, Time: time.Now().UTC(), Params: params}
+	if b.Named != nil {
+		e.Component = b.Name().Name
+	}
+	if eventErr != nil {
+		e.Error = eventErr.Error()
+	}
+	for _, w := range b.webhooks() {
+		if w.wants(event) {
+			deliveries = append(deliveries, webhookDelivery{URL: w.URL, Event: e, NextAttempt: e.Time})
+		}
+	}
+	if len(deliveries) == 0 {
+		return
+	}
+
+	err := b.updateWebhookQueue(func(queue []webhookDelivery) []webhookDelivery {
+		return append(queue, deliveries...)
+	})
+	if err != nil {
+		b.logger.Errorf("Error queueing %s webhook: %v", event, err)
+		return
+	}
+	select {
+	case b.webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+func loadWebhookQueue(path string) ([]webhookDelivery, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var queue []webhookDelivery
+	if err := json.Unmarshal(data, &queue); err != nil {
+		return nil, err
+	}
+	return queue, nil
+}
+
+func saveWebhookQueue(path string, queue []webhookDelivery) error {
+	if len(queue) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(queue)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// readWebhookQueue returns the deliveries queued for this component
+func (b *RobotUpdateModule) readWebhookQueue() ([]webhookDelivery, error) {
+	path, err := b.componentFile(webhookQueueFile)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := lockDataFile(&b.webhookMu, path)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return loadWebhookQueue(path)
+}
+
+// updateWebhookQueue replaces this component's queue with what change returns, holding the queue's lock
+// so deliveries queued by other goroutines or the self update watchdog aren't lost
+func (b *RobotUpdateModule) updateWebhookQueue(change func([]webhookDelivery) []webhookDelivery) error {
+	path, err := b.componentFile(webhookQueueFile)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockDataFile(&b.webhookMu, path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	queue, err := loadWebhookQueue(path)
+	if err != nil {
+		return err
+	}
+	return saveWebhookQueue(path, change(queue))
+}
+
+// deliverWebhooks attempts every due delivery once and returns when the next one is due, or the zero
+// time if the queue is empty
+func (b *RobotUpdateModule) deliverWebhooks(ctx context.Context) time.Time {
+	queue, err := b.readWebhookQueue()
+	if err != nil {
+		b.logger.Errorf("Error reading webhook queue: %v", err)
+		return time.Time{}
+	}
+
+	webhooks := map[string]Webhook{}
+	for _, w := range b.webhooks() {
+		webhooks[w.URL] = w
+	}
+	now := time.Now()
+	done := map[string]bool{}
+	retry := map[string]webhookDelivery{}
+	for _, d := range queue {
+		key := d.URL + " " + d.Event.ID
+		w, ok := webhooks[d.URL]
+		if !ok {
+			b.logger.Infof("Dropping %s webhook for %s, it is no longer configured", d.Event.Event, d.URL)
+			done[key] = true
+			continue
+		}
+		if d.NextAttempt.After(now) {
+			continue
+		}
+		err := postWebhook(ctx, &w, d.Event)
+		if err == nil {
+			done[key] = true
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		d.Attempts++
+		d.LastError = err.Error()
+		if now.Sub(d.Event.Time) > maxWebhookAge {
+			b.logger.Errorf("Dropping %s webhook for %s after %d attempts: %v", d.Event.Event, d.URL, d.Attempts, err)
+			done[key] = true
+			continue
+		}
+		backoff := initialWebhookBackoff << min(d.Attempts-1, 20)
+		d.NextAttempt = now.Add(min(backoff, maxWebhookBackoff))
+		b.logger.Warnf("Error sending %s webhook to %s, retrying at %v: %v", d.Event.Event, d.URL, d.NextAttempt, err)
+		retry[key] = d
+	}
+
+	// events may have been queued while delivering, so merge into the queue as it is now
+	var next time.Time
+	err = b.updateWebhookQueue(func(queue []webhookDelivery) []webhookDelivery {
+		remaining := queue[:0]
+		for _, d := range queue {
+			key := d.URL + " " + d.Event.ID
+			if done[key] {
+				continue
+			}
+			if r, ok := retry[key]; ok {
+				d = r
+			}
+			if next.IsZero() || d.NextAttempt.Before(next) {
+				next = d.NextAttempt
+			}
+			remaining = append(remaining, d)
+		}
+		return remaining
+	})
+	if err != nil {
+		b.logger.Errorf("Error saving webhook queue: %v", err)
+		return time.Time{}
+	}
+	return next
+}
+
+func postWebhook(ctx context.Context, w *Webhook, e webhookEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	timeout := defaultWebhookTimeout
+	if w.TimeoutSeconds > 0 {
+		timeout = time.Duration(w.TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, e.Event)
+	req.Header.Set(webhookIdHeader, e.ID)
+	if w.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, "sha256="+webhookSignature(w.Secret, body))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+// webhookSignature is the hex HMAC-SHA256 of the body, receivers recompute it to verify the sender
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// runWebhooks delivers queued webhooks until ctx is done, waking when events are queued or retries are due
+func (b *RobotUpdateModule) runWebhooks(ctx context.Context) {
+	for {
+		next := b.deliverWebhooks(ctx)
+		var retry <-chan time.Time
+		var timer *time.Timer
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			retry = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-b.webhookWake:
+		case <-retry:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package update_module
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.viam.com/rdk/components/generic"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+)
+
+// webhookReceiver records the events posted to it, failing the first failures requests
+type webhookReceiver struct {
+	mu         sync.Mutex
+	failures   int
+	events     []webhookEvent
+	signatures []string
+	received   chan struct{}
+}
+
+func newWebhookReceiver(t *testing.T) (*webhookReceiver, *httptest.Server) {
+	r := &webhookReceiver{received: make(chan struct{}, 10)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.failures > 0 {
+			r.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		var e webhookEvent
+		require.NoError(t, json.Unmarshal(body, &e))
+		assert.Equal(t, e.Event, req.Header.Get(webhookEventHeader))
+		if sig := req.Header.Get(webhookSignatureHeader); sig != "" {
+			assert.Equal(t, "sha256="+webhookSignature("s3cret", body), sig)
+			r.signatures = append(r.signatures, sig)
+		}
+		r.events = append(r.events, e)
+		r.received <- struct{}{}
+	}))
+	t.Cleanup(server.Close)
+	return r, server
+}
+
+func (r *webhookReceiver) eventNames() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var names []string
+	for _, e := range r.events {
+		names = append(names, e.Event)
+	}
+	return names
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	ctx := context.Background()
+	receiver, server := newWebhookReceiver(t)
+	manager := &fakeServiceManager{}
+	cfg := &Config{Webhooks: []Webhook{
+		{URL: server.URL, Secret: "s3cret"},
+		{URL: server.URL + "/failures", Events: []string{eventRestartFailed}},
+	}}
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: ctx, cfg: cfg, serviceManager: manager}
+
+	_, err := module.DoCommand(ctx, map[string]interface{}{"command": "restart", "delay_seconds": 0})
+	require.NoError(t, err)
+	module.scheduleRestart(time.Now().Add(time.Hour), operation{Command: "restart"})
+	_, err = module.cancelRestart()
+	require.NoError(t, err)
+
+	queue, err := module.readWebhookQueue()
+	require.NoError(t, err)
+	assert.Len(t, queue, 2)
+	assert.True(t, module.deliverWebhooks(ctx).IsZero())
+	assert.Equal(t, []string{eventRestartCompleted, eventRestartScheduled}, receiver.eventNames())
+	assert.Len(t, receiver.signatures, 2)
+	assert.Equal(t, "restart", receiver.events[0].Params["command"])
+	assert.NotEmpty(t, receiver.events[1].Params["restart_at"])
+
+	manager.restartErr = errors.New("access denied")
+	_, err = module.DoCommand(ctx, map[string]interface{}{"command": "restart", "delay_seconds": 0})
+	require.Error(t, err)
+	assert.True(t, module.deliverWebhooks(ctx).IsZero())
+	names := receiver.eventNames()
+	assert.Equal(t, []string{eventRestartFailed, eventRestartFailed}, names[2:])
+	assert.Contains(t, receiver.events[2].Error, "access denied")
+}
+
+func TestWebhookRetry(t *testing.T) {
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	ctx := context.Background()
+	defer func(backoff time.Duration) { initialWebhookBackoff = backoff }(initialWebhookBackoff)
+	initialWebhookBackoff = time.Minute
+
+	receiver, server := newWebhookReceiver(t)
+	receiver.failures = 1
+	module := RobotUpdateModule{logger: logging.NewTestLogger(t), ctx: ctx, cfg: &Config{Webhooks: []Webhook{{URL: server.URL}}}}
+
+	module.notify(eventUpdateStarted, map[string]string{"new_fragment_id": "frag"}, nil)
+	next := module.deliverWebhooks(ctx)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), next, 10*time.Second)
+	queue, err := module.readWebhookQueue()
+	require.NoError(t, err)
+	require.Len(t, queue, 1)
+	assert.Equal(t, 1, queue[0].Attempts)
+	assert.Contains(t, queue[0].LastError, "503")
+
+	// not due yet
+	module.deliverWebhooks(ctx)
+	assert.Empty(t, receiver.eventNames())
+
+	queue[0].NextAttempt = time.Now()
+	require.NoError(t, module.updateWebhookQueue(func([]webhookDelivery) []webhookDelivery { return queue }))
+	assert.True(t, module.deliverWebhooks(ctx).IsZero())
+	assert.Equal(t, []string{eventUpdateStarted}, receiver.eventNames())
+	queue, err = module.readWebhookQueue()
+	require.NoError(t, err)
+	assert.Empty(t, queue)
+
+	// deliveries for webhooks that are no longer configured are dropped
+	module.notify(eventUpdateFailed, nil, errors.New("boom"))
+	module.cfg = &Config{}
+	assert.True(t, module.deliverWebhooks(ctx).IsZero())
+	assert.Len(t, receiver.eventNames(), 1)
+}
+
+func TestRunWebhooks(t *testing.T) {
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	ctx, cancel := context.WithCancel(context.Background())
+	receiver, server := newWebhookReceiver(t)
+	module := RobotUpdateModule{
+		logger:      logging.NewTestLogger(t),
+		ctx:         ctx,
+		cfg:         &Config{Webhooks: []Webhook{{URL: server.URL}}},
+		webhookWake: make(chan struct{}, 1),
+	}
+	done := make(chan struct{})
+	go func() {
+		module.runWebhooks(ctx)
+		close(done)
+	}()
+
+	module.notify(eventUpdateSucceeded, nil, nil)
+	select {
+	case <-receiver.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not delivered")
+	}
+	cancel()
+	<-done
+}
+
+func TestWebhookValidate(t *testing.T) {
+	assert.NoError(t, (&Webhook{URL: "https://example.com/hook", Events: []string{eventUpdateFailed}}).validate())
+	assert.ErrorIs(t, (&Webhook{URL: "example.com/hook"}).validate(), errInvalidWebhook)
+	assert.ErrorIs(t, (&Webhook{URL: "https://example.com", Events: []string{"update_exploded"}}).validate(), errInvalidWebhook)
+	_, err := (&Config{Webhooks: []Webhook{{URL: "ftp://example.com"}}}).Validate("path")
+	assert.ErrorIs(t, err, errInvalidWebhook)
+}
+
+func TestWebhookQueuePerComponent(t *testing.T) {
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	ctx := context.Background()
+	receiver, server := newWebhookReceiver(t)
+	cfg := &Config{Webhooks: []Webhook{{URL: server.URL}}}
+	first := RobotUpdateModule{Named: resource.NewName(generic.API, "first").AsNamed(), logger: logging.NewTestLogger(t), ctx: ctx, cfg: cfg}
+	second := RobotUpdateModule{Named: resource.NewName(generic.API, "second").AsNamed(), logger: logging.NewTestLogger(t), ctx: ctx, cfg: cfg}
+
+	// components sharing the data directory keep their own queues, delivering one leaves the other
+	first.notify(eventUpdateStarted, nil, nil)
+	second.notify(eventUpdateFailed, nil, nil)
+	assert.True(t, first.deliverWebhooks(ctx).IsZero())
+	assert.Equal(t, []string{eventUpdateStarted}, receiver.eventNames())
+	queue, err := second.readWebhookQueue()
+	require.NoError(t, err)
+	require.Len(t, queue, 1)
+	assert.Equal(t, "second", queue[0].Event.Component)
+
+	// the self update watchdog queues into the queue of the component it supervises
+	watchdog := RobotUpdateModule{Named: resource.NewName(generic.API, "second").AsNamed(), logger: logging.NewTestLogger(t), ctx: ctx, cfg: cfg}
+	watchdog.notify(eventUpdateSucceeded, nil, nil)
+	assert.True(t, second.deliverWebhooks(ctx).IsZero())
+	assert.Equal(t, []string{eventUpdateStarted, eventUpdateFailed, eventUpdateSucceeded}, receiver.eventNames())
+}